@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package bundle reads files out of tar and zip archives, such as the artifact
+// bundles published by CI pipelines.
+package bundle
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/glob"
+	"github.com/dpeckett/aptify/internal/util"
+	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/uncompr"
+)
+
+// Separator separates the path of an archive from the pattern of the files
+// within it, eg. "artifacts.tar.gz!/**/*.deb".
+const Separator = "!/"
+
+// Split splits a pattern of the form "archive!/pattern" into the path of the
+// archive and the pattern of the files within the archive.
+func Split(pattern string) (archivePath, innerPattern string, ok bool) {
+	return strings.Cut(pattern, Separator)
+}
+
+// Walk calls fn for every regular file within the archive whose path matches
+// the pattern. Tar archives may be compressed (with any compression supported
+// by uncompr), zip archives are detected by their ".zip" extension (in any
+// case). The data size and compression ratio limits are applied when
+// decompressing tar archives, and to each member of zip archives (as they are
+// compressed individually).
+func Walk(ctx context.Context, archivePath, pattern string, limits deb.Limits, fn func(name string, r io.Reader) error) error {
+	if err := glob.Validate(pattern); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	fsys, cleanup, err := open(ctx, f, limits)
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %w", archivePath, err)
+	}
+	defer cleanup()
+
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to walk archive %s: %w", archivePath, err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if ok, _ := glob.Match(pattern, filepath.FromSlash(name)); !ok {
+			return nil
+		}
+
+		entry, err := fsys.Open(name)
+		if err != nil {
+			return fmt.Errorf("failed to open %s in archive %s: %w", name, archivePath, err)
+		}
+		defer entry.Close()
+
+		fi, err := entry.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat %s in archive %s: %w", name, archivePath, err)
+		}
+
+		fh, ok := fi.Sys().(*zip.FileHeader)
+		if !ok {
+			return fn(name, entry)
+		}
+
+		// Decompress the zip member through the limits.
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			_, err := limits.CopyDecompressed(pw, entry, archivePath+Separator+name, int64(fh.CompressedSize64))
+			_ = pw.CloseWithError(err)
+		}()
+		defer func() {
+			// Wait for the copy to stop before the member is closed.
+			_ = pr.Close()
+			<-done
+		}()
+
+		return fn(name, pr)
+	})
+}
+
+func open(ctx context.Context, f *os.File, limits deb.Limits) (fs.FS, func(), error) {
+	noop := func() {}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, noop, err
+	}
+
+	ext := strings.ToLower(filepath.Ext(f.Name()))
+
+	if ext == ".zip" {
+		fsys, err := zip.NewReader(f, fi.Size())
+		return fsys, noop, err
+	}
+
+	if ext == ".tar" {
+		fsys, err := tarfs.Open(f)
+		return fsys, noop, err
+	}
+
+	r, err := uncompr.NewReader(f)
+	if err != nil {
+		return nil, noop, fmt.Errorf("failed to decompress archive: %w", err)
+	}
+	defer r.Close()
+
+	// Write the decompressed archive to a temporary file (as we need a seekable
+	// reader for the tarfs implementation).
+	tempFile, err := os.CreateTemp("", "bundle.tar")
+	if err != nil {
+		return nil, noop, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup := func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}
+
+	if _, err := limits.CopyDecompressed(tempFile, util.NewContextReader(ctx, r), f.Name(), fi.Size()); err != nil {
+		cleanup()
+		return nil, noop, fmt.Errorf("failed to decompress archive: %w", err)
+	}
+
+	fsys, err := tarfs.Open(tempFile)
+	if err != nil {
+		cleanup()
+		return nil, noop, err
+	}
+
+	return fsys, cleanup, nil
+}
@@ -0,0 +1,228 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/fetch"
+	"github.com/dpeckett/aptify/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+var files = []testutil.File{
+	{Name: "debs/", Typeflag: '5'},
+	{Name: "debs/hello_1.0_amd64.deb", Body: []byte("hello")},
+	{Name: "debs/hello-dbgsym_1.0_amd64.deb", Body: []byte("hello-dbgsym")},
+	{Name: "debs/nested/world_1.0_all.deb", Body: []byte("world")},
+	{Name: "README", Body: []byte("readme")},
+}
+
+func writeArchives(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bundle.tar"), testutil.Tar(t, files), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bundle.tar.gz"), testutil.TarGz(t, files), 0o644))
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		if f.Typeflag == '5' {
+			continue
+		}
+
+		w, err := zw.Create(f.Name)
+		require.NoError(t, err)
+		_, err = w.Write(f.Body)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bundle.zip"), buf.Bytes(), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "BUNDLE.ZIP"), buf.Bytes(), 0o644))
+
+	return dir
+}
+
+func TestSplit(t *testing.T) {
+	archivePath, innerPattern, ok := Split("artifacts/*.tar.gz!/**/*.deb")
+	require.True(t, ok)
+	require.Equal(t, "artifacts/*.tar.gz", archivePath)
+	require.Equal(t, "**/*.deb", innerPattern)
+
+	_, _, ok = Split("dist/*.deb")
+	require.False(t, ok)
+}
+
+func TestWalk(t *testing.T) {
+	ctx := context.Background()
+	dir := writeArchives(t)
+
+	for _, name := range []string{"bundle.tar", "bundle.tar.gz", "bundle.zip", "BUNDLE.ZIP"} {
+		t.Run(name, func(t *testing.T) {
+			contents := make(map[string]string)
+			err := Walk(ctx, filepath.Join(dir, name), filepath.Join("**", "*.deb"), deb.DefaultLimits, func(name string, r io.Reader) error {
+				data, err := io.ReadAll(r)
+				contents[name] = string(data)
+				return err
+			})
+			require.NoError(t, err)
+
+			require.Equal(t, map[string]string{
+				"debs/hello_1.0_amd64.deb":        "hello",
+				"debs/hello-dbgsym_1.0_amd64.deb": "hello-dbgsym",
+				"debs/nested/world_1.0_all.deb":   "world",
+			}, contents)
+		})
+	}
+
+	t.Run("Invalid Pattern", func(t *testing.T) {
+		err := Walk(ctx, filepath.Join(dir, "bundle.tar"), "[", deb.DefaultLimits, func(string, io.Reader) error {
+			return nil
+		})
+		require.ErrorContains(t, err, "invalid pattern")
+	})
+
+	t.Run("Decompression Bomb", func(t *testing.T) {
+		bombPath := filepath.Join(t.TempDir(), "bomb.tar.gz")
+		require.NoError(t, os.WriteFile(bombPath, testutil.TarGz(t, []testutil.File{
+			{Name: "zeros.deb", Body: make([]byte, 4<<20)},
+		}), 0o644))
+
+		for _, limits := range []deb.Limits{{MaxDataSize: 1 << 20}, {MaxRatio: 10}} {
+			err := Walk(ctx, bombPath, "*.deb", limits, func(string, io.Reader) error {
+				t.Fatal("bomb should not have been read")
+				return nil
+			})
+
+			var limitErr *deb.LimitExceededError
+			require.ErrorAs(t, err, &limitErr)
+		}
+	})
+
+	t.Run("Zip Decompression Bomb", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create("zeros.deb")
+		require.NoError(t, err)
+		_, err = w.Write(make([]byte, 4<<20))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		bombPath := filepath.Join(t.TempDir(), "bomb.zip")
+		require.NoError(t, os.WriteFile(bombPath, buf.Bytes(), 0o644))
+
+		for _, limits := range []deb.Limits{{MaxDataSize: 1 << 20}, {MaxRatio: 10}} {
+			var n int64
+			err := Walk(ctx, bombPath, "*.deb", limits, func(_ string, r io.Reader) error {
+				var err error
+				n, err = io.Copy(io.Discard, r)
+				return err
+			})
+
+			var limitErr *deb.LimitExceededError
+			require.ErrorAs(t, err, &limitErr)
+			require.Less(t, n, int64(4<<20))
+		}
+	})
+}
+
+func TestExtract(t *testing.T) {
+	ctx := context.Background()
+	dir := writeArchives(t)
+
+	var walks int
+	walk = func(ctx context.Context, archivePath, pattern string, limits deb.Limits, fn func(name string, r io.Reader) error) error {
+		walks++
+		return Walk(ctx, archivePath, pattern, limits, fn)
+	}
+	t.Cleanup(func() {
+		walk = Walk
+	})
+
+	fetcher := fetch.NewFetcher(t.TempDir(), nil)
+	archivePath := filepath.Join(dir, "bundle.tar.gz")
+	pattern := filepath.Join("**", "*.deb")
+
+	isDebug := func(name string) bool {
+		return strings.Contains(name, "-dbgsym_")
+	}
+
+	names := func(members []Member) []string {
+		var names []string
+		for _, member := range members {
+			data, err := os.ReadFile(member.Path)
+			require.NoError(t, err)
+			require.Equal(t, member.Name, map[string]string{
+				"hello":        "debs/hello_1.0_amd64.deb",
+				"hello-dbgsym": "debs/hello-dbgsym_1.0_amd64.deb",
+				"world":        "debs/nested/world_1.0_all.deb",
+			}[string(data)])
+
+			names = append(names, member.Name)
+		}
+		return names
+	}
+
+	members, err := Extract(ctx, archivePath, pattern, deb.DefaultLimits, fetcher, isDebug)
+	require.NoError(t, err)
+	require.Equal(t, []string{"debs/hello_1.0_amd64.deb", "debs/nested/world_1.0_all.deb"}, names(members))
+	require.Equal(t, 1, walks)
+
+	t.Run("Unchanged", func(t *testing.T) {
+		members, err := Extract(ctx, archivePath, pattern, deb.DefaultLimits, fetcher, isDebug)
+		require.NoError(t, err)
+		require.Equal(t, []string{"debs/hello_1.0_amd64.deb", "debs/nested/world_1.0_all.deb"}, names(members))
+		require.Equal(t, 1, walks, "unchanged archive was read again")
+	})
+
+	t.Run("Skipped File Needed", func(t *testing.T) {
+		members, err := Extract(ctx, archivePath, pattern, deb.DefaultLimits, fetcher, func(string) bool { return false })
+		require.NoError(t, err)
+		require.Len(t, names(members), 3)
+		require.Equal(t, 2, walks)
+	})
+
+	t.Run("Missing From Cache", func(t *testing.T) {
+		require.NoError(t, os.Remove(members[0].Path))
+
+		members, err := Extract(ctx, archivePath, pattern, deb.DefaultLimits, fetcher, isDebug)
+		require.NoError(t, err)
+		require.Len(t, names(members), 2)
+		require.Equal(t, 3, walks)
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(archivePath, testutil.TarGz(t, files[:2]), 0o644))
+
+		members, err := Extract(ctx, archivePath, pattern, deb.DefaultLimits, fetcher, isDebug)
+		require.NoError(t, err)
+		require.Equal(t, []string{"debs/hello_1.0_amd64.deb"}, names(members))
+		require.Equal(t, 4, walks)
+	})
+}
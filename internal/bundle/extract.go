@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/fetch"
+	"github.com/dpeckett/aptify/internal/sha256sum"
+)
+
+// walk is a variable so that it can be overridden in tests.
+var walk = Walk
+
+// Member is a file that was extracted from an archive.
+type Member struct {
+	// Name is the path of the file within the archive.
+	Name string
+	// Path is the path of the extracted file in the fetcher's cache.
+	Path string
+}
+
+// index records the files that were extracted from an archive, for each
+// pattern, so that unchanged archives don't need to be read again.
+type index struct {
+	Patterns map[string][]indexEntry `json:"patterns"`
+}
+
+type indexEntry struct {
+	Name string `json:"name"`
+	// SHA256 is the sha256sum of the extracted file, or empty if the file was
+	// skipped.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Extract extracts the regular files within the archive that match the
+// pattern (and that are not skipped) into the fetcher's cache. Archives are
+// identified by their sha256sum, the files are only extracted again if the
+// archive has changed (or the cached files are missing).
+func Extract(ctx context.Context, archivePath, pattern string, limits deb.Limits, fetcher *fetch.Fetcher, skip func(name string) bool) ([]Member, error) {
+	archiveSHA256, err := sha256sum.File(ctx, archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash archive %s: %w", archivePath, err)
+	}
+
+	indexPath := fetcher.MetadataPath(archiveSHA256)
+
+	idx, err := readIndex(indexPath)
+	if err != nil {
+		slog.Warn("Ignoring corrupt archive index", slog.String("path", indexPath), slog.Any("error", err))
+		idx = &index{}
+	}
+
+	if members, ok := cachedMembers(idx.Patterns[pattern], fetcher, skip); ok {
+		slog.Debug("Using previously extracted files", slog.String("archive", archivePath))
+		return members, nil
+	}
+
+	var members []Member
+	var entries []indexEntry
+	err = walk(ctx, archivePath, pattern, limits, func(name string, r io.Reader) error {
+		if skip(name) {
+			entries = append(entries, indexEntry{Name: name})
+			return nil
+		}
+
+		path, err := fetcher.Store(ctx, archivePath+Separator+name, r)
+		if err != nil {
+			return err
+		}
+
+		members = append(members, Member{Name: name, Path: path})
+		entries = append(entries, indexEntry{Name: name, SHA256: filepath.Base(path)})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if idx.Patterns == nil {
+		idx.Patterns = make(map[string][]indexEntry)
+	}
+	idx.Patterns[pattern] = entries
+
+	// The index is only an optimization.
+	if err := writeIndex(indexPath, idx); err != nil {
+		slog.Warn("Failed to write archive index", slog.String("path", indexPath), slog.Any("error", err))
+	}
+
+	return members, nil
+}
+
+// cachedMembers returns the previously extracted files, provided every file
+// that is needed is still in the cache.
+func cachedMembers(entries []indexEntry, fetcher *fetch.Fetcher, skip func(name string) bool) ([]Member, bool) {
+	if entries == nil {
+		return nil, false
+	}
+
+	members := []Member{}
+	for _, entry := range entries {
+		if skip(entry.Name) {
+			continue
+		}
+
+		if entry.SHA256 == "" {
+			return nil, false
+		}
+
+		path := fetcher.Path(entry.SHA256)
+		if _, err := os.Stat(path); err != nil {
+			return nil, false
+		}
+
+		members = append(members, Member{Name: entry.Name, Path: path})
+	}
+
+	return members, true
+}
+
+func readIndex(path string) (*index, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &index{}, nil
+		}
+
+		return nil, err
+	}
+
+	var idx index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, err
+	}
+
+	return &idx, nil
+}
+
+func writeIndex(path string, idx *index) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".index-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
@@ -19,38 +19,65 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 
 	configtypes "github.com/dpeckett/aptify/internal/config/types"
-	latestconfig "github.com/dpeckett/aptify/internal/config/v1alpha1"
+	"github.com/dpeckett/aptify/internal/config/v1alpha1"
+	latestconfig "github.com/dpeckett/aptify/internal/config/v1alpha2"
 	"gopkg.in/yaml.v3"
 )
 
-// FromYAML reads the given reader and returns a config object.
-func FromYAML(r io.Reader) (*latestconfig.Repository, error) {
+// FromYAML reads the given reader and returns a config object. Variables and
+// templates in the config are expanded using lookupVar (or the environment,
+// if lookupVar is nil). Any included files are merged into the config, with
+// relative paths resolved against the current directory.
+func FromYAML(r io.Reader, lookupVar LookupFunc) (*latestconfig.Repository, error) {
+	conf, err := decode(r, lookupVar)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conf.Include) == 0 {
+		return conf, nil
+	}
+
+	l := newLoader(lookupVar)
+	if err := l.mergeWithIncludes("config", ".", conf); err != nil {
+		return nil, err
+	}
+
+	return l.conf, nil
+}
+
+// decode reads a single config file, without merging any included files.
+func decode(r io.Reader, lookupVar LookupFunc) (*latestconfig.Repository, error) {
 	confBytes, err := io.ReadAll(r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config from reader: %w", err)
 	}
 
+	var root yaml.Node
+	if err := yaml.Unmarshal(confBytes, &root); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config file: %w", err)
+	}
+
+	if err := interpolate(&root, lookupVar); err != nil {
+		return nil, fmt.Errorf("failed to expand variables in config file: %w", err)
+	}
+
 	var typeMeta configtypes.TypeMeta
-	if err := yaml.Unmarshal(confBytes, &typeMeta); err != nil {
+	if err := root.Decode(&typeMeta); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal type meta from config file: %w", err)
 	}
 
-	var versionedConf configtypes.Config
-	switch typeMeta.APIVersion {
-	case latestconfig.APIVersion:
-		versionedConf, err = latestconfig.GetConfigByKind(typeMeta.Kind)
-	default:
-		return nil, fmt.Errorf("unsupported api version: %s", typeMeta.APIVersion)
-	}
+	versionedConf, err := GetConfigByAPIVersion(typeMeta.APIVersion, typeMeta.Kind)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get config by kind %q: %w", typeMeta.Kind, err)
+		return nil, fmt.Errorf("failed to get config: %w", err)
 	}
 
-	if err := yaml.Unmarshal(confBytes, versionedConf); err != nil {
+	if err := root.Decode(versionedConf); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config from config file: %w", err)
 	}
 
@@ -62,20 +89,64 @@ func FromYAML(r io.Reader) (*latestconfig.Repository, error) {
 	return versionedConf.(*latestconfig.Repository), nil
 }
 
+// Migrate reads a config from r and, if it is not already at the latest
+// version, writes the migrated config to w. Returns true if the config was
+// migrated.
+func Migrate(r io.Reader, w io.Writer) (bool, error) {
+	confBytes, err := io.ReadAll(r)
+	if err != nil {
+		return false, fmt.Errorf("failed to read config from reader: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(confBytes, &root); err != nil {
+		return false, fmt.Errorf("failed to unmarshal config file: %w", err)
+	}
+
+	var typeMeta configtypes.TypeMeta
+	if err := root.Decode(&typeMeta); err != nil {
+		return false, fmt.Errorf("failed to unmarshal type meta from config file: %w", err)
+	}
+
+	if usesTemplating(&root) {
+		if typeMeta.APIVersion == latestconfig.APIVersion {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("config uses variables or templates, which would be lost by migration")
+	}
+
+	conf, err := decode(bytes.NewReader(confBytes), nil)
+	if err != nil {
+		return false, err
+	}
+
+	if typeMeta.APIVersion == latestconfig.APIVersion {
+		return false, nil
+	}
+
+	return true, ToYAML(w, conf)
+}
+
 // ToYAML writes the given config object to the given writer.
 func ToYAML(w io.Writer, versionedConf configtypes.Config) error {
 	versionedConf.PopulateTypeMeta()
 
-	if err := yaml.NewEncoder(w).Encode(versionedConf); err != nil {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(versionedConf); err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
-	return nil
+	return enc.Close()
 }
 
 // MigrateToLatest migrates the given config object to the latest version.
 func MigrateToLatest(versionedConf configtypes.Config) (configtypes.Config, error) {
 	switch conf := versionedConf.(type) {
+	case *v1alpha1.Repository:
+		return MigrateToLatest(migrateV1Alpha1ToV1Alpha2(conf))
 	case *latestconfig.Repository:
 		// Nothing to do, already at the latest version.
 		return conf, nil
@@ -83,3 +154,75 @@ func MigrateToLatest(versionedConf configtypes.Config) (configtypes.Config, erro
 		return nil, fmt.Errorf("unsupported config version: %s", conf.GetAPIVersion())
 	}
 }
+
+// migrateV1Alpha1ToV1Alpha2 moves the repository-wide settings of a v1alpha1
+// config into the settings section of v1alpha2. Releases and components are
+// otherwise unchanged.
+func migrateV1Alpha1ToV1Alpha2(conf *v1alpha1.Repository) *latestconfig.Repository {
+	migrated := &latestconfig.Repository{
+		Settings: latestconfig.Settings{
+			PoolMode:        conf.PoolMode,
+			DuplicatePolicy: conf.DuplicatePolicy,
+		},
+	}
+	migrated.PopulateTypeMeta()
+
+	if conf.Limits != nil {
+		limits := latestconfig.LimitsConfig(*conf.Limits)
+		migrated.Settings.Limits = &limits
+	}
+
+	if conf.Lint != nil {
+		lint := latestconfig.LintConfig(*conf.Lint)
+		migrated.Settings.Lint = &lint
+	}
+
+	if conf.Provenance != nil {
+		provenance := latestconfig.ProvenanceConfig(*conf.Provenance)
+		migrated.Settings.Provenance = &provenance
+	}
+
+	for _, releaseConf := range conf.Releases {
+		release := latestconfig.ReleaseConfig{
+			Name:          releaseConf.Name,
+			Version:       releaseConf.Version,
+			Origin:        releaseConf.Origin,
+			Label:         releaseConf.Label,
+			Suite:         releaseConf.Suite,
+			Description:   releaseConf.Description,
+			Architectures: releaseConf.Architectures,
+		}
+
+		for _, componentConf := range releaseConf.Components {
+			component := latestconfig.ComponentConfig{
+				Name:     componentConf.Name,
+				Packages: componentConf.Packages,
+				Exclude:  componentConf.Exclude,
+			}
+
+			for _, urlConf := range componentConf.URLs {
+				component.URLs = append(component.URLs, latestconfig.URLConfig(urlConf))
+			}
+
+			for _, ociConf := range componentConf.OCI {
+				component.OCI = append(component.OCI, latestconfig.OCIConfig(ociConf))
+			}
+
+			if componentConf.Filter != nil {
+				filter := latestconfig.FilterConfig(*componentConf.Filter)
+				component.Filter = &filter
+			}
+
+			if componentConf.Retention != nil {
+				retention := latestconfig.RetentionConfig(*componentConf.Retention)
+				component.Retention = &retention
+			}
+
+			release.Components = append(release.Components, component)
+		}
+
+		migrated.Releases = append(migrated.Releases, release)
+	}
+
+	return migrated
+}
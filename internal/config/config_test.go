@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha1"
+	latestconfig "github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/stretchr/testify/require"
+)
+
+const v1alpha1Config = `apiVersion: aptify/v1alpha1
+kind: Repository
+poolMode: hardlink
+duplicatePolicy: last-wins
+limits:
+  maxEntries: 1000
+lint:
+  enabled: true
+  severities:
+    maintainer: ignore
+provenance:
+  metadataFromEnv:
+    - CI_JOB_ID
+  attestations: true
+releases:
+  - name: bookworm
+    origin: Example
+    architectures:
+      - amd64
+    components:
+      - name: main
+        packages:
+          - debs/*.deb
+        urls:
+          - url: https://example.com/hello_1.0_amd64.deb
+            sha256: aaaa
+        oci:
+          - repository: ghcr.io/example/debs
+            tags: v1.*
+        exclude:
+          - debs/*-dbg_*.deb
+        filter:
+          sections:
+            - utils
+        retention:
+          keepLatest: 2
+          keepNewerThan: 720h
+`
+
+func TestFromYAML(t *testing.T) {
+	t.Run("v1alpha1", func(t *testing.T) {
+		conf, err := FromYAML(strings.NewReader(v1alpha1Config), nil)
+		require.NoError(t, err)
+
+		require.Equal(t, latestconfig.APIVersion, conf.APIVersion)
+		require.Equal(t, "Repository", conf.Kind)
+
+		require.Equal(t, latestconfig.Settings{
+			PoolMode:        "hardlink",
+			DuplicatePolicy: "last-wins",
+			Limits:          &latestconfig.LimitsConfig{MaxEntries: 1000},
+			Lint: &latestconfig.LintConfig{
+				Enabled:    true,
+				Severities: map[string]string{"maintainer": "ignore"},
+			},
+			Provenance: &latestconfig.ProvenanceConfig{
+				MetadataFromEnv: []string{"CI_JOB_ID"},
+				Attestations:    true,
+			},
+		}, conf.Settings)
+
+		require.Equal(t, []latestconfig.ReleaseConfig{{
+			Name:          "bookworm",
+			Origin:        "Example",
+			Architectures: []string{"amd64"},
+			Components: []latestconfig.ComponentConfig{{
+				Name:     "main",
+				Packages: []string{"debs/*.deb"},
+				URLs: []latestconfig.URLConfig{{
+					URL:    "https://example.com/hello_1.0_amd64.deb",
+					SHA256: "aaaa",
+				}},
+				OCI: []latestconfig.OCIConfig{{
+					Repository: "ghcr.io/example/debs",
+					Tags:       "v1.*",
+				}},
+				Exclude: []string{"debs/*-dbg_*.deb"},
+				Filter:  &latestconfig.FilterConfig{Sections: []string{"utils"}},
+				Retention: &latestconfig.RetentionConfig{
+					KeepLatest:    2,
+					KeepNewerThan: 720 * time.Hour,
+				},
+			}},
+		}}, conf.Releases)
+	})
+
+	t.Run("Unsupported Version", func(t *testing.T) {
+		_, err := FromYAML(strings.NewReader("apiVersion: aptify/v1\nkind: Repository\n"), nil)
+		require.Error(t, err)
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	t.Run("v1alpha1", func(t *testing.T) {
+		var migrated bytes.Buffer
+		ok, err := Migrate(strings.NewReader(v1alpha1Config), &migrated)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		require.Contains(t, migrated.String(), "apiVersion: aptify/v1alpha2\n")
+		require.Contains(t, migrated.String(), "settings:\n  poolMode: hardlink\n")
+
+		// The migrated config decodes to the same config.
+		expected, err := FromYAML(strings.NewReader(v1alpha1Config), nil)
+		require.NoError(t, err)
+
+		conf, err := FromYAML(bytes.NewReader(migrated.Bytes()), nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, conf)
+
+		// Migrating again is a no-op.
+		var remigrated bytes.Buffer
+		ok, err = Migrate(bytes.NewReader(migrated.Bytes()), &remigrated)
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.Empty(t, remigrated.String())
+	})
+
+	t.Run("Templating", func(t *testing.T) {
+		conf := "apiVersion: aptify/v1alpha1\nkind: Repository\nreleases:\n  - name: ${RELEASE}\n"
+
+		_, err := Migrate(strings.NewReader(conf), &bytes.Buffer{})
+		require.ErrorContains(t, err, "would be lost by migration")
+
+		conf = strings.Replace(conf, "v1alpha1", "v1alpha2", 1)
+
+		ok, err := Migrate(strings.NewReader(conf), &bytes.Buffer{})
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := Migrate(strings.NewReader("apiVersion: aptify/v1alpha1\nkind: Repository\nreleases: {\n"), &bytes.Buffer{})
+		require.Error(t, err)
+	})
+}
+
+func TestMigrateToLatest(t *testing.T) {
+	conf, err := MigrateToLatest(&v1alpha1.Repository{
+		PoolMode: "symlink",
+		Releases: []v1alpha1.ReleaseConfig{{Name: "stable"}},
+	})
+	require.NoError(t, err)
+
+	migrated, ok := conf.(*latestconfig.Repository)
+	require.True(t, ok)
+	require.Equal(t, latestconfig.APIVersion, migrated.APIVersion)
+	require.Equal(t, "symlink", migrated.Settings.PoolMode)
+	require.Equal(t, []latestconfig.ReleaseConfig{{Name: "stable"}}, migrated.Releases)
+}
@@ -0,0 +1,303 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+
+	"github.com/dpeckett/aptify/internal/bundle"
+	latestconfig "github.com/dpeckett/aptify/internal/config/v1alpha2"
+)
+
+// Load reads the config file (or directory of config fragments) at path, along
+// with any files it includes, and returns the merged config and the paths of
+// every file that was read.
+//
+// Fragments are merged as follows: the settings and defaults may each only be
+// set by one file, releases with the same name in different files are combined
+// (but only one file may set the fields of a release other than its
+// components), and a component may only be defined once within a release.
+//
+// Relative package and exclude patterns within included files are resolved
+// against the directory of the included file.
+func Load(path string, lookupVar LookupFunc) (*latestconfig.Repository, []string, error) {
+	l := newLoader(lookupVar)
+	if err := l.load(path, false); err != nil {
+		return nil, nil, err
+	}
+
+	return l.conf, l.files, nil
+}
+
+// Fragments returns the config files (with a .yaml or .yml extension) within
+// a directory, in lexical order.
+func Fragments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config directory: %w", err)
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// loader merges config files together.
+type loader struct {
+	lookupVar LookupFunc
+	conf      *latestconfig.Repository
+	files     []string
+	// loaded is the set of files that have been read, and loading is the set
+	// of files whose includes are currently being read (to detect cycles).
+	loaded  map[string]bool
+	loading map[string]bool
+	// Where each part of the config was defined, for reporting conflicts.
+	settingsFrom   string
+	defaultsFrom   string
+	releaseFrom    map[string]string
+	componentsFrom map[string]map[string]string
+}
+
+func newLoader(lookupVar LookupFunc) *loader {
+	conf := &latestconfig.Repository{}
+	conf.PopulateTypeMeta()
+
+	return &loader{
+		lookupVar:      lookupVar,
+		conf:           conf,
+		loaded:         make(map[string]bool),
+		loading:        make(map[string]bool),
+		releaseFrom:    make(map[string]string),
+		componentsFrom: make(map[string]map[string]string),
+	}
+}
+
+// load reads a config file, or every config fragment within a directory.
+func (l *loader) load(path string, included bool) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat config: %w", err)
+	}
+
+	if !fi.IsDir() {
+		return l.loadFile(path, included)
+	}
+
+	paths, err := Fragments(path)
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 {
+		return fmt.Errorf("no config files found in %s", path)
+	}
+
+	for _, path := range paths {
+		if err := l.loadFile(path, included); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *loader) loadFile(path string, included bool) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path of %s: %w", path, err)
+	}
+
+	if l.loading[absPath] {
+		return fmt.Errorf("config %s includes itself", path)
+	}
+
+	// Files included more than once (eg. by several fragments) are only
+	// merged the first time.
+	if l.loaded[absPath] {
+		return nil
+	}
+	l.loaded[absPath] = true
+	l.files = append(l.files, path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	conf, err := decode(f, l.lookupVar)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if included {
+		resolvePatterns(conf, filepath.Dir(path))
+	}
+
+	l.loading[absPath] = true
+	defer delete(l.loading, absPath)
+
+	return l.mergeWithIncludes(path, filepath.Dir(path), conf)
+}
+
+// mergeWithIncludes merges a config, and then the files it includes (relative
+// to dir).
+func (l *loader) mergeWithIncludes(path, dir string, conf *latestconfig.Repository) error {
+	if err := l.merge(path, conf); err != nil {
+		return err
+	}
+
+	for _, include := range conf.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+
+		if err := l.load(include, true); err != nil {
+			return fmt.Errorf("failed to include %s from %s: %w", include, path, err)
+		}
+	}
+
+	return nil
+}
+
+// merge merges the settings, defaults, releases and components of a config
+// file into the combined config.
+func (l *loader) merge(path string, conf *latestconfig.Repository) error {
+	if !reflect.ValueOf(conf.Settings).IsZero() {
+		if l.settingsFrom != "" {
+			return conflictError("settings are", l.settingsFrom, path)
+		}
+
+		l.settingsFrom = path
+		l.conf.Settings = conf.Settings
+	}
+
+	if !reflect.ValueOf(conf.Defaults).IsZero() {
+		if l.defaultsFrom != "" {
+			return conflictError("defaults are", l.defaultsFrom, path)
+		}
+
+		l.defaultsFrom = path
+		l.conf.Defaults = conf.Defaults
+	}
+
+	names := make(map[string]bool, len(conf.Releases))
+	for _, releaseConf := range conf.Releases {
+		// Releases are only combined across files, as within a file a repeated
+		// name is almost certainly a mistake (and is reported by validate).
+		if names[releaseConf.Name] {
+			return conflictError(fmt.Sprintf("release %q is", releaseConf.Name), path, path)
+		}
+		names[releaseConf.Name] = true
+
+		i := slices.IndexFunc(l.conf.Releases, func(existing latestconfig.ReleaseConfig) bool {
+			return existing.Name == releaseConf.Name
+		})
+		if i < 0 {
+			l.conf.Releases = append(l.conf.Releases, latestconfig.ReleaseConfig{Name: releaseConf.Name})
+			i = len(l.conf.Releases) - 1
+		}
+		merged := &l.conf.Releases[i]
+
+		fields := releaseConf
+		fields.Components = nil
+		if !reflect.DeepEqual(fields, latestconfig.ReleaseConfig{Name: releaseConf.Name}) {
+			if from, ok := l.releaseFrom[releaseConf.Name]; ok {
+				return conflictError(fmt.Sprintf("release %q is", releaseConf.Name), from, path)
+			}
+
+			l.releaseFrom[releaseConf.Name] = path
+			fields.Components = merged.Components
+			*merged = fields
+		}
+
+		componentsFrom, ok := l.componentsFrom[releaseConf.Name]
+		if !ok {
+			componentsFrom = make(map[string]string)
+			l.componentsFrom[releaseConf.Name] = componentsFrom
+		}
+
+		for _, componentConf := range releaseConf.Components {
+			if from, ok := componentsFrom[componentConf.Name]; ok {
+				return conflictError(fmt.Sprintf("component %q of release %q is", componentConf.Name, releaseConf.Name), from, path)
+			}
+
+			componentsFrom[componentConf.Name] = path
+			merged.Components = append(merged.Components, componentConf)
+		}
+	}
+
+	return nil
+}
+
+// resolvePatterns resolves the relative package and exclude patterns of every
+// component against dir.
+func resolvePatterns(conf *latestconfig.Repository, dir string) {
+	for i := range conf.Releases {
+		for j := range conf.Releases[i].Components {
+			componentConf := &conf.Releases[i].Components[j]
+			for k, pattern := range componentConf.Packages {
+				componentConf.Packages[k] = resolvePattern(dir, pattern)
+			}
+			for k, pattern := range componentConf.Exclude {
+				componentConf.Exclude[k] = resolvePattern(dir, pattern)
+			}
+		}
+	}
+}
+
+// resolvePattern resolves a relative file path/glob pattern against dir. Only
+// the archive path of a pattern within an archive (eg.
+// "artifacts.tar.gz!/**/*.deb") is resolved.
+func resolvePattern(dir, pattern string) string {
+	archivePattern, innerPattern, ok := bundle.Split(pattern)
+	if ok {
+		return resolvePattern(dir, archivePattern) + bundle.Separator + innerPattern
+	}
+
+	if filepath.IsAbs(pattern) {
+		return pattern
+	}
+
+	return filepath.Join(dir, pattern)
+}
+
+// conflictError describes something that is defined by more than one config
+// file (or more than once within the same file).
+func conflictError(what, firstPath, path string) error {
+	if firstPath == path {
+		return fmt.Errorf("%s defined more than once in %s", what, path)
+	}
+
+	return fmt.Errorf("%s defined in both %s and %s", what, firstPath, path)
+}
@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	latestconfig "github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/stretchr/testify/require"
+)
+
+const configHeader = "apiVersion: aptify/v1alpha2\nkind: Repository\n"
+
+func writeConfigs(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, conf := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(configHeader+conf), 0o644))
+	}
+
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("Includes", func(t *testing.T) {
+		dir := writeConfigs(t, map[string]string{
+			"aptify.yaml": `include:
+  - teams/
+  - shared/release.yaml
+settings:
+  poolMode: hardlink
+releases:
+  - name: bookworm
+    components:
+      - name: main
+        packages: [debs/main/*.deb]
+`,
+			"teams/web.yaml": `include:
+  - ../shared/release.yaml
+releases:
+  - name: bookworm
+    components:
+      - name: web
+        packages: [debs/web/*.deb]
+`,
+			"teams/db.yml": `releases:
+  - name: trixie
+    components:
+      - name: db
+        packages: [debs/db/*.deb, /srv/debs/db/*.deb, artifacts.tar.gz!/**/*.deb]
+        exclude: ["**/*-dbg_*.deb"]
+`,
+			"teams/README.md": "not a config",
+			"shared/release.yaml": `defaults:
+  architectures: [amd64]
+releases:
+  - name: bookworm
+    origin: Example
+`,
+		})
+
+		conf, files, err := Load(filepath.Join(dir, "aptify.yaml"), lookupMap(nil))
+		require.NoError(t, err)
+
+		require.Equal(t, []string{
+			filepath.Join(dir, "aptify.yaml"),
+			filepath.Join(dir, "teams", "db.yml"),
+			filepath.Join(dir, "teams", "web.yaml"),
+			filepath.Join(dir, "shared", "release.yaml"),
+		}, files)
+
+		require.Equal(t, latestconfig.APIVersion, conf.APIVersion)
+		require.Equal(t, "hardlink", conf.Settings.PoolMode)
+		require.Equal(t, []string{"amd64"}, conf.Defaults.Architectures)
+		require.Equal(t, []latestconfig.ReleaseConfig{
+			{
+				Name:   "bookworm",
+				Origin: "Example",
+				Components: []latestconfig.ComponentConfig{
+					{Name: "main", Packages: []string{"debs/main/*.deb"}},
+					{Name: "web", Packages: []string{filepath.Join(dir, "teams", "debs", "web", "*.deb")}},
+				},
+			},
+			{
+				Name: "trixie",
+				Components: []latestconfig.ComponentConfig{
+					{
+						Name: "db",
+						Packages: []string{
+							filepath.Join(dir, "teams", "debs", "db", "*.deb"),
+							"/srv/debs/db/*.deb",
+							filepath.Join(dir, "teams", "artifacts.tar.gz") + "!/**/*.deb",
+						},
+						Exclude: []string{filepath.Join(dir, "teams", "**", "*-dbg_*.deb")},
+					},
+				},
+			},
+		}, conf.Releases)
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		dir := writeConfigs(t, map[string]string{
+			"10-settings.yaml": "settings:\n  poolMode: symlink\n",
+			"20-release.yaml":  "releases:\n  - name: ${RELEASE}\n",
+		})
+
+		conf, files, err := Load(dir, lookupMap(map[string]string{"RELEASE": "stable"}))
+		require.NoError(t, err)
+
+		require.Equal(t, []string{filepath.Join(dir, "10-settings.yaml"), filepath.Join(dir, "20-release.yaml")}, files)
+		require.Equal(t, "symlink", conf.Settings.PoolMode)
+		require.Equal(t, []latestconfig.ReleaseConfig{{Name: "stable"}}, conf.Releases)
+	})
+
+	t.Run("Empty Directory", func(t *testing.T) {
+		_, _, err := Load(t.TempDir(), lookupMap(nil))
+		require.ErrorContains(t, err, "no config files found")
+	})
+
+	t.Run("Cycle", func(t *testing.T) {
+		dir := writeConfigs(t, map[string]string{
+			"a.yaml": "include: [b.yaml]\n",
+			"b.yaml": "include: [a.yaml]\n",
+		})
+
+		_, _, err := Load(filepath.Join(dir, "a.yaml"), lookupMap(nil))
+		require.ErrorContains(t, err, "includes itself")
+	})
+
+	t.Run("Missing Include", func(t *testing.T) {
+		dir := writeConfigs(t, map[string]string{
+			"aptify.yaml": "include: [missing.yaml]\n",
+		})
+
+		_, _, err := Load(filepath.Join(dir, "aptify.yaml"), lookupMap(nil))
+		require.ErrorContains(t, err, "failed to include")
+	})
+
+	t.Run("Conflicts", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			other string
+			err   string
+		}{
+			{name: "Settings", other: "settings:\n  poolMode: copy\n", err: "settings are defined in both"},
+			{name: "Defaults", other: "defaults:\n  architectures: [arm64]\n", err: "defaults are defined in both"},
+			{name: "Release", other: "releases:\n  - name: stable\n    origin: Other\n", err: `release "stable" is defined in both`},
+			{name: "Component", other: "releases:\n  - name: stable\n    components:\n      - name: main\n", err: `component "main" of release "stable" is defined in both`},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				dir := writeConfigs(t, map[string]string{
+					"aptify.yaml": `include: [other.yaml]
+settings:
+  poolMode: hardlink
+defaults:
+  architectures: [amd64]
+releases:
+  - name: stable
+    origin: Example
+    components:
+      - name: main
+`,
+					"other.yaml": tt.other,
+				})
+
+				_, _, err := Load(filepath.Join(dir, "aptify.yaml"), lookupMap(nil))
+				require.ErrorContains(t, err, tt.err)
+				require.ErrorContains(t, err, filepath.Join(dir, "other.yaml"))
+			})
+		}
+
+		t.Run("Same File", func(t *testing.T) {
+			dir := writeConfigs(t, map[string]string{
+				"aptify.yaml": "releases:\n  - name: stable\n    components:\n      - name: main\n      - name: main\n",
+			})
+
+			_, _, err := Load(filepath.Join(dir, "aptify.yaml"), lookupMap(nil))
+			require.ErrorContains(t, err, `component "main" of release "stable" is defined more than once in`)
+		})
+
+		t.Run("Same File Release", func(t *testing.T) {
+			dir := writeConfigs(t, map[string]string{
+				"aptify.yaml": "releases:\n  - name: stable\n  - name: stable\n",
+			})
+
+			_, _, err := Load(filepath.Join(dir, "aptify.yaml"), lookupMap(nil))
+			require.ErrorContains(t, err, `release "stable" is defined more than once in`)
+		})
+	})
+}
@@ -0,0 +1,361 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	configtypes "github.com/dpeckett/aptify/internal/config/types"
+	"github.com/dpeckett/aptify/internal/config/v1alpha1"
+	latestconfig "github.com/dpeckett/aptify/internal/config/v1alpha2"
+)
+
+// GetConfigByAPIVersion returns an empty config object of the given api version
+// and kind.
+func GetConfigByAPIVersion(apiVersion, kind string) (configtypes.Config, error) {
+	switch apiVersion {
+	case v1alpha1.APIVersion:
+		return v1alpha1.GetConfigByKind(kind)
+	case latestconfig.APIVersion:
+		return latestconfig.GetConfigByKind(kind)
+	default:
+		return nil, fmt.Errorf("unsupported api version: %s", apiVersion)
+	}
+}
+
+// JSONSchema generates a JSON Schema (draft 2020-12) describing the given
+// config object (eg. for editor autocompletion). Descriptions are taken from
+// the doc comments of the config types. Variables (eg. "${NAME}") are allowed
+// in place of any value, and templates in place of any list item, as they are
+// expanded before the config is decoded.
+func JSONSchema(versionedConf configtypes.Config) ([]byte, error) {
+	schema := allowTemplating(schemaForType(reflect.TypeOf(versionedConf)))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = fmt.Sprintf("aptify %s %s", versionedConf.GetAPIVersion(), versionedConf.GetKind())
+	schema["$defs"] = map[string]any{
+		"variable": map[string]any{
+			"type":        "string",
+			"pattern":     `\$\{`,
+			"description": "A value containing variables (eg. \"${NAME}\" or \"${NAME:-default}\"), which are expanded before the config is decoded.",
+		},
+		"matrix": map[string]any{
+			"type":        "object",
+			"description": "The variables to expand the template with, every combination of their values produces a list item.",
+			"additionalProperties": map[string]any{
+				"type":  "array",
+				"items": map[string]any{"type": []any{"string", "number", "boolean"}},
+			},
+		},
+	}
+
+	properties := schema["properties"].(map[string]any)
+	properties["apiVersion"] = map[string]any{"const": versionedConf.GetAPIVersion()}
+	properties["kind"] = map[string]any{"const": versionedConf.GetKind()}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal schema: %w", err)
+	}
+
+	return append(data, '\n'), nil
+}
+
+// typeSources is the Go source of the types of each config version, keyed by
+// package path.
+var typeSources = map[string][]byte{
+	reflect.TypeOf(v1alpha1.Repository{}).PkgPath():     v1alpha1.Source,
+	reflect.TypeOf(latestconfig.Repository{}).PkgPath(): latestconfig.Source,
+}
+
+// docComments returns the doc comments of the config types (and their
+// fields), keyed by "pkgpath.Type" (and "pkgpath.Type.Field").
+var docComments = sync.OnceValue(func() map[string]string {
+	docs := make(map[string]string)
+	for pkgPath, src := range typeSources {
+		f, err := parser.ParseFile(token.NewFileSet(), "types.go", src, parser.ParseComments)
+		if err != nil {
+			continue
+		}
+
+		for _, decl := range f.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.TYPE {
+				continue
+			}
+
+			for _, spec := range genDecl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				typeName := pkgPath + "." + typeSpec.Name.Name
+
+				doc := typeSpec.Doc
+				if doc == nil && len(genDecl.Specs) == 1 {
+					doc = genDecl.Doc
+				}
+				if text := commentText(doc); text != "" {
+					docs[typeName] = text
+				}
+
+				structType, ok := typeSpec.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+
+				for _, structField := range structType.Fields.List {
+					for _, name := range structField.Names {
+						if text := commentText(structField.Doc); text != "" {
+							docs[typeName+"."+name.Name] = text
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return docs
+})
+
+// commentText returns the text of a comment as a single line.
+func commentText(comment *ast.CommentGroup) string {
+	if comment == nil {
+		return ""
+	}
+
+	return strings.Join(strings.Fields(comment.Text()), " ")
+}
+
+// docComment returns the doc comment of a config type (or one of its fields).
+func docComment(t reflect.Type, fieldName string) string {
+	key := t.PkgPath() + "." + t.Name()
+	if fieldName != "" {
+		key += "." + fieldName
+	}
+
+	return docComments()[key]
+}
+
+// field is a field of a config struct, as it appears in YAML.
+type field struct {
+	name        string
+	typ         reflect.Type
+	description string
+	required    bool
+	enum        []string
+	// keys are the allowed keys of a map.
+	keys []string
+}
+
+// fieldsOf returns the YAML fields of a struct type (including those of any
+// inlined structs), following the naming rules of gopkg.in/yaml.v3.
+func fieldsOf(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if strings.Contains(opts, "inline") {
+			fields = append(fields, fieldsOf(sf.Type)...)
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(sf.Name)
+		}
+
+		f := field{name: name, typ: sf.Type, description: docComment(t, sf.Name)}
+		for _, opt := range strings.Split(sf.Tag.Get("jsonschema"), ",") {
+			switch {
+			case opt == "required":
+				f.required = true
+			case strings.HasPrefix(opt, "enum="):
+				f.enum = strings.Split(strings.TrimPrefix(opt, "enum="), "|")
+			case strings.HasPrefix(opt, "keys="):
+				f.keys = strings.Split(strings.TrimPrefix(opt, "keys="), "|")
+			}
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// schemaForType returns the JSON Schema for a config type.
+func schemaForType(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		return map[string]any{
+			"type":        "string",
+			"description": "A duration, eg. \"168h\".",
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]any)
+		var required []string
+		for _, f := range fieldsOf(t) {
+			properties[f.name] = schemaForField(f)
+			if f.required {
+				required = append(required, f.name)
+			}
+		}
+
+		schema := map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		if description := docComment(t, ""); description != "" {
+			schema["description"] = description
+		}
+
+		return schema
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaForType(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaForType(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	default:
+		return map[string]any{}
+	}
+}
+
+// schemaForField returns the JSON Schema for a field, applying any enum to the
+// field itself, or to the elements of a list or map.
+func schemaForField(f field) map[string]any {
+	schema := schemaForType(f.typ)
+	if f.description != "" {
+		schema["description"] = f.description
+	}
+
+	if len(f.keys) > 0 && schema["type"] == "object" {
+		schema["propertyNames"] = map[string]any{"enum": f.keys}
+	}
+
+	if len(f.enum) == 0 {
+		return schema
+	}
+
+	switch schema["type"] {
+	case "array":
+		schema["items"].(map[string]any)["enum"] = f.enum
+	case "object":
+		if values, ok := schema["additionalProperties"].(map[string]any); ok {
+			values["enum"] = f.enum
+		}
+	default:
+		schema["enum"] = f.enum
+	}
+
+	return schema
+}
+
+// allowTemplating returns a copy of the schema that also accepts the
+// templating forms that are expanded before the config is decoded: a value
+// containing variables in place of any value that isn't a free-form string,
+// and a template in place of any list item.
+func allowTemplating(schema map[string]any) map[string]any {
+	templated := make(map[string]any, len(schema))
+	for k, v := range schema {
+		templated[k] = v
+	}
+
+	switch schema["type"] {
+	case "object":
+		if properties, ok := schema["properties"].(map[string]any); ok {
+			templatedProperties := make(map[string]any, len(properties))
+			for name, property := range properties {
+				templatedProperties[name] = allowTemplating(property.(map[string]any))
+			}
+			templated["properties"] = templatedProperties
+		}
+
+		if values, ok := schema["additionalProperties"].(map[string]any); ok {
+			templated["additionalProperties"] = allowTemplating(values)
+		}
+
+		return templated
+	case "array":
+		items := allowTemplating(schema["items"].(map[string]any))
+		templated["items"] = map[string]any{
+			"anyOf": []any{
+				items,
+				map[string]any{
+					"type":        "object",
+					"description": "A template, which is replaced by a copy of itself for every combination of the matrix values.",
+					"properties": map[string]any{
+						"matrix":   map[string]any{"$ref": "#/$defs/matrix"},
+						"template": items,
+					},
+					"required":             []any{"matrix", "template"},
+					"additionalProperties": false,
+				},
+			},
+		}
+
+		return templated
+	case "string":
+		if _, ok := schema["enum"]; !ok {
+			return templated
+		}
+	}
+
+	// Keep the description alongside the alternatives.
+	description, hasDescription := templated["description"]
+	delete(templated, "description")
+
+	wrapped := map[string]any{
+		"anyOf": []any{templated, map[string]any{"$ref": "#/$defs/variable"}},
+	}
+	if hasDescription {
+		wrapped["description"] = description
+	}
+
+	return wrapped
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha1"
+	latestconfig "github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONSchema(t *testing.T) {
+	data, err := JSONSchema(&latestconfig.Repository{})
+	require.NoError(t, err)
+
+	var schema map[string]any
+	require.NoError(t, json.Unmarshal(data, &schema))
+
+	require.Equal(t, "https://json-schema.org/draft/2020-12/schema", schema["$schema"])
+	require.Equal(t, "aptify aptify/v1alpha2 Repository", schema["title"])
+	require.Equal(t, "object", schema["type"])
+	require.Equal(t, false, schema["additionalProperties"])
+
+	properties := schema["properties"].(map[string]any)
+	require.Equal(t, map[string]any{"const": latestconfig.APIVersion}, properties["apiVersion"])
+	require.Equal(t, map[string]any{"const": "Repository"}, properties["kind"])
+
+	settings := properties["settings"].(map[string]any)
+	require.Contains(t, settings["description"], "Settings")
+
+	settingsProperties := settings["properties"].(map[string]any)
+	poolMode := settingsProperties["poolMode"].(map[string]any)
+	require.Contains(t, poolMode["description"], "PoolMode is how package files are placed")
+	require.Equal(t, []any{
+		map[string]any{"type": "string", "enum": []any{"copy", "hardlink", "reflink", "symlink"}},
+		map[string]any{"$ref": "#/$defs/variable"},
+	}, poolMode["anyOf"])
+
+	compression := settingsProperties["compression"].(map[string]any)
+	require.Equal(t, "array", compression["type"])
+	compressionItem := map[string]any{
+		"anyOf": []any{
+			map[string]any{"type": "string", "enum": []any{"gz", "xz", "lz4", "zst"}},
+			map[string]any{"$ref": "#/$defs/variable"},
+		},
+	}
+	require.Equal(t, []any{
+		compressionItem,
+		map[string]any{
+			"type":        "object",
+			"description": "A template, which is replaced by a copy of itself for every combination of the matrix values.",
+			"properties": map[string]any{
+				"matrix":   map[string]any{"$ref": "#/$defs/matrix"},
+				"template": compressionItem,
+			},
+			"required":             []any{"matrix", "template"},
+			"additionalProperties": false,
+		},
+	}, compression["items"].(map[string]any)["anyOf"])
+
+	severities := settingsProperties["lint"].(map[string]any)["properties"].(map[string]any)["severities"].(map[string]any)
+	require.Equal(t, "object", severities["type"])
+	require.Equal(t, map[string]any{
+		"anyOf": []any{
+			map[string]any{"type": "string", "enum": []any{"error", "warning", "ignore"}},
+			map[string]any{"$ref": "#/$defs/variable"},
+		},
+	}, severities["additionalProperties"])
+	require.Contains(t, severities["propertyNames"].(map[string]any)["enum"], "package-name")
+
+	releases := properties["releases"].(map[string]any)
+	require.Equal(t, "array", releases["type"])
+
+	release := releases["items"].(map[string]any)["anyOf"].([]any)[0].(map[string]any)
+	components := release["properties"].(map[string]any)["components"].(map[string]any)
+	component := components["items"].(map[string]any)["anyOf"].([]any)[0].(map[string]any)["properties"].(map[string]any)
+
+	urls := component["urls"].(map[string]any)["items"].(map[string]any)["anyOf"].([]any)[0].(map[string]any)
+	require.ElementsMatch(t, []any{"url", "sha256"}, urls["required"])
+
+	retention := component["retention"].(map[string]any)["properties"].(map[string]any)
+	require.Equal(t, "string", retention["keepNewerThan"].(map[string]any)["type"])
+	require.Equal(t, []any{
+		map[string]any{"type": "integer"},
+		map[string]any{"$ref": "#/$defs/variable"},
+	}, retention["keepLatest"].(map[string]any)["anyOf"])
+
+	defs := schema["$defs"].(map[string]any)
+	require.Contains(t, defs, "variable")
+	require.Contains(t, defs, "matrix")
+
+	t.Run("v1alpha1", func(t *testing.T) {
+		data, err := JSONSchema(&v1alpha1.Repository{})
+		require.NoError(t, err)
+
+		var schema map[string]any
+		require.NoError(t, json.Unmarshal(data, &schema))
+
+		properties := schema["properties"].(map[string]any)
+		require.Equal(t, map[string]any{"const": v1alpha1.APIVersion}, properties["apiVersion"])
+		require.Contains(t, properties, "poolMode")
+		require.NotContains(t, properties, "settings")
+	})
+}
+
+func TestGetConfigByAPIVersion(t *testing.T) {
+	conf, err := GetConfigByAPIVersion(latestconfig.APIVersion, "Repository")
+	require.NoError(t, err)
+	require.IsType(t, &latestconfig.Repository{}, conf)
+
+	conf, err = GetConfigByAPIVersion(v1alpha1.APIVersion, "Repository")
+	require.NoError(t, err)
+	require.IsType(t, &v1alpha1.Repository{}, conf)
+
+	_, err = GetConfigByAPIVersion("aptify/v1", "Repository")
+	require.ErrorContains(t, err, "unsupported api version: aptify/v1")
+
+	_, err = GetConfigByAPIVersion(latestconfig.APIVersion, "Release")
+	require.Error(t, err)
+}
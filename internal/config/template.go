@@ -0,0 +1,304 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LookupFunc returns the value of a variable, and whether it is defined.
+type LookupFunc func(name string) (string, bool)
+
+// InterpolationError is returned when the variables or templates in a config
+// file can't be expanded.
+type InterpolationError struct {
+	// Line is the line of the config file the error was found on.
+	Line int
+	// Column is the column of the config file the error was found at.
+	Column int
+	// Message describes the error.
+	Message string
+}
+
+func (e *InterpolationError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+var variableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// interpolate expands the variables in every scalar value of a YAML document
+// (in place), along with any templates.
+//
+// Variables are written as "${NAME}", or "${NAME:-default}" to use a default
+// value when the variable is unset (or empty), and "$$" is a literal "$".
+// Defaults may themselves contain variables (eg. "${NAME:-${OTHER:-x}}").
+// Undefined variables are an error.
+//
+// A list item of the form {matrix: {name: [values...], ...}, template: item}
+// is replaced by a copy of the template for every combination of the matrix
+// values, with each matrix name available as a variable.
+func interpolate(node *yaml.Node, lookupVar LookupFunc) error {
+	if lookupVar == nil {
+		lookupVar = os.LookupEnv
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := interpolate(child, lookupVar); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		// Only values are interpolated, keys are left as they are.
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := interpolate(node.Content[i], lookupVar); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		var content []*yaml.Node
+		for _, item := range node.Content {
+			if matrix, template, ok := asTemplate(item); ok {
+				expanded, err := expandTemplate(matrix, template, lookupVar)
+				if err != nil {
+					return err
+				}
+
+				content = append(content, expanded...)
+				continue
+			}
+
+			if err := interpolate(item, lookupVar); err != nil {
+				return err
+			}
+
+			content = append(content, item)
+		}
+		node.Content = content
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "$") {
+			return nil
+		}
+
+		value, err := expandVariables(node.Value, lookupVar)
+		if err != nil {
+			return &InterpolationError{Line: node.Line, Column: node.Column, Message: err.Error()}
+		}
+
+		// Plain scalars are resolved again, so that eg. a variable can be used
+		// for an integer field.
+		if node.Style == 0 && value != node.Value {
+			node.Tag = ""
+		}
+		node.Value = value
+	}
+
+	return nil
+}
+
+// expandVariables expands the variables within a string.
+func expandVariables(s string, lookupVar LookupFunc) (string, error) {
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+
+		sb.WriteString(s[:i])
+
+		switch s[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			s = s[i+2:]
+			continue
+		case '{':
+		default:
+			sb.WriteByte('$')
+			s = s[i+1:]
+			continue
+		}
+
+		end := closingBrace(s[i+2:])
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference: %s", s[i:])
+		}
+
+		expr := s[i+2 : i+2+end]
+		s = s[i+2+end+1:]
+
+		name, defaultValue, hasDefault := strings.Cut(expr, ":-")
+		if !variableNameRegexp.MatchString(name) {
+			return "", fmt.Errorf("invalid variable name: %q", name)
+		}
+
+		value, ok := lookupVar(name)
+		switch {
+		case ok && value != "":
+		case hasDefault:
+			var err error
+			value, err = expandVariables(defaultValue, lookupVar)
+			if err != nil {
+				return "", err
+			}
+		case !ok:
+			return "", fmt.Errorf("undefined variable: %s", name)
+		}
+
+		sb.WriteString(value)
+	}
+}
+
+// closingBrace returns the index of the brace that closes a variable reference
+// (or -1), skipping over any references nested within its default value.
+func closingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '$':
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+
+	return -1
+}
+
+// asTemplate returns the matrix and template of a templated list item.
+func asTemplate(node *yaml.Node) (matrix, template *yaml.Node, ok bool) {
+	if node.Kind != yaml.MappingNode || len(node.Content) != 4 {
+		return nil, nil, false
+	}
+
+	matrix, template = lookup(node, "matrix"), lookup(node, "template")
+	return matrix, template, matrix != nil && template != nil
+}
+
+// expandTemplate returns a copy of the template for every combination of the
+// matrix values.
+func expandTemplate(matrix, template *yaml.Node, lookupVar LookupFunc) ([]*yaml.Node, error) {
+	if matrix.Kind != yaml.MappingNode {
+		return nil, &InterpolationError{Line: matrix.Line, Column: matrix.Column, Message: "matrix must be a mapping of names to lists of values"}
+	}
+
+	combinations := []map[string]string{{}}
+	for i := 0; i+1 < len(matrix.Content); i += 2 {
+		name, values := matrix.Content[i], matrix.Content[i+1]
+
+		if !variableNameRegexp.MatchString(name.Value) {
+			return nil, &InterpolationError{Line: name.Line, Column: name.Column, Message: fmt.Sprintf("invalid variable name: %q", name.Value)}
+		}
+
+		if values.Kind != yaml.SequenceNode {
+			return nil, &InterpolationError{Line: values.Line, Column: values.Column, Message: fmt.Sprintf("matrix values of %s must be a list", name.Value)}
+		}
+
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, value := range values.Content {
+				if value.Kind != yaml.ScalarNode {
+					return nil, &InterpolationError{Line: value.Line, Column: value.Column, Message: "matrix values must be scalars"}
+				}
+
+				expanded, err := expandVariables(value.Value, lookupVar)
+				if err != nil {
+					return nil, &InterpolationError{Line: value.Line, Column: value.Column, Message: err.Error()}
+				}
+
+				vars := make(map[string]string, len(combination)+1)
+				for k, v := range combination {
+					vars[k] = v
+				}
+				vars[name.Value] = expanded
+
+				next = append(next, vars)
+			}
+		}
+		combinations = next
+	}
+
+	var expanded []*yaml.Node
+	for _, vars := range combinations {
+		item := copyNode(template)
+
+		err := interpolate(item, func(name string) (string, bool) {
+			if value, ok := vars[name]; ok {
+				return value, true
+			}
+
+			return lookupVar(name)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		expanded = append(expanded, item)
+	}
+
+	return expanded, nil
+}
+
+// copyNode returns a deep copy of a YAML node.
+func copyNode(node *yaml.Node) *yaml.Node {
+	copied := *node
+	copied.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		copied.Content[i] = copyNode(child)
+	}
+
+	return &copied
+}
+
+// usesTemplating returns true if a YAML document contains any variables or
+// templates.
+func usesTemplating(node *yaml.Node) bool {
+	if node.Kind == yaml.ScalarNode {
+		return strings.Contains(node.Value, "${") || strings.Contains(node.Value, "$$")
+	}
+
+	if node.Kind == yaml.SequenceNode {
+		for _, item := range node.Content {
+			if _, _, ok := asTemplate(item); ok {
+				return true
+			}
+		}
+	}
+
+	for _, child := range node.Content {
+		if usesTemplating(child) {
+			return true
+		}
+	}
+
+	return false
+}
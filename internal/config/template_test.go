@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	latestconfig "github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func lookupMap(vars map[string]string) LookupFunc {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	lookupVar := lookupMap(map[string]string{
+		"CODENAME": "bookworm",
+		"EMPTY":    "",
+		"FALLBACK": "fallback",
+	})
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+		err      string
+	}{
+		{name: "No Variables", value: "debs/*.deb", expected: "debs/*.deb"},
+		{name: "Variable", value: "debs/${CODENAME}/*.deb", expected: "debs/bookworm/*.deb"},
+		{name: "Multiple", value: "${CODENAME}-${CODENAME}", expected: "bookworm-bookworm"},
+		{name: "Default Unused", value: "${CODENAME:-trixie}", expected: "bookworm"},
+		{name: "Default Unset", value: "${ORIGIN:-Demo Organization}", expected: "Demo Organization"},
+		{name: "Default Empty", value: "${EMPTY:-default}", expected: "default"},
+		{name: "Empty Default", value: "${ORIGIN:-}", expected: ""},
+		{name: "Empty Without Default", value: "[${EMPTY}]", expected: "[]"},
+		{name: "Nested Default", value: "${ORIGIN:-${FALLBACK:-x}}", expected: "fallback"},
+		{name: "Nested Default Unset", value: "${ORIGIN:-${OTHER:-x}}/y", expected: "x/y"},
+		{name: "Nested Default In Text", value: "a ${ORIGIN:-b ${OTHER:-c} d} e", expected: "a b c d e"},
+		{name: "Escaped", value: "$${CODENAME} costs $$5", expected: "${CODENAME} costs $5"},
+		{name: "Escaped In Default", value: "${ORIGIN:-$${x}}", expected: "${x}"},
+		{name: "Lone Dollar", value: "$CODENAME $", expected: "$CODENAME $"},
+		{name: "Undefined", value: "${ORIGIN}", err: "undefined variable: ORIGIN"},
+		{name: "Undefined In Default", value: "${ORIGIN:-${OTHER}}", err: "undefined variable: OTHER"},
+		{name: "Unterminated", value: "${CODENAME", err: "unterminated variable reference: ${CODENAME"},
+		{name: "Unterminated Nested", value: "${ORIGIN:-${FALLBACK}", err: "unterminated variable reference"},
+		{name: "Invalid Name", value: "${1ST}", err: `invalid variable name: "1ST"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := expandVariables(tt.value, lookupVar)
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestFromYAMLInterpolation(t *testing.T) {
+	lookupVar := lookupMap(map[string]string{
+		"ORIGIN":      "Acme Inc.",
+		"KEEP_LATEST": "3",
+		"COMPONENTS":  "main",
+	})
+
+	conf, err := FromYAML(strings.NewReader(`apiVersion: aptify/v1alpha2
+kind: Repository
+releases:
+  - matrix:
+      codename: [bookworm, trixie]
+      arch: [amd64, "${ARCH:-arm64}"]
+    template:
+      name: ${codename}-${arch}
+      origin: ${ORIGIN:-Demo Organization}
+      components:
+        - name: ${COMPONENTS}
+          packages:
+            - debs/${codename}/*_${arch}.deb
+          retention:
+            keepLatest: ${KEEP_LATEST}
+  - name: literal
+    description: "$${NOT_A_VARIABLE}"
+`), lookupVar)
+	require.NoError(t, err)
+
+	var names []string
+	for _, release := range conf.Releases {
+		names = append(names, release.Name)
+	}
+	require.Equal(t, []string{"bookworm-amd64", "bookworm-arm64", "trixie-amd64", "trixie-arm64", "literal"}, names)
+
+	require.Equal(t, latestconfig.ReleaseConfig{
+		Name:   "trixie-arm64",
+		Origin: "Acme Inc.",
+		Components: []latestconfig.ComponentConfig{{
+			Name:      "main",
+			Packages:  []string{"debs/trixie/*_arm64.deb"},
+			Retention: &latestconfig.RetentionConfig{KeepLatest: 3},
+		}},
+	}, conf.Releases[3])
+
+	require.Equal(t, "${NOT_A_VARIABLE}", conf.Releases[4].Description)
+}
+
+func TestInterpolateErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  string
+		line  int
+		col   int
+		error string
+	}{
+		{
+			name:  "Undefined Variable",
+			conf:  "releases:\n  - name: stable\n    origin: ${ORIGIN}\n",
+			line:  3,
+			col:   13,
+			error: "undefined variable: ORIGIN",
+		},
+		{
+			name:  "Matrix Not A Mapping",
+			conf:  "releases:\n  - matrix: [bookworm]\n    template:\n      name: stable\n",
+			line:  2,
+			col:   13,
+			error: "matrix must be a mapping of names to lists of values",
+		},
+		{
+			name:  "Matrix Values Not A List",
+			conf:  "releases:\n  - matrix:\n      codename: bookworm\n    template:\n      name: ${codename}\n",
+			line:  3,
+			col:   17,
+			error: "matrix values of codename must be a list",
+		},
+		{
+			name:  "Invalid Matrix Name",
+			conf:  "releases:\n  - matrix:\n      code-name: [bookworm]\n    template:\n      name: stable\n",
+			line:  3,
+			col:   7,
+			error: `invalid variable name: "code-name"`,
+		},
+		{
+			name:  "Undefined In Template",
+			conf:  "releases:\n  - matrix:\n      codename: [bookworm]\n    template:\n      name: ${codename}-${SUFFIX}\n",
+			line:  5,
+			col:   13,
+			error: "undefined variable: SUFFIX",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root yaml.Node
+			require.NoError(t, yaml.Unmarshal([]byte(tt.conf), &root))
+
+			err := interpolate(&root, lookupMap(nil))
+
+			var interpolationErr *InterpolationError
+			require.ErrorAs(t, err, &interpolationErr)
+			require.Equal(t, &InterpolationError{Line: tt.line, Column: tt.col, Message: tt.error}, interpolationErr)
+		})
+	}
+}
+
+func TestUsesTemplating(t *testing.T) {
+	tests := []struct {
+		conf     string
+		expected bool
+	}{
+		{conf: "releases:\n  - name: stable\n", expected: false},
+		{conf: "releases:\n  - name: $stable\n", expected: false},
+		{conf: "releases:\n  - name: ${RELEASE}\n", expected: true},
+		{conf: "releases:\n  - name: costs $$5\n", expected: true},
+		{conf: "releases:\n  - matrix:\n      codename: [bookworm]\n    template:\n      name: stable\n", expected: true},
+	}
+
+	for _, tt := range tests {
+		var root yaml.Node
+		require.NoError(t, yaml.Unmarshal([]byte(tt.conf), &root))
+		require.Equal(t, tt.expected, usesTemplating(&root), tt.conf)
+	}
+}
@@ -20,9 +20,9 @@ package types
 
 type TypeMeta struct {
 	// APIVersion is the version of the API.
-	APIVersion string `yaml:"apiVersion" mapstructure:"apiVersion"`
+	APIVersion string `yaml:"apiVersion" mapstructure:"apiVersion" jsonschema:"required"`
 	// Kind is the kind of the resource.
-	Kind string `yaml:"kind" mapstructure:"kind"`
+	Kind string `yaml:"kind" mapstructure:"kind" jsonschema:"required"`
 }
 
 type Config interface {
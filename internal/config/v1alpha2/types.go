@@ -0,0 +1,277 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package v1alpha2
+
+import (
+	_ "embed"
+	"fmt"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/config/types"
+)
+
+const APIVersion = "aptify/v1alpha2"
+
+// Source is the Go source of this file, the doc comments of the config types
+// are used as the descriptions in the generated JSON Schema.
+//
+//go:embed types.go
+var Source []byte
+
+type Repository struct {
+	types.TypeMeta `yaml:",inline"`
+	// Include is a list of config files (or directories of config files) whose
+	// settings, defaults, releases and components are merged into this config.
+	// Relative paths are relative to the directory of the including file.
+	Include []string `yaml:",omitempty"`
+	// Settings are the repository-wide settings.
+	Settings Settings `yaml:",omitempty"`
+	// Defaults are applied to every release (and component) that doesn't
+	// specify the setting itself.
+	Defaults Defaults `yaml:",omitempty"`
+	// Releases is the list of releases to generate.
+	Releases []ReleaseConfig
+}
+
+// Settings are the repository-wide settings.
+type Settings struct {
+	// PoolMode is how package files are placed into the pool directory.
+	// One of "copy" (the default), "hardlink", "reflink", or "symlink".
+	// Hardlinks and reflinks fall back to copying across filesystems.
+	PoolMode string `yaml:"poolMode,omitempty" jsonschema:"enum=copy|hardlink|reflink|symlink"`
+	// DuplicatePolicy determines what happens when multiple deb files with
+	// different contents share the same package name, version and architecture.
+	// One of "error" (the default), "first-wins", "last-wins", or
+	// "highest-mtime". Deb files with identical contents are always merged.
+	DuplicatePolicy string `yaml:"duplicatePolicy,omitempty" jsonschema:"enum=error|first-wins|last-wins|highest-mtime"`
+	// Signing configures how releases are signed.
+	Signing *SigningConfig `yaml:",omitempty"`
+	// Compression is the list of compressed variants of the Packages indices
+	// to generate, any of "gz", "xz", "lz4", or "zst". Defaults to "xz". The
+	// uncompressed indices are always generated.
+	Compression []string `yaml:",omitempty" jsonschema:"enum=gz|xz|lz4|zst"`
+	// Limits bounds the resources used when reading deb files, to protect
+	// against malicious packages (eg. decompression bombs).
+	Limits *LimitsConfig `yaml:",omitempty"`
+	// Lint configures the checks that "aptify lint" (and optionally every
+	// build) performs on packages.
+	Lint *LintConfig `yaml:",omitempty"`
+	// Provenance configures the provenance manifest that records where each
+	// package in the repository came from.
+	Provenance *ProvenanceConfig `yaml:",omitempty"`
+}
+
+// SigningConfig configures how releases are signed.
+type SigningConfig struct {
+	// PrivateKeyFile is the path of the (armored) OpenPGP private key used to
+	// sign releases. Defaults to the key generated by "aptify init-keys".
+	PrivateKeyFile string `yaml:"privateKeyFile,omitempty"`
+}
+
+// LimitsConfig bounds the resources used when reading deb files. Zero values
+// use the default limit, negative values disable the limit.
+type LimitsConfig struct {
+	// MaxControlSize is the maximum decompressed size (in bytes) of the control
+	// archive. Defaults to 64MiB.
+	MaxControlSize int64 `yaml:"maxControlSize,omitempty"`
+	// MaxDataSize is the maximum decompressed size (in bytes) of the data
+	// archive, and of compressed archives of deb files. Defaults to 16GiB.
+	MaxDataSize int64 `yaml:"maxDataSize,omitempty"`
+	// MaxEntries is the maximum number of entries in the data archive.
+	// Defaults to 1000000.
+	MaxEntries int `yaml:"maxEntries,omitempty"`
+	// MaxRatio is the maximum ratio of the decompressed to compressed size of
+	// the control and data archives, and of compressed archives of deb files.
+	// Disabled by default.
+	MaxRatio float64 `yaml:"maxRatio,omitempty"`
+}
+
+// LintConfig configures the package lint checks.
+type LintConfig struct {
+	// Enabled runs the lint checks as part of every build, the build fails if
+	// any check with a severity of "error" fails.
+	Enabled bool `yaml:",omitempty"`
+	// Severities overrides the severity of individual checks (by name), one of
+	// "error", "warning", or "ignore".
+	Severities map[string]string `yaml:",omitempty" jsonschema:"enum=error|warning|ignore,keys=required-fields|package-name|version|architecture|filename|permissions|installed-size"`
+}
+
+// ProvenanceConfig configures the provenance manifest.
+type ProvenanceConfig struct {
+	// MetadataFromEnv is a list of environment variables (eg. CI build
+	// identifiers) whose values are recorded in the provenance of newly
+	// ingested packages. Unset variables are ignored.
+	MetadataFromEnv []string `yaml:"metadataFromEnv,omitempty"`
+	// Attestations also publishes an in-toto attestation (with a SLSA
+	// provenance predicate) for every package, signed with the repository key.
+	Attestations bool `yaml:",omitempty"`
+}
+
+// Defaults are the default settings for releases and components.
+type Defaults struct {
+	// Origin is the default origin of each release.
+	Origin string `yaml:",omitempty"`
+	// Label is the default label of each release.
+	Label string `yaml:",omitempty"`
+	// Architectures is the default list of architectures supported by each
+	// release.
+	Architectures []string `yaml:",omitempty"`
+	// Retention is the default version retention policy for each component.
+	Retention *RetentionConfig `yaml:",omitempty"`
+}
+
+// ReleaseConfig is the configuration for a release.
+type ReleaseConfig struct {
+	// Name is the name of the release.
+	Name string `jsonschema:"required"`
+	// Version is the version of the release.
+	Version string `yaml:",omitempty"`
+	// Origin is the origin of the release.
+	// This specifies the source or the entity responsible for creating and distributing the release.
+	Origin string `yaml:",omitempty"`
+	// Label is the label of the release.
+	// This provides a human-readable identifier or tag for the release.
+	Label string `yaml:",omitempty"`
+	// Suite is the suite of the release.
+	// This categorizes the release into a broader collection or group of releases.
+	Suite string `yaml:",omitempty"`
+	// Description is a description of the release.
+	Description string `yaml:",omitempty"`
+	// Architectures is an optional list of the architectures supported by the
+	// release. Indices are always generated for every listed architecture (even
+	// if they are empty), and packages for any other architecture (apart from
+	// "all") are rejected. By default the architectures of the included
+	// packages are used.
+	Architectures []string `yaml:",omitempty"`
+	// Components is the list of components (and their packages) within the release.
+	Components []ComponentConfig
+}
+
+// ComponentConfig is the configuration for a component.
+type ComponentConfig struct {
+	// Name is the name of the component.
+	Name string `jsonschema:"required"`
+	// Packages is the list of file system paths/glob patterns to deb files that
+	// will be included within the component. Patterns may contain "**" to match
+	// any number of directories, and directory paths (without any glob
+	// characters) include every deb file beneath them.
+	Packages []string `yaml:",omitempty"`
+	// URLs is a list of deb files that will be downloaded over HTTP(S) and
+	// included within the component.
+	URLs []URLConfig `yaml:"urls,omitempty"`
+	// OCI is a list of OCI registry repositories that deb files will be pulled
+	// from and included within the component.
+	OCI []OCIConfig `yaml:"oci,omitempty"`
+	// Exclude is a list of glob patterns for deb files that will be ignored,
+	// even if they are matched by Packages.
+	Exclude []string `yaml:",omitempty"`
+	// Filter optionally restricts the component to packages whose control
+	// fields match.
+	Filter *FilterConfig `yaml:",omitempty"`
+	// Retention is an optional policy that limits which versions of each
+	// package are included within the component.
+	Retention *RetentionConfig `yaml:",omitempty"`
+}
+
+// URLConfig is a deb file that is downloaded over HTTP(S).
+type URLConfig struct {
+	// URL is the location of the deb file.
+	URL string `yaml:"url" jsonschema:"required"`
+	// SHA256 is the expected sha256sum of the deb file.
+	SHA256 string `yaml:"sha256" jsonschema:"required"`
+	// HeadersFromEnv maps HTTP header names to the environment variables that
+	// hold their values (eg. for authentication). The headers are not sent if
+	// the download is redirected to a different host.
+	HeadersFromEnv map[string]string `yaml:"headersFromEnv,omitempty"`
+}
+
+// OCIConfig is an OCI registry repository containing deb files pushed as
+// artifacts (eg. using ORAS).
+type OCIConfig struct {
+	// Repository is the registry and repository, eg.
+	// "registry.example.com/team/debs".
+	Repository string `yaml:"repository" jsonschema:"required"`
+	// Tags is an optional glob pattern that selects which tags are pulled,
+	// by default all tags are pulled.
+	Tags string `yaml:"tags,omitempty"`
+	// MediaType is the media type of the layers containing deb files.
+	// Defaults to "application/vnd.debian.binary-package".
+	MediaType string `yaml:"mediaType,omitempty"`
+	// Insecure uses plain HTTP to connect to the registry.
+	Insecure bool `yaml:"insecure,omitempty"`
+	// UsernameFromEnv is the environment variable that holds the username
+	// used to authenticate with the registry.
+	UsernameFromEnv string `yaml:"usernameFromEnv,omitempty"`
+	// PasswordFromEnv is the environment variable that holds the password
+	// (or token) used to authenticate with the registry.
+	PasswordFromEnv string `yaml:"passwordFromEnv,omitempty"`
+}
+
+// FilterConfig selects packages based on their control fields. A package must
+// match every specified field to be included.
+type FilterConfig struct {
+	// Name is a regular expression that the package name must match in full.
+	Name string `yaml:",omitempty"`
+	// Version is a comma separated list of version constraints that the package
+	// version must satisfy (eg. ">= 2.0, << 3.0"). The supported operators are
+	// "<<", "<=", "=", "!=", ">=" and ">>".
+	Version string `yaml:",omitempty"`
+	// Architectures is the list of allowed package architectures.
+	Architectures []string `yaml:",omitempty"`
+	// Sections is the list of allowed package sections.
+	Sections []string `yaml:",omitempty"`
+}
+
+// RetentionConfig is the version retention policy for a component.
+// A version is kept if any of the rules match, if no rules are specified all
+// versions are kept.
+type RetentionConfig struct {
+	// KeepLatest keeps the latest N versions of each package (per architecture).
+	KeepLatest int `yaml:"keepLatest,omitempty"`
+	// KeepNewerThan keeps versions whose deb files were first added to the
+	// repository within the given duration (eg. "168h").
+	KeepNewerThan time.Duration `yaml:"keepNewerThan,omitempty"`
+	// Pinned is a list of package versions that are always kept, in the form
+	// "name=version".
+	Pinned []string `yaml:",omitempty"`
+}
+
+func (r *Repository) GetAPIVersion() string {
+	return APIVersion
+}
+
+func (r *Repository) GetKind() string {
+	return "Repository"
+}
+
+func (r *Repository) PopulateTypeMeta() {
+	r.TypeMeta = types.TypeMeta{
+		APIVersion: APIVersion,
+		Kind:       "Repository",
+	}
+}
+
+func GetConfigByKind(kind string) (types.Config, error) {
+	switch kind {
+	case "Repository":
+		return &Repository{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kind: %s", kind)
+	}
+}
@@ -0,0 +1,370 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/bundle"
+	"github.com/dpeckett/aptify/internal/glob"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in a config file.
+type ValidationError struct {
+	// Line is the line of the config file the problem was found on.
+	Line int
+	// Column is the column of the config file the problem was found at.
+	Column int
+	// Message describes the problem.
+	Message string
+	// Warning is true if the problem doesn't prevent the config from being used
+	// (eg. a pattern that doesn't match any files).
+	Warning bool
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Validate checks a config file for mistakes: unknown fields, values of the
+// wrong type, missing required fields, unsupported values, duplicate release
+// and component names, and invalid package patterns (or patterns that don't
+// match any files). File patterns are resolved relative to the current
+// directory, as they are when building. Variables and templates are expanded
+// first, using lookupVar (or the environment, if lookupVar is nil).
+func Validate(r io.Reader, lookupVar LookupFunc) ([]ValidationError, error) {
+	confBytes, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config from reader: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(confBytes, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	v := &validator{}
+
+	if err := interpolate(&root, lookupVar); err != nil {
+		var interpolationErr *InterpolationError
+		if !errors.As(err, &interpolationErr) {
+			return nil, err
+		}
+
+		v.errs = append(v.errs, ValidationError{
+			Line:    interpolationErr.Line,
+			Column:  interpolationErr.Column,
+			Message: interpolationErr.Message,
+		})
+		return v.errs, nil
+	}
+
+	if len(root.Content) == 0 {
+		v.errorf(&root, "config is empty")
+		return v.errs, nil
+	}
+
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		v.errorf(doc, "expected a mapping")
+		return v.errs, nil
+	}
+
+	apiVersion, kind := lookup(doc, "apiVersion"), lookup(doc, "kind")
+	if apiVersion == nil || kind == nil {
+		v.errorf(doc, "missing apiVersion or kind")
+		return v.errs, nil
+	}
+
+	versionedConf, err := GetConfigByAPIVersion(apiVersion.Value, kind.Value)
+	if err != nil {
+		v.errorf(apiVersion, "%s", err)
+		return v.errs, nil
+	}
+
+	v.validateNode(doc, reflect.TypeOf(versionedConf))
+	v.validateReleases(lookup(doc, "releases"))
+
+	slices.SortStableFunc(v.errs, func(a, b ValidationError) int {
+		if a.Line != b.Line {
+			return a.Line - b.Line
+		}
+
+		return a.Column - b.Column
+	})
+
+	return v.errs, nil
+}
+
+type validator struct {
+	errs []ValidationError
+}
+
+func (v *validator) errorf(node *yaml.Node, format string, args ...any) {
+	v.errs = append(v.errs, ValidationError{Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(node *yaml.Node, format string, args ...any) {
+	v.errs = append(v.errs, ValidationError{Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// validateNode checks that the node can be decoded into a value of type t.
+func (v *validator) validateNode(node *yaml.Node, t reflect.Type) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	// Empty values are allowed everywhere.
+	if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null" {
+		return
+	}
+
+	if t == durationType {
+		if node.Kind != yaml.ScalarNode {
+			v.errorf(node, "expected a duration")
+		} else if _, err := time.ParseDuration(node.Value); err != nil && node.ShortTag() != "!!int" {
+			v.errorf(node, "invalid duration %q", node.Value)
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(node, "expected a mapping")
+			return
+		}
+
+		fields := make(map[string]field)
+		for _, f := range fieldsOf(t) {
+			fields[f.name] = f
+		}
+
+		seen := make(map[string]bool)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+
+			if seen[key.Value] {
+				v.errorf(key, "duplicate field %q", key.Value)
+				continue
+			}
+			seen[key.Value] = true
+
+			f, ok := fields[key.Value]
+			if !ok {
+				v.errorf(key, "unknown field %q", key.Value)
+				continue
+			}
+
+			v.validateNode(value, f.typ)
+			v.validateEnum(value, f)
+		}
+
+		for _, f := range fieldsOf(t) {
+			if f.required && !seen[f.name] {
+				v.errorf(node, "missing required field %q", f.name)
+			}
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			v.errorf(node, "expected a list")
+			return
+		}
+
+		for _, item := range node.Content {
+			v.validateNode(item, t.Elem())
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			v.errorf(node, "expected a mapping")
+			return
+		}
+
+		for i := 1; i < len(node.Content); i += 2 {
+			v.validateNode(node.Content[i], t.Elem())
+		}
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			v.errorf(node, "expected a string")
+		}
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!bool" {
+			v.errorf(node, "expected a boolean")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!int" {
+			v.errorf(node, "expected an integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		if node.Kind != yaml.ScalarNode || (node.ShortTag() != "!!int" && node.ShortTag() != "!!float") {
+			v.errorf(node, "expected a number")
+		}
+	}
+}
+
+// validateEnum checks that the value of a field (or the elements of a list or
+// map field) is one of the field's allowed values.
+func (v *validator) validateEnum(node *yaml.Node, f field) {
+	if len(f.enum) == 0 {
+		return
+	}
+
+	var values []*yaml.Node
+	switch node.Kind {
+	case yaml.ScalarNode:
+		values = []*yaml.Node{node}
+	case yaml.SequenceNode:
+		values = node.Content
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			values = append(values, node.Content[i])
+		}
+	}
+
+	for _, value := range values {
+		if value.Kind == yaml.ScalarNode && value.ShortTag() != "!!null" && !slices.Contains(f.enum, value.Value) {
+			v.errorf(value, "unsupported value %q for %s (expected one of %s)",
+				value.Value, f.name, strings.Join(f.enum, ", "))
+		}
+	}
+}
+
+// validateReleases checks for duplicate release and component names, and
+// invalid package patterns.
+func (v *validator) validateReleases(releases *yaml.Node) {
+	if releases == nil || releases.Kind != yaml.SequenceNode {
+		return
+	}
+
+	releaseNames := make(map[string]*yaml.Node)
+	for _, release := range releases.Content {
+		if release.Kind != yaml.MappingNode {
+			continue
+		}
+
+		if name := lookup(release, "name"); name != nil && name.Kind == yaml.ScalarNode {
+			if previous, ok := releaseNames[name.Value]; ok {
+				v.errorf(name, "duplicate release name %q (first defined on line %d)", name.Value, previous.Line)
+			} else {
+				releaseNames[name.Value] = name
+			}
+		}
+
+		components := lookup(release, "components")
+		if components == nil || components.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		componentNames := make(map[string]*yaml.Node)
+		for _, component := range components.Content {
+			if component.Kind != yaml.MappingNode {
+				continue
+			}
+
+			if name := lookup(component, "name"); name != nil && name.Kind == yaml.ScalarNode {
+				if previous, ok := componentNames[name.Value]; ok {
+					v.errorf(name, "duplicate component name %q (first defined on line %d)", name.Value, previous.Line)
+				} else {
+					componentNames[name.Value] = name
+				}
+			}
+
+			for _, pattern := range scalars(lookup(component, "packages")) {
+				v.validatePackagePattern(pattern)
+			}
+
+			for _, pattern := range scalars(lookup(component, "exclude")) {
+				if err := glob.Validate(pattern.Value); err != nil {
+					v.errorf(pattern, "invalid exclude pattern %q: %s", pattern.Value, err)
+				}
+			}
+		}
+	}
+}
+
+// validatePackagePattern checks that a package pattern is valid, and that it
+// matches at least one file.
+func (v *validator) validatePackagePattern(pattern *yaml.Node) {
+	filePattern := pattern.Value
+	if archivePattern, innerPattern, ok := bundle.Split(pattern.Value); ok {
+		if err := glob.Validate(innerPattern); err != nil {
+			v.errorf(pattern, "invalid pattern %q: %s", pattern.Value, err)
+			return
+		}
+
+		filePattern = archivePattern
+	}
+
+	if err := glob.Validate(filePattern); err != nil {
+		v.errorf(pattern, "invalid pattern %q: %s", pattern.Value, err)
+		return
+	}
+
+	matches, err := glob.Glob(filePattern)
+	if err != nil {
+		v.errorf(pattern, "failed to match pattern %q: %s", pattern.Value, err)
+		return
+	}
+
+	if len(matches) == 0 {
+		v.warnf(pattern, "pattern %q does not match any files", filePattern)
+	}
+}
+
+// lookup returns the value of a key within a mapping node (or nil).
+func lookup(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// scalars returns the scalar elements of a sequence node.
+func scalars(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	var values []*yaml.Node
+	for _, item := range node.Content {
+		if item.Kind == yaml.ScalarNode {
+			values = append(values, item)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	debsDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(debsDir, "hello_1.0_amd64.deb"), nil, 0o644))
+
+	validate := func(t *testing.T, conf string) []ValidationError {
+		t.Helper()
+
+		conf = strings.ReplaceAll(conf, "DEBS_DIR", debsDir)
+		errs, err := Validate(strings.NewReader(conf), func(string) (string, bool) { return "", false })
+		require.NoError(t, err)
+
+		return errs
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		errs := validate(t, `apiVersion: aptify/v1alpha2
+kind: Repository
+settings:
+  poolMode: hardlink
+  compression: [gz, zst]
+  limits:
+    maxRatio: 100
+  lint:
+    severities:
+      maintainer: ignore
+releases:
+  - name: stable
+    components:
+      - name: main
+        packages:
+          - DEBS_DIR/*.deb
+        retention:
+          keepLatest: 2
+          keepNewerThan: 720h
+`)
+		require.Empty(t, errs)
+	})
+
+	t.Run("Mistakes", func(t *testing.T) {
+		errs := validate(t, `apiVersion: aptify/v1alpha2
+kind: Repository
+settings:
+  poolMode: move
+  compression: [gz, bz2]
+  lint:
+    enabled: maybe
+    severities:
+      maintainer: fatal
+  limits:
+    maxEntries: lots
+releases:
+  - name: stable
+    pakages: []
+    components:
+      - name: main
+        packages:
+          - DEBS_DIR/[.deb
+          - DEBS_DIR/missing/*.deb
+        urls:
+          - url: https://example.com/hello_1.0_amd64.deb
+        retention:
+          keepNewerThan: a week
+      - name: main
+  - name: stable
+    architectures: amd64
+`)
+
+		require.Equal(t, []ValidationError{
+			{Line: 4, Column: 13, Message: `unsupported value "move" for poolMode (expected one of copy, hardlink, reflink, symlink)`},
+			{Line: 5, Column: 21, Message: `unsupported value "bz2" for compression (expected one of gz, xz, lz4, zst)`},
+			{Line: 7, Column: 14, Message: "expected a boolean"},
+			{Line: 9, Column: 19, Message: `unsupported value "fatal" for severities (expected one of error, warning, ignore)`},
+			{Line: 11, Column: 17, Message: "expected an integer"},
+			{Line: 14, Column: 5, Message: `unknown field "pakages"`},
+			{Line: 18, Column: 13, Message: `invalid pattern "` + debsDir + `/[.deb": syntax error in pattern`},
+			{Line: 19, Column: 13, Message: `pattern "` + debsDir + `/missing/*.deb" does not match any files`, Warning: true},
+			{Line: 21, Column: 13, Message: `missing required field "sha256"`},
+			{Line: 23, Column: 26, Message: `invalid duration "a week"`},
+			{Line: 24, Column: 15, Message: `duplicate component name "main" (first defined on line 16)`},
+			{Line: 25, Column: 11, Message: `duplicate release name "stable" (first defined on line 13)`},
+			{Line: 26, Column: 20, Message: "expected a list"},
+		}, errs)
+	})
+
+	t.Run("Duplicate Field", func(t *testing.T) {
+		errs := validate(t, "apiVersion: aptify/v1alpha2\nkind: Repository\nreleases: []\nreleases: []\n")
+		require.Equal(t, []ValidationError{{Line: 4, Column: 1, Message: `duplicate field "releases"`}}, errs)
+	})
+
+	t.Run("Unsupported Version", func(t *testing.T) {
+		errs := validate(t, "apiVersion: aptify/v1\nkind: Repository\n")
+		require.Equal(t, []ValidationError{{Line: 1, Column: 13, Message: "unsupported api version: aptify/v1"}}, errs)
+	})
+
+	t.Run("Missing Type Meta", func(t *testing.T) {
+		errs := validate(t, "releases: []\n")
+		require.Equal(t, []ValidationError{{Line: 1, Column: 1, Message: "missing apiVersion or kind"}}, errs)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		errs := validate(t, "")
+		require.Len(t, errs, 1)
+		require.Equal(t, "config is empty", errs[0].Message)
+	})
+
+	t.Run("Not A Mapping", func(t *testing.T) {
+		errs := validate(t, "- releases\n")
+		require.Equal(t, []ValidationError{{Line: 1, Column: 1, Message: "expected a mapping"}}, errs)
+	})
+
+	t.Run("Invalid YAML", func(t *testing.T) {
+		_, err := Validate(strings.NewReader("releases: [\n"), nil)
+		require.ErrorContains(t, err, "failed to parse config")
+	})
+}
+
+func TestValidationError(t *testing.T) {
+	err := ValidationError{Line: 3, Column: 5, Message: `unknown field "pakages"`}
+	require.Equal(t, `3:5: unknown field "pakages"`, err.Error())
+}
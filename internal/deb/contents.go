@@ -19,37 +19,95 @@
 package deb
 
 import (
+	"archive/tar"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"strings"
 
+	"github.com/dpeckett/aptify/internal/util"
 	"github.com/dpeckett/archivefs/arfs"
 	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/dpeckett/uncompr"
 )
 
-func GetPackageContents(path string) ([]string, error) {
+// GetPackageContents returns the paths of all the files within the deb file at
+// path.
+func GetPackageContents(ctx context.Context, path string, limits Limits) ([]string, error) {
+	var contents []string
+	err := walkDataArchive(ctx, path, limits, func(name string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			contents = append(contents, name)
+		}
+
+		return nil
+	})
+
+	return contents, err
+}
+
+// File describes an entry within the data archive of a deb file.
+type File struct {
+	// Name is the path of the entry, relative to the root of the archive.
+	Name string
+	// Mode is the file mode (including the type and setuid/setgid bits).
+	Mode fs.FileMode
+	// Size is the size of the file in bytes.
+	Size int64
+	// UID is the numeric user id of the owner.
+	UID int
+	// GID is the numeric group id of the owner.
+	GID int
+}
+
+// GetPackageFiles returns every entry (including directories) within the deb
+// file at path.
+func GetPackageFiles(ctx context.Context, path string, limits Limits) ([]File, error) {
+	var files []File
+	err := walkDataArchive(ctx, path, limits, func(name string, d fs.DirEntry) error {
+		fi, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", name, err)
+		}
+
+		file := File{Name: name, Mode: fi.Mode(), Size: fi.Size()}
+		if hdr, ok := fi.Sys().(*tar.Header); ok {
+			file.UID, file.GID = hdr.Uid, hdr.Gid
+		}
+
+		files = append(files, file)
+
+		return nil
+	})
+
+	return files, err
+}
+
+// walkDataArchive calls fn for every entry within the data archive of the deb
+// file at path (excluding the root directory).
+func walkDataArchive(ctx context.Context, path string, limits Limits, fn func(name string, d fs.DirEntry) error) error {
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open package file: %w", err)
+		return fmt.Errorf("failed to open package file: %w", err)
 	}
 	defer f.Close()
 
 	debFS, err := arfs.Open(f)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open archive: %w", err)
+		return fmt.Errorf("failed to open archive: %w", err)
 	}
 
 	if err := ensureIsDebianPackage(debFS); err != nil {
-		return nil, err
+		return err
 	}
 
 	// Look for data archive in the debian package.
 	entries, err := debFS.ReadDir(".")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read debian package: %w", err)
+		return fmt.Errorf("failed to read debian package: %w", err)
 	}
 
 	var dataArchiveFilename string
@@ -60,55 +118,114 @@ func GetPackageContents(path string) ([]string, error) {
 		}
 	}
 	if dataArchiveFilename == "" {
-		return nil, fmt.Errorf("failed to find data archive in debian package")
+		return fmt.Errorf("failed to find data archive in debian package")
 	}
 
 	dataArchiveFile, err := debFS.Open(dataArchiveFilename)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open data archive: %w", err)
+		return fmt.Errorf("failed to open data archive: %w", err)
+	}
+
+	dataArchiveInfo, err := dataArchiveFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat data archive: %w", err)
 	}
 
 	dataArchiveReader, err := uncompr.NewReader(dataArchiveFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decompress data archive: %w", err)
+		return fmt.Errorf("failed to decompress data archive: %w", err)
 	}
 
 	// Write data archive to temporary file (as we need a seekable reader for the
 	// tarfs implementation).
 	tempFile, err := os.CreateTemp("", "data.tar")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+		return fmt.Errorf("failed to create temporary file: %w", err)
 	}
-	defer os.Remove(tempFile.Name())
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
 
-	if _, err := io.Copy(tempFile, dataArchiveReader); err != nil {
-		return nil, fmt.Errorf("failed to write data archive to temporary file: %w", err)
+	_, err = copyWithLimits(tempFile, util.NewContextReader(ctx, dataArchiveReader), path,
+		"data size", limits.MaxDataSize, limits.MaxRatio, dataArchiveInfo.Size())
+	if err != nil {
+		return fmt.Errorf("failed to write data archive to temporary file: %w", err)
+	}
+
+	// Count the entries before indexing the archive (which holds every header
+	// in memory).
+	if limits.MaxEntries > 0 {
+		if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to beginning of temporary file: %w", err)
+		}
+
+		if err := checkEntryCount(ctx, tempFile, path, limits.MaxEntries); err != nil {
+			return err
+		}
 	}
 
 	// Seek to beginning of temporary file.
 	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to beginning of temporary file: %w", err)
+		return fmt.Errorf("failed to seek to beginning of temporary file: %w", err)
 	}
 
 	dataArchiveFS, err := tarfs.Open(tempFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open data archive: %w", err)
+		return fmt.Errorf("failed to open data archive: %w", err)
 	}
 
-	var contents []string
-	err = fs.WalkDir(dataArchiveFS, ".", func(path string, d fs.DirEntry, err error) error {
+	var entryCount int
+	return fs.WalkDir(dataArchiveFS, ".", func(name string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return fmt.Errorf("failed to walk data archive: %w", err)
 		}
 
-		if d.IsDir() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if name == "." {
 			return nil
 		}
 
-		contents = append(contents, path)
+		entryCount++
+		if limits.MaxEntries > 0 && entryCount > limits.MaxEntries {
+			return &LimitExceededError{Path: path, Limit: "entry count", Max: float64(limits.MaxEntries)}
+		}
 
-		return nil
+		return fn(name, d)
 	})
+}
 
-	return contents, err
+// checkEntryCount reads the headers of a tar archive, one at a time, and
+// returns an error if there are more than maxEntries entries (excluding the
+// root directory).
+func checkEntryCount(ctx context.Context, r io.Reader, path string, maxEntries int) error {
+	tr := tar.NewReader(r)
+
+	var entryCount int
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read data archive: %w", err)
+		}
+
+		if name := strings.TrimPrefix(hdr.Name, "./"); name == "" || name == "." {
+			continue
+		}
+
+		entryCount++
+		if entryCount > maxEntries {
+			return &LimitExceededError{Path: path, Limit: "entry count", Max: float64(maxEntries)}
+		}
+	}
 }
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package deb
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Limits bounds the resources used when reading (untrusted) deb files, to
+// protect against decompression bombs. A zero value disables the limit.
+type Limits struct {
+	// MaxControlSize is the maximum decompressed size of the control archive.
+	MaxControlSize int64
+	// MaxDataSize is the maximum decompressed size of the data archive.
+	MaxDataSize int64
+	// MaxEntries is the maximum number of entries in the data archive.
+	MaxEntries int
+	// MaxRatio is the maximum ratio of the decompressed to compressed size of
+	// the control and data archives.
+	MaxRatio float64
+}
+
+// DefaultLimits are the limits used unless otherwise configured.
+var DefaultLimits = Limits{
+	MaxControlSize: 64 << 20,
+	MaxDataSize:    16 << 30,
+	MaxEntries:     1_000_000,
+}
+
+// LimitExceededError is returned when a deb file exceeds one of the limits.
+type LimitExceededError struct {
+	// Path is the path of the offending deb file (or archive of deb files).
+	Path string
+	// Limit is the name of the limit that was exceeded.
+	Limit string
+	// Max is the value of the limit.
+	Max float64
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s exceeds the %s limit (%s)", e.Path, e.Limit, strconv.FormatFloat(e.Max, 'f', -1, 64))
+}
+
+// MaxFileSize returns the maximum size of a deb file (eg. when downloading
+// one), or zero if there is no limit. Compressed archives are never
+// meaningfully larger than their contents, so this is the sum of the control
+// and data size limits (with some room to spare for the ar headers).
+func (l Limits) MaxFileSize() int64 {
+	if l.MaxControlSize <= 0 || l.MaxDataSize <= 0 {
+		return 0
+	}
+
+	return l.MaxControlSize + l.MaxDataSize + 1<<20
+}
+
+// CopyDecompressed copies the decompressed contents of an archive (eg. a
+// compressed tarball of deb files), enforcing the data size and compression
+// ratio limits. The compressed size is used to calculate the compression ratio.
+func (l Limits) CopyDecompressed(dst io.Writer, src io.Reader, path string, compressedSize int64) (int64, error) {
+	return copyWithLimits(dst, src, path, "data size", l.MaxDataSize, l.MaxRatio, compressedSize)
+}
+
+// copyWithLimits copies the decompressed contents of an archive member,
+// enforcing the size and compression ratio limits. The compressed size is used
+// to calculate the compression ratio.
+func copyWithLimits(dst io.Writer, src io.Reader, path, sizeLimitName string, maxSize int64, maxRatio float64, compressedSize int64) (int64, error) {
+	limit := int64(math.MaxInt64)
+	var limitName string
+	var limitValue float64
+
+	if maxSize > 0 {
+		limit, limitName, limitValue = maxSize, sizeLimitName, float64(maxSize)
+	}
+
+	if maxRatio > 0 {
+		// Treat the compressed size as at least one byte, so that empty members
+		// are not rejected.
+		if ratioLimit := int64(maxRatio * float64(max(compressedSize, 1))); ratioLimit < limit {
+			limit, limitName, limitValue = ratioLimit, "compression ratio", maxRatio
+		}
+	}
+
+	if limit == math.MaxInt64 {
+		return io.Copy(dst, src)
+	}
+
+	n, err := io.Copy(dst, io.LimitReader(src, limit+1))
+	if err != nil {
+		return n, err
+	}
+
+	if n > limit {
+		return n, &LimitExceededError{Path: path, Limit: limitName, Max: limitValue}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package deb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A small deb file that decompresses to 16MiB.
+	bombPath := testutil.WriteDeb(t, filepath.Join(dir, "bomb_1.0_amd64.deb"), testutil.Deb{
+		Control: testutil.Control("bomb", "1.0", "amd64", "X-Padding: "+strings.Repeat("0", 1<<20)),
+		Files: []testutil.File{
+			{Name: "./zeros", Body: make([]byte, 16<<20)},
+		},
+	})
+
+	var files []testutil.File
+	for i := 0; i < 100; i++ {
+		files = append(files, testutil.File{Name: fmt.Sprintf("./file%d", i)})
+	}
+	manyPath := testutil.WriteDeb(t, filepath.Join(dir, "many_1.0_amd64.deb"), testutil.Deb{
+		Control: testutil.Control("many", "1.0", "amd64"),
+		Files:   append([]testutil.File{{Name: "./", Typeflag: '5'}}, files...),
+	})
+
+	t.Run("Default Limits", func(t *testing.T) {
+		pkg, err := GetMetadata(ctx, bombPath, DefaultLimits)
+		require.NoError(t, err)
+		require.Equal(t, "bomb", pkg.Name)
+
+		contents, err := GetPackageContents(ctx, bombPath, DefaultLimits)
+		require.NoError(t, err)
+		require.Equal(t, []string{"zeros"}, contents)
+
+		contents, err = GetPackageContents(ctx, manyPath, DefaultLimits)
+		require.NoError(t, err)
+		require.Len(t, contents, 100)
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		limits Limits
+		limit  string
+		read   func(ctx context.Context, path string, limits Limits) error
+	}{
+		{"Control Size", bombPath, Limits{MaxControlSize: 64 << 10}, "control size", readMetadata},
+		{"Control Ratio", bombPath, Limits{MaxRatio: 100}, "compression ratio", readMetadata},
+		{"Data Size", bombPath, Limits{MaxDataSize: 1 << 20}, "data size", readContents},
+		{"Data Ratio", bombPath, Limits{MaxRatio: 100}, "compression ratio", readContents},
+		{"Entry Count", manyPath, Limits{MaxEntries: 10}, "entry count", readContents},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.read(ctx, tt.path, tt.limits)
+
+			var limitErr *LimitExceededError
+			require.ErrorAs(t, err, &limitErr)
+			require.Equal(t, tt.limit, limitErr.Limit)
+			require.Equal(t, tt.path, limitErr.Path)
+		})
+	}
+
+	t.Run("Exactly At Entry Limit", func(t *testing.T) {
+		_, err := GetPackageContents(ctx, manyPath, Limits{MaxEntries: 100})
+		require.NoError(t, err)
+	})
+}
+
+func TestCheckEntryCount(t *testing.T) {
+	ctx := context.Background()
+
+	archive := testutil.Tar(t, []testutil.File{
+		{Name: "./", Typeflag: '5'},
+		{Name: "./usr/", Typeflag: '5'},
+		{Name: "./usr/hello"},
+	})
+
+	// The root directory is not counted.
+	require.NoError(t, checkEntryCount(ctx, bytes.NewReader(archive), "hello.deb", 2))
+
+	err := checkEntryCount(ctx, bytes.NewReader(archive), "hello.deb", 1)
+	var limitErr *LimitExceededError
+	require.ErrorAs(t, err, &limitErr)
+
+	// Headers are read one at a time, so a truncated archive is still counted.
+	err = checkEntryCount(ctx, bytes.NewReader(archive[:3*512]), "hello.deb", 1)
+	require.ErrorAs(t, err, &limitErr)
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, checkEntryCount(cancelledCtx, bytes.NewReader(archive), "hello.deb", 2), context.Canceled)
+}
+
+func readMetadata(ctx context.Context, path string, limits Limits) error {
+	_, err := GetMetadata(ctx, path, limits)
+	return err
+}
+
+func readContents(ctx context.Context, path string, limits Limits) error {
+	_, err := GetPackageContents(ctx, path, limits)
+	return err
+}
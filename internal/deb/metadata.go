@@ -20,12 +20,14 @@ package deb
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"strings"
 
+	"github.com/dpeckett/aptify/internal/util"
 	"github.com/dpeckett/archivefs/arfs"
 	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/dpeckett/deb822"
@@ -33,7 +35,8 @@ import (
 	"github.com/dpeckett/uncompr"
 )
 
-func GetMetadata(path string) (*types.Package, error) {
+// GetMetadata reads the control file of the deb file at path.
+func GetMetadata(ctx context.Context, path string, limits Limits) (*types.Package, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open package file: %w", err)
@@ -71,6 +74,11 @@ func GetMetadata(path string) (*types.Package, error) {
 		return nil, fmt.Errorf("failed to open control archive: %w", err)
 	}
 
+	controlArchiveInfo, err := controlArchiveFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat control archive: %w", err)
+	}
+
 	controlArchiveReader, err := uncompr.NewReader(controlArchiveFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decompress control archive: %w", err)
@@ -78,12 +86,14 @@ func GetMetadata(path string) (*types.Package, error) {
 
 	// Read control archive entirely into memory (as we need a seekable reader for
 	// the tarfs implementation).
-	controlArchiveData, err := io.ReadAll(controlArchiveReader)
+	var controlArchiveData bytes.Buffer
+	_, err = copyWithLimits(&controlArchiveData, util.NewContextReader(ctx, controlArchiveReader), path,
+		"control size", limits.MaxControlSize, limits.MaxRatio, controlArchiveInfo.Size())
 	if err != nil {
 		return nil, fmt.Errorf("failed to read control archive: %w", err)
 	}
 
-	controlArchiveFS, err := tarfs.Open(bytes.NewReader(controlArchiveData))
+	controlArchiveFS, err := tarfs.Open(bytes.NewReader(controlArchiveData.Bytes()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open control archive: %w", err)
 	}
@@ -114,7 +124,8 @@ func ensureIsDebianPackage(debFS fs.FS) error {
 		return fmt.Errorf("failed to open debian-binary file: %w", err)
 	}
 
-	debianBinary, err := io.ReadAll(debianBinaryFile)
+	// The file should only contain the format version.
+	debianBinary, err := io.ReadAll(io.LimitReader(debianBinaryFile, 64))
 	if err != nil {
 		return fmt.Errorf("failed to read debian-binary file: %w", err)
 	}
@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package deb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/version"
+)
+
+// Grammars from the Debian policy manual (sections 5.6.1, 5.6.7 and 5.6.12).
+var (
+	packageNameRegexp     = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+	upstreamVersionRegexp = regexp.MustCompile(`^[0-9][A-Za-z0-9.+~-]*$`)
+	revisionRegexp        = regexp.MustCompile(`^[A-Za-z0-9+.~]+$`)
+	architectureRegexp    = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+)
+
+// InvalidFieldError is returned when a control field does not conform to the
+// Debian policy grammar for that field.
+type InvalidFieldError struct {
+	Field string
+	Value string
+}
+
+func (e *InvalidFieldError) Error() string {
+	return fmt.Sprintf("invalid %s field: %q", e.Field, e.Value)
+}
+
+// Validate checks that the control fields used to name a package's files
+// (Package, Source, Version and Architecture) conform to Debian policy.
+func Validate(pkg *types.Package) error {
+	if err := ValidateNames(pkg); err != nil {
+		return err
+	}
+
+	if !ValidVersion(pkg.Version) {
+		return &InvalidFieldError{Field: "Version", Value: pkg.Version.String()}
+	}
+
+	if !ValidArchitecture(pkg.Architecture.String()) {
+		return &InvalidFieldError{Field: "Architecture", Value: pkg.Architecture.String()}
+	}
+
+	return nil
+}
+
+// ValidateNames checks that the Package and Source fields conform to Debian
+// policy.
+func ValidateNames(pkg *types.Package) error {
+	if !packageNameRegexp.MatchString(pkg.Name) {
+		return &InvalidFieldError{Field: "Package", Value: pkg.Name}
+	}
+
+	if source := strings.TrimSpace(pkg.Source); source != "" {
+		name, sourceVersion, hasVersion := strings.Cut(source, " ")
+		if !packageNameRegexp.MatchString(name) {
+			return &InvalidFieldError{Field: "Source", Value: pkg.Source}
+		}
+
+		// The source version is optional, eg. "hello (1.0-1)".
+		if hasVersion {
+			sourceVersion = strings.TrimSpace(sourceVersion)
+			if !strings.HasPrefix(sourceVersion, "(") || !strings.HasSuffix(sourceVersion, ")") {
+				return &InvalidFieldError{Field: "Source", Value: pkg.Source}
+			}
+
+			v, err := version.Parse(sourceVersion[1 : len(sourceVersion)-1])
+			if err != nil || !ValidVersion(v) {
+				return &InvalidFieldError{Field: "Source", Value: pkg.Source}
+			}
+		}
+	}
+
+	return nil
+}
+
+// SourceName returns the name of the source package that a binary package was
+// built from (without any version).
+func SourceName(pkg *types.Package) string {
+	source, _, _ := strings.Cut(strings.TrimSpace(pkg.Source), " ")
+	if source == "" {
+		return pkg.Name
+	}
+
+	return source
+}
+
+// ValidVersion returns true if the version conforms to the Debian policy
+// grammar (an epoch is permitted, but not required).
+func ValidVersion(v version.Version) bool {
+	if !upstreamVersionRegexp.MatchString(v.Version) {
+		return false
+	}
+
+	// Hyphens are only allowed in the upstream version if there is a revision.
+	if v.Revision == "" {
+		return !strings.Contains(v.Version, "-")
+	}
+
+	return revisionRegexp.MatchString(v.Revision)
+}
+
+// ValidArchitecture returns true if the architecture name is syntactically
+// valid. It does not check that the architecture is one known to dpkg.
+func ValidArchitecture(arch string) bool {
+	return architectureRegexp.MatchString(arch)
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package deb
+
+import (
+	"testing"
+
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	valid := types.Package{
+		Name:         "hello",
+		Source:       "hello-src (1:1.0-1)",
+		Version:      version.MustParse("1:1.0-1"),
+		Architecture: arch.MustParse("amd64"),
+	}
+	require.NoError(t, Validate(&valid))
+
+	tests := []struct {
+		name   string
+		field  string
+		modify func(pkg *types.Package)
+	}{
+		{"Empty Name", "Package", func(pkg *types.Package) { pkg.Name = "" }},
+		{"Traversal Name", "Package", func(pkg *types.Package) { pkg.Name = "../hello" }},
+		{"Absolute Name", "Package", func(pkg *types.Package) { pkg.Name = "/etc/passwd" }},
+		{"Slash Name", "Package", func(pkg *types.Package) { pkg.Name = "hello/world" }},
+		{"Newline Name", "Package", func(pkg *types.Package) { pkg.Name = "hello\nFilename: x" }},
+		{"Uppercase Name", "Package", func(pkg *types.Package) { pkg.Name = "Hello" }},
+		{"Traversal Source", "Source", func(pkg *types.Package) { pkg.Source = "../hello" }},
+		{"Absolute Source", "Source", func(pkg *types.Package) { pkg.Source = "/hello" }},
+		{"Newline Source", "Source", func(pkg *types.Package) { pkg.Source = "hello\n" + "x" }},
+		{"Unbracketed Source Version", "Source", func(pkg *types.Package) { pkg.Source = "hello 1.0" }},
+		{"Bad Source Epoch", "Source", func(pkg *types.Package) { pkg.Source = "hello (x:1.0)" }},
+		{"Traversal Source Version", "Source", func(pkg *types.Package) { pkg.Source = "hello (1.0/../../x)" }},
+		{"Traversal Version", "Version", func(pkg *types.Package) { pkg.Version = version.Version{Version: "1.0/../../x"} }},
+		{"Absolute Version", "Version", func(pkg *types.Package) { pkg.Version = version.Version{Version: "/1.0"} }},
+		{"Newline Version", "Version", func(pkg *types.Package) { pkg.Version = version.Version{Version: "1.0\nx"} }},
+		{"Colon In Version", "Version", func(pkg *types.Package) { pkg.Version = version.Version{Version: "1:2:3"} }},
+		{"Hyphen Without Revision", "Version", func(pkg *types.Package) { pkg.Version = version.Version{Version: "1.0-1"} }},
+		{"Traversal Revision", "Version", func(pkg *types.Package) { pkg.Version = version.Version{Version: "1.0", Revision: "1/../x"} }},
+		{"Traversal Architecture", "Architecture", func(pkg *types.Package) { pkg.Architecture = arch.Arch{ABI: "gnu", OS: "linux", CPU: "../amd64"} }},
+		{"Absolute Architecture", "Architecture", func(pkg *types.Package) { pkg.Architecture = arch.Arch{ABI: "gnu", OS: "linux", CPU: "/amd64"} }},
+		{"Newline Architecture", "Architecture", func(pkg *types.Package) { pkg.Architecture = arch.Arch{ABI: "gnu", OS: "linux", CPU: "amd64\n"} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg := valid
+			tt.modify(&pkg)
+
+			var fieldErr *InvalidFieldError
+			require.ErrorAs(t, Validate(&pkg), &fieldErr)
+			require.Equal(t, tt.field, fieldErr.Field)
+		})
+	}
+}
+
+func TestVersionEpochs(t *testing.T) {
+	for _, s := range []string{"x:1.0", "-1:1.0", ":1.0", "1:"} {
+		_, err := version.Parse(s)
+		require.Error(t, err, s)
+	}
+
+	v, err := version.Parse("2:1.0-1")
+	require.NoError(t, err)
+	require.True(t, ValidVersion(v))
+}
+
+func TestSourceName(t *testing.T) {
+	require.Equal(t, "hello", SourceName(&types.Package{Name: "hello"}))
+	require.Equal(t, "hello-src", SourceName(&types.Package{Name: "hello", Source: "hello-src (1.0-1)"}))
+}
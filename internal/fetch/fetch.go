@@ -0,0 +1,281 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package fetch downloads remote files into a content-addressed cache.
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/sha256sum"
+	"github.com/dpeckett/aptify/internal/util"
+)
+
+const (
+	// DefaultTimeout is the time limit for each download (including reading
+	// the response body) made using the default HTTP client.
+	DefaultTimeout = time.Hour
+	// DefaultResponseHeaderTimeout is how long the default HTTP client waits
+	// for a server to start responding.
+	DefaultResponseHeaderTimeout = time.Minute
+	// maxRedirects is the maximum number of redirects that will be followed.
+	maxRedirects = 10
+)
+
+// ChecksumMismatchError is returned when a downloaded file doesn't have the
+// expected sha256sum.
+type ChecksumMismatchError struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected sha256 %s, got %s", e.Name, e.Expected, e.Actual)
+}
+
+// Fetcher downloads files into a cache directory, where they are stored by
+// their sha256sum.
+type Fetcher struct {
+	dir    string
+	client *http.Client
+}
+
+// NewFetcher creates a new fetcher that stores downloaded files in dir. If
+// client is nil, a client with the default timeouts is used.
+func NewFetcher(dir string, client *http.Client) *Fetcher {
+	if client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = DefaultResponseHeaderTimeout
+
+		client = &http.Client{
+			Transport: transport,
+			Timeout:   DefaultTimeout,
+		}
+	}
+
+	return &Fetcher{dir: dir, client: client}
+}
+
+// Path returns the path that a file with the given sha256sum is cached at.
+func (f *Fetcher) Path(sha256 string) string {
+	return filepath.Join(f.dir, "sha256", sha256)
+}
+
+// MetadataPath returns the path that metadata about a file with the given
+// sha256sum (eg. an index of the contents of an archive) is cached at.
+func (f *Fetcher) MetadataPath(sha256 string) string {
+	return filepath.Join(f.dir, "metadata", sha256+".json")
+}
+
+// Fetch downloads the file at url (unless it is already cached) and returns
+// the path of the cached file. The file must have the expected sha256sum, and
+// must not be larger than the largest deb file allowed by the limits. The
+// headers are only sent to the host of the url, they are removed if the
+// request is redirected to a different host.
+func (f *Fetcher) Fetch(ctx context.Context, url, expectedSHA256 string, header http.Header, limits deb.Limits) (string, error) {
+	return f.FetchWith(ctx, url, expectedSHA256, limits, func(ctx context.Context) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		client := *f.client
+		client.CheckRedirect = redirectPolicy(header, f.client.CheckRedirect)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", url, err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("failed to download %s: unexpected status: %s", url, resp.Status)
+		}
+
+		return resp.Body, nil
+	})
+}
+
+// redirectPolicy returns a redirect policy that removes the given headers from
+// any request that is redirected to a different host (as they may contain
+// credentials), before applying the client's own policy (if any).
+func redirectPolicy(header http.Header, next func(req *http.Request, via []*http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != via[0].URL.Host {
+			for name := range header {
+				req.Header.Del(name)
+			}
+		}
+
+		if next != nil {
+			return next(req, via)
+		}
+
+		if len(via) >= maxRedirects {
+			return errors.New("stopped after too many redirects")
+		}
+
+		return nil
+	}
+}
+
+// FetchWith is like Fetch, but reads the file using the given open function
+// (eg. for downloads that require a custom client). The name is only used in
+// log and error messages.
+func (f *Fetcher) FetchWith(ctx context.Context, name, expectedSHA256 string, limits deb.Limits, open func(ctx context.Context) (io.ReadCloser, error)) (string, error) {
+	expectedSHA256 = strings.ToLower(expectedSHA256)
+	if !isSHA256(expectedSHA256) {
+		return "", fmt.Errorf("invalid sha256 for %s: %q", name, expectedSHA256)
+	}
+
+	path := f.Path(expectedSHA256)
+
+	// Cached files are verified again, in case they have been modified.
+	if _, err := os.Stat(path); err == nil {
+		actualSHA256, err := sha256sum.File(ctx, path)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash cached file: %w", err)
+		}
+
+		if actualSHA256 == expectedSHA256 {
+			slog.Debug("Using cached file", slog.String("name", name), slog.String("path", path))
+			return path, nil
+		}
+
+		slog.Warn("Cached file is corrupt, downloading it again",
+			slog.String("name", name), slog.String("path", path))
+	}
+
+	slog.Info("Downloading", slog.String("name", name))
+
+	r, err := open(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	if _, err := f.store(ctx, r, name, expectedSHA256, limits.MaxFileSize()); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Store copies the contents of r into the cache (eg. a file extracted from an
+// archive) and returns the path of the cached file.
+func (f *Fetcher) Store(ctx context.Context, name string, r io.Reader) (string, error) {
+	sha256, err := f.store(ctx, r, name, "", 0)
+	if err != nil {
+		return "", err
+	}
+
+	return f.Path(sha256), nil
+}
+
+// store writes the contents of r into the cache, provided it has the
+// expected sha256sum (if specified) and is no larger than maxSize (if
+// non-zero). Returns the sha256sum of the contents.
+func (f *Fetcher) store(ctx context.Context, r io.Reader, name, expectedSHA256 string, maxSize int64) (string, error) {
+	dir := filepath.Join(f.dir, "sha256")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	// Download into a temporary file, so that a partial download is never
+	// mistaken for the real thing.
+	tempFile, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+
+	r = util.NewContextReader(ctx, r)
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tempFile, h), r)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", name, err)
+	}
+
+	if maxSize > 0 && n > maxSize {
+		return "", &deb.LimitExceededError{Path: name, Limit: "file size", Max: float64(maxSize)}
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	actualSHA256 := hex.EncodeToString(h.Sum(nil))
+	if expectedSHA256 != "" && actualSHA256 != expectedSHA256 {
+		return "", &ChecksumMismatchError{Name: name, Expected: expectedSHA256, Actual: actualSHA256}
+	}
+
+	if err := os.Rename(tempFile.Name(), f.Path(actualSHA256)); err != nil {
+		return "", fmt.Errorf("failed to move %s into cache: %w", name, err)
+	}
+
+	return actualSHA256, nil
+}
+
+// HeaderFromEnv builds a set of HTTP headers from a map of header names to
+// the environment variables that hold their values.
+func HeaderFromEnv(headersFromEnv map[string]string) (http.Header, error) {
+	header := make(http.Header)
+	for name, envVar := range headersFromEnv {
+		value, ok := os.LookupEnv(envVar)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s for header %s is not set", envVar, name)
+		}
+
+		header.Set(name, value)
+	}
+
+	return header, nil
+}
+
+func isSHA256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
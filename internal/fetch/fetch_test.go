@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+
+	content := []byte("hello world")
+	sum := sha256.Sum256(content)
+	contentSHA256 := hex.EncodeToString(sum[:])
+
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		switch r.URL.Path {
+		case "/hello.deb":
+			_, _ = w.Write(content)
+		case "/private.deb":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write(content)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Run("Download", func(t *testing.T) {
+		f := NewFetcher(t.TempDir(), srv.Client())
+
+		path, err := f.Fetch(ctx, srv.URL+"/hello.deb", strings.ToUpper(contentSHA256), nil, deb.DefaultLimits)
+		require.NoError(t, err)
+		require.Equal(t, f.Path(contentSHA256), path)
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, content, data)
+	})
+
+	t.Run("Cache Hit", func(t *testing.T) {
+		f := NewFetcher(t.TempDir(), srv.Client())
+
+		_, err := f.Fetch(ctx, srv.URL+"/hello.deb", contentSHA256, nil, deb.DefaultLimits)
+		require.NoError(t, err)
+
+		before := requests.Load()
+
+		path, err := f.Fetch(ctx, srv.URL+"/hello.deb", contentSHA256, nil, deb.DefaultLimits)
+		require.NoError(t, err)
+		require.Equal(t, f.Path(contentSHA256), path)
+
+		require.Equal(t, before, requests.Load(), "cached file was downloaded again")
+	})
+
+	t.Run("Corrupt Cache", func(t *testing.T) {
+		f := NewFetcher(t.TempDir(), srv.Client())
+
+		require.NoError(t, os.MkdirAll(filepath.Dir(f.Path(contentSHA256)), 0o755))
+		require.NoError(t, os.WriteFile(f.Path(contentSHA256), []byte("corrupt"), 0o644))
+
+		path, err := f.Fetch(ctx, srv.URL+"/hello.deb", contentSHA256, nil, deb.DefaultLimits)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, content, data)
+	})
+
+	t.Run("Checksum Mismatch", func(t *testing.T) {
+		dir := t.TempDir()
+		f := NewFetcher(dir, srv.Client())
+
+		expectedSHA256 := strings.Repeat("0", 64)
+		_, err := f.Fetch(ctx, srv.URL+"/hello.deb", expectedSHA256, nil, deb.DefaultLimits)
+
+		var mismatchErr *ChecksumMismatchError
+		require.ErrorAs(t, err, &mismatchErr)
+		require.Equal(t, contentSHA256, mismatchErr.Actual)
+
+		// Nothing is left behind in the cache.
+		entries, err := os.ReadDir(filepath.Join(dir, "sha256"))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("Invalid Checksum", func(t *testing.T) {
+		f := NewFetcher(t.TempDir(), srv.Client())
+
+		_, err := f.Fetch(ctx, srv.URL+"/hello.deb", "abc", nil, deb.DefaultLimits)
+		require.ErrorContains(t, err, "invalid sha256")
+	})
+
+	t.Run("Unexpected Status", func(t *testing.T) {
+		dir := t.TempDir()
+		f := NewFetcher(dir, srv.Client())
+
+		_, err := f.Fetch(ctx, srv.URL+"/missing.deb", contentSHA256, nil, deb.DefaultLimits)
+		require.ErrorContains(t, err, "unexpected status: 404 Not Found")
+
+		_, err = os.Stat(f.Path(contentSHA256))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Headers From Env", func(t *testing.T) {
+		f := NewFetcher(t.TempDir(), srv.Client())
+
+		_, err := f.Fetch(ctx, srv.URL+"/private.deb", contentSHA256, nil, deb.DefaultLimits)
+		require.ErrorContains(t, err, "unexpected status: 401 Unauthorized")
+
+		t.Setenv("APTIFY_TEST_AUTHORIZATION", "Bearer secret")
+
+		header, err := HeaderFromEnv(map[string]string{"Authorization": "APTIFY_TEST_AUTHORIZATION"})
+		require.NoError(t, err)
+
+		_, err = f.Fetch(ctx, srv.URL+"/private.deb", contentSHA256, header, deb.DefaultLimits)
+		require.NoError(t, err)
+
+		_, err = HeaderFromEnv(map[string]string{"Authorization": "APTIFY_TEST_UNSET"})
+		require.ErrorContains(t, err, "APTIFY_TEST_UNSET")
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		// Another host, which must not receive the headers.
+		otherSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Api-Key") != "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write(content)
+		}))
+		t.Cleanup(otherSrv.Close)
+
+		redirectSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Api-Key") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/same-host.deb":
+				http.Redirect(w, r, "/hello.deb", http.StatusFound)
+			case "/other-host.deb":
+				http.Redirect(w, r, otherSrv.URL+"/hello.deb", http.StatusFound)
+			default:
+				_, _ = w.Write(content)
+			}
+		}))
+		t.Cleanup(redirectSrv.Close)
+
+		header := http.Header{"X-Api-Key": []string{"secret"}}
+
+		_, err := NewFetcher(t.TempDir(), nil).Fetch(ctx, redirectSrv.URL+"/same-host.deb", contentSHA256, header, deb.DefaultLimits)
+		require.NoError(t, err)
+
+		_, err = NewFetcher(t.TempDir(), nil).Fetch(ctx, redirectSrv.URL+"/other-host.deb", contentSHA256, header, deb.DefaultLimits)
+		require.NoError(t, err)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		dir := t.TempDir()
+		f := NewFetcher(dir, srv.Client())
+
+		limits := deb.Limits{MaxControlSize: 1, MaxDataSize: 1}
+		largeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(make([]byte, limits.MaxFileSize()+1))
+		}))
+		t.Cleanup(largeSrv.Close)
+
+		_, err := f.Fetch(ctx, largeSrv.URL+"/large.deb", contentSHA256, nil, limits)
+		var limitErr *deb.LimitExceededError
+		require.ErrorAs(t, err, &limitErr)
+		require.Equal(t, "file size", limitErr.Limit)
+
+		// Nothing is left behind in the cache.
+		entries, err := os.ReadDir(filepath.Join(dir, "sha256"))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("Store", func(t *testing.T) {
+		f := NewFetcher(t.TempDir(), nil)
+
+		path, err := f.Store(ctx, "hello.deb", strings.NewReader(string(content)))
+		require.NoError(t, err)
+		require.Equal(t, f.Path(contentSHA256), path)
+	})
+}
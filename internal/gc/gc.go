@@ -0,0 +1,300 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package gc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/publish"
+	"github.com/dpeckett/aptify/internal/repository"
+)
+
+// Options configures garbage collection.
+type Options struct {
+	// KeepGenerations is the number of published generations to keep.
+	KeepGenerations int
+	// GracePeriod is how long a superseded generation (and the pool files it
+	// references) is kept around for.
+	GracePeriod time.Duration
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// Result describes what was removed by a garbage collection run.
+type Result struct {
+	// Generations is the list of removed generation ids.
+	Generations []string
+	// Files is the list of removed files (relative to the repository directory).
+	Files []string
+}
+
+// Collect removes old generations, stale staging directories, and any pool
+// files that are no longer referenced by the indices of a remaining generation.
+// Like generations, pool files are only removed once they have been
+// unreferenced for at least the grace period.
+func Collect(repoDir string, opts Options) (*Result, error) {
+	// Without a published generation there is no way to know which pool files
+	// are still in use.
+	current, err := publish.CurrentGeneration(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	if current == "" {
+		return nil, fmt.Errorf("repository has no published generation; run 'aptify build' first")
+	}
+
+	// The references of the generations that are about to be pruned are needed
+	// to know when their pool files were last in use.
+	references, err := poolReferences(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result Result
+	result.Generations, err = publish.Prune(repoDir, opts.KeepGenerations, opts.GracePeriod, opts.DryRun)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune generations: %w", err)
+	}
+
+	stagingDirs, err := publish.StagingDirs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for dir, createdAt := range stagingDirs {
+		if time.Since(createdAt) < opts.GracePeriod {
+			continue
+		}
+
+		relPath, err := filepath.Rel(repoDir, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := remove(dir, opts.DryRun); err != nil {
+			return nil, fmt.Errorf("failed to remove staging directory: %w", err)
+		}
+
+		result.Files = append(result.Files, relPath)
+	}
+
+	removedGenerations := make(map[string]bool)
+	for _, id := range result.Generations {
+		removedGenerations[id] = true
+	}
+
+	poolDir := filepath.Join(repoDir, "pool")
+	err = filepath.WalkDir(poolDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(repoDir, path)
+		if err != nil {
+			return err
+		}
+
+		lastUsed, inUse, err := references.lastUsed(filepath.ToSlash(relPath), removedGenerations)
+		if err != nil {
+			return err
+		}
+
+		if inUse {
+			return nil
+		}
+
+		// Files that were never referenced by a generation (eg. left behind by
+		// a failed build) fall back to when they were placed in the pool.
+		if lastUsed.IsZero() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			lastUsed = fi.ModTime()
+		}
+
+		if time.Since(lastUsed) < opts.GracePeriod {
+			slog.Debug("Keeping recently unreferenced pool file", slog.String("path", relPath))
+			return nil
+		}
+
+		if err := remove(path, opts.DryRun); err != nil {
+			return fmt.Errorf("failed to remove pool file: %w", err)
+		}
+
+		result.Files = append(result.Files, relPath)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk pool directory: %w", err)
+	}
+
+	if !opts.DryRun {
+		if err := removeEmptyDirs(poolDir); err != nil {
+			return nil, fmt.Errorf("failed to remove empty pool directories: %w", err)
+		}
+	}
+
+	return &result, nil
+}
+
+// references records which generations reference each pool file.
+type references struct {
+	// ids is every generation id, oldest first.
+	ids []string
+	// generations maps each pool file to the generations that reference it.
+	generations map[string][]string
+}
+
+// poolReferences reads the Packages indices of every generation.
+func poolReferences(repoDir string) (*references, error) {
+	ids, err := publish.Generations(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := &references{ids: ids, generations: make(map[string][]string)}
+	for _, id := range ids {
+		distsDir := filepath.Join(repoDir, publish.StateDirName, "generations", id, "dists")
+		err := filepath.WalkDir(distsDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() || d.Name() != "Packages" {
+				return nil
+			}
+
+			packages, err := repository.ReadPackagesIndice(path)
+			if err != nil {
+				return err
+			}
+
+			for _, pkg := range packages {
+				if !slices.Contains(refs.generations[pkg.Filename], id) {
+					refs.generations[pkg.Filename] = append(refs.generations[pkg.Filename], id)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read indices of generation %q: %w", id, err)
+		}
+	}
+
+	return refs, nil
+}
+
+// lastUsed returns whether a pool file is referenced by a generation that
+// hasn't been removed, and if not, when it was last referenced (ie. when the
+// generation following the newest removed generation that referenced it was
+// published). The time is zero if the file was never referenced.
+func (r *references) lastUsed(filename string, removed map[string]bool) (time.Time, bool, error) {
+	var newest string
+	for _, id := range r.generations[filename] {
+		if !removed[id] {
+			return time.Time{}, true, nil
+		}
+
+		newest = max(newest, id)
+	}
+
+	if newest == "" {
+		return time.Time{}, false, nil
+	}
+
+	i := slices.Index(r.ids, newest)
+	if i+1 >= len(r.ids) {
+		return time.Time{}, false, nil
+	}
+
+	supersededAt, err := publish.GenerationTime(r.ids[i+1])
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return supersededAt, false, nil
+}
+
+func remove(path string, dryRun bool) error {
+	if dryRun {
+		slog.Info("Would remove", slog.String("path", path))
+		return nil
+	}
+
+	slog.Info("Removing", slog.String("path", path))
+
+	return os.RemoveAll(path)
+}
+
+// removeEmptyDirs removes any empty subdirectories of dir (deepest first).
+func removeEmptyDirs(dir string) error {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if d.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			if err := os.Remove(dirs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package gc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/publish"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollect(t *testing.T) {
+	repoDir := t.TempDir()
+
+	_, err := Collect(repoDir, Options{})
+	require.Error(t, err, "repository has never been published")
+
+	for _, filename := range []string{"pool/main/a/a_1.0_amd64.deb", "pool/main/b/b_1.0_amd64.deb", "pool/main/o/orphan_1.0_amd64.deb"} {
+		writeFile(t, filepath.Join(repoDir, filename), "deb")
+	}
+
+	first := publishGeneration(t, repoDir, "pool/main/a/a_1.0_amd64.deb", "pool/main/b/b_1.0_amd64.deb")
+	second := publishGeneration(t, repoDir, "pool/main/b/b_1.0_amd64.deb")
+
+	t.Run("Grace Period", func(t *testing.T) {
+		result, err := Collect(repoDir, Options{KeepGenerations: 1, GracePeriod: time.Hour})
+		require.NoError(t, err)
+
+		require.Empty(t, result.Generations)
+		// The orphan was only just placed in the pool.
+		require.Empty(t, result.Files)
+	})
+
+	// Pretend the orphan was left behind by a build that failed a while ago.
+	orphanPath := filepath.Join(repoDir, "pool/main/o/orphan_1.0_amd64.deb")
+	longAgo := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(orphanPath, longAgo, longAgo))
+
+	t.Run("Dry Run", func(t *testing.T) {
+		result, err := Collect(repoDir, Options{KeepGenerations: 1, DryRun: true})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{first}, result.Generations)
+		require.ElementsMatch(t, []string{"pool/main/a/a_1.0_amd64.deb", "pool/main/o/orphan_1.0_amd64.deb"}, result.Files)
+
+		require.FileExists(t, filepath.Join(repoDir, "pool/main/a/a_1.0_amd64.deb"))
+	})
+
+	result, err := Collect(repoDir, Options{KeepGenerations: 1, GracePeriod: time.Hour / 2})
+	require.NoError(t, err)
+
+	// The first generation is still within the grace period, but the orphan
+	// isn't.
+	require.Empty(t, result.Generations)
+	require.Equal(t, []string{"pool/main/o/orphan_1.0_amd64.deb"}, result.Files)
+	require.NoDirExists(t, filepath.Join(repoDir, "pool/main/o"))
+
+	result, err = Collect(repoDir, Options{KeepGenerations: 1})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{first}, result.Generations)
+	require.Equal(t, []string{"pool/main/a/a_1.0_amd64.deb"}, result.Files)
+
+	require.FileExists(t, filepath.Join(repoDir, "pool/main/b/b_1.0_amd64.deb"))
+
+	ids, err := publish.Generations(repoDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{second}, ids)
+}
+
+func TestLastUsed(t *testing.T) {
+	publishedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, publishedAt.Add(time.Duration(i)*time.Hour).Format("20060102T150405.000000000Z"))
+	}
+
+	refs := &references{
+		ids: ids,
+		generations: map[string][]string{
+			"pool/a.deb": {ids[0]},
+			"pool/b.deb": {ids[0], ids[1]},
+		},
+	}
+
+	removed := map[string]bool{ids[0]: true, ids[1]: true}
+
+	// Superseded when the generation after the last one to reference it was
+	// published.
+	lastUsed, inUse, err := refs.lastUsed("pool/a.deb", removed)
+	require.NoError(t, err)
+	require.False(t, inUse)
+	require.Equal(t, publishedAt.Add(time.Hour), lastUsed)
+
+	lastUsed, inUse, err = refs.lastUsed("pool/b.deb", removed)
+	require.NoError(t, err)
+	require.False(t, inUse)
+	require.Equal(t, publishedAt.Add(2*time.Hour), lastUsed)
+
+	_, inUse, err = refs.lastUsed("pool/b.deb", map[string]bool{ids[0]: true})
+	require.NoError(t, err)
+	require.True(t, inUse)
+
+	lastUsed, inUse, err = refs.lastUsed("pool/c.deb", removed)
+	require.NoError(t, err)
+	require.False(t, inUse)
+	require.True(t, lastUsed.IsZero())
+}
+
+// publishGeneration publishes a generation whose Packages index references
+// the given pool files.
+func publishGeneration(t *testing.T, repoDir string, filenames ...string) string {
+	t.Helper()
+
+	staging, err := publish.Stage(repoDir)
+	require.NoError(t, err)
+
+	var packages string
+	for i, filename := range filenames {
+		packages += fmt.Sprintf("Package: pkg%d\nVersion: 1.0\nArchitecture: amd64\nFilename: %s\nSize: 3\n\n", i, filename)
+	}
+
+	writeFile(t, filepath.Join(staging.DistsDir(), "stable", "main", "binary-amd64", "Packages"), packages)
+
+	require.NoError(t, staging.Commit(10, 0))
+
+	current, err := publish.CurrentGeneration(repoDir)
+	require.NoError(t, err)
+
+	return current
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
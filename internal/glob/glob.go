@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package glob extends filepath.Glob with support for recursive "**" patterns.
+package glob
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// recursive is the pattern segment that matches zero or more directories.
+const recursive = "**"
+
+// HasMeta returns true if the pattern contains any glob meta characters.
+func HasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// IsRecursive returns true if the pattern contains a "**" segment.
+func IsRecursive(pattern string) bool {
+	for _, segment := range split(pattern) {
+		if segment == recursive {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Base returns the deepest directory of a pattern that does not contain any
+// glob meta characters.
+func Base(pattern string) string {
+	dir := filepath.Dir(filepath.Clean(pattern))
+	for HasMeta(dir) {
+		dir = filepath.Dir(dir)
+	}
+
+	return dir
+}
+
+// Match reports whether name matches the pattern. In addition to the syntax
+// supported by filepath.Match, a "**" path segment matches zero or more
+// directories.
+func Match(pattern, name string) (bool, error) {
+	return matchSegments(split(pattern), split(name))
+}
+
+// Glob returns the names of all files matching the pattern, in lexical
+// order. Patterns without a "**" segment are handled by filepath.Glob.
+// Nothing within any of the skipped directories is returned, and recursive
+// patterns never descend into them.
+func Glob(pattern string, skip ...string) ([]string, error) {
+	if !IsRecursive(pattern) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		return slices.DeleteFunc(matches, func(match string) bool {
+			return Within(match, skip...)
+		}), nil
+	}
+
+	// Check the pattern is well formed, before walking any directories.
+	if err := Validate(pattern); err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	err := filepath.WalkDir(Base(pattern), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The base directory doesn't exist, so nothing matches.
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if d.IsDir() && Within(path, skip...) {
+			return filepath.SkipDir
+		}
+
+		if ok, _ := Match(pattern, path); ok {
+			matches = append(matches, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+// Within returns true if the path is one of the given directories, or is
+// beneath one of them.
+func Within(path string, dirs ...string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	for _, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+
+		if absPath == absDir || strings.HasPrefix(absPath, absDir+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks that the pattern is well formed.
+func Validate(pattern string) error {
+	for _, segment := range split(pattern) {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == recursive {
+			// Collapse consecutive "**" segments.
+			for len(pattern) > 0 && pattern[0] == recursive {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 0 {
+				return true, nil
+			}
+
+			for i := 0; i <= len(name); i++ {
+				ok, err := matchSegments(pattern, name[i:])
+				if ok || err != nil {
+					return ok, err
+				}
+			}
+
+			return false, nil
+		}
+
+		if len(name) == 0 {
+			return false, nil
+		}
+
+		ok, err := filepath.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false, err
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0, nil
+}
+
+func split(path string) []string {
+	path = filepath.Clean(path)
+	if path == "." {
+		return nil
+	}
+
+	return strings.Split(path, string(filepath.Separator))
+}
@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package glob
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"dist/*.deb", "dist/hello.deb", true},
+		{"dist/*.deb", "dist/sub/hello.deb", false},
+		{"dist/**/*.deb", "dist/hello.deb", true},
+		{"dist/**/*.deb", "dist/a/b/hello.deb", true},
+		{"dist/**/*.deb", "other/hello.deb", false},
+		{"**/*-dbgsym_*.deb", "dist/a/hello-dbgsym_1.0_amd64.deb", true},
+		{"dist/**", "dist/a/b", true},
+		{"dist/**/**/b/*.deb", "dist/b/hello.deb", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			ok, err := Match(filepath.FromSlash(tt.pattern), filepath.FromSlash(tt.name))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, ok)
+		})
+	}
+
+	_, err := Match("dist/[", "dist/a")
+	require.Error(t, err)
+}
+
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"hello.deb",
+		"a/world.deb",
+		"a/b/other.deb",
+		"a/README",
+		"repository/pool/main/h/hello/hello.deb",
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, nil, 0o644))
+	}
+
+	t.Run("Recursive", func(t *testing.T) {
+		matches, err := Glob(filepath.Join(dir, "**", "*.deb"))
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			filepath.Join(dir, "a", "b", "other.deb"),
+			filepath.Join(dir, "a", "world.deb"),
+			filepath.Join(dir, "hello.deb"),
+			filepath.Join(dir, "repository", "pool", "main", "h", "hello", "hello.deb"),
+		}, matches)
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		matches, err := Glob(filepath.Join(dir, "**", "*.deb"), filepath.Join(dir, "repository"))
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			filepath.Join(dir, "a", "b", "other.deb"),
+			filepath.Join(dir, "a", "world.deb"),
+			filepath.Join(dir, "hello.deb"),
+		}, matches)
+	})
+
+	t.Run("Not Recursive", func(t *testing.T) {
+		matches, err := Glob(filepath.Join(dir, "*", "*.deb"))
+		require.NoError(t, err)
+		require.Equal(t, []string{filepath.Join(dir, "a", "world.deb")}, matches)
+	})
+
+	t.Run("Not Recursive Skip", func(t *testing.T) {
+		matches, err := Glob(filepath.Join(dir, "*", "*"), filepath.Join(dir, "a"))
+		require.NoError(t, err)
+		require.Equal(t, []string{filepath.Join(dir, "repository", "pool")}, matches)
+	})
+
+	t.Run("Missing Base", func(t *testing.T) {
+		matches, err := Glob(filepath.Join(dir, "missing", "**", "*.deb"))
+		require.NoError(t, err)
+		require.Empty(t, matches)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := Glob(filepath.Join(dir, "**", "["))
+		require.Error(t, err)
+	})
+}
+
+func TestBase(t *testing.T) {
+	require.Equal(t, filepath.FromSlash("dist/a"), Base(filepath.FromSlash("dist/a/*.deb")))
+	require.Equal(t, "dist", Base(filepath.FromSlash("dist/**/*.deb")))
+	require.Equal(t, ".", Base(filepath.FromSlash("**/*.deb")))
+}
+
+func TestWithin(t *testing.T) {
+	require.True(t, Within("repository", "repository"))
+	require.True(t, Within(filepath.FromSlash("./repository/pool/main"), "other", "repository"))
+	require.False(t, Within("repository-src", "repository"))
+	require.False(t, Within("repository"))
+}
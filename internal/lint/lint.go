@@ -0,0 +1,350 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package lint checks deb files for common packaging mistakes.
+package lint
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/repository"
+	"github.com/dpeckett/deb822/types"
+)
+
+// Severity is how a failed check is treated.
+type Severity string
+
+const (
+	// SeverityError fails the lint (and the build, if linting is enabled).
+	SeverityError Severity = "error"
+	// SeverityWarning reports the failure, but doesn't fail the lint.
+	SeverityWarning Severity = "warning"
+	// SeverityIgnore disables the check.
+	SeverityIgnore Severity = "ignore"
+)
+
+// ParseSeverity parses a severity.
+func ParseSeverity(s string) (Severity, error) {
+	switch severity := Severity(s); severity {
+	case SeverityError, SeverityWarning, SeverityIgnore:
+		return severity, nil
+	default:
+		return "", fmt.Errorf("unsupported severity: %s", s)
+	}
+}
+
+// The names of the checks.
+const (
+	// CheckRequiredFields checks that the mandatory control fields are present.
+	CheckRequiredFields = "required-fields"
+	// CheckPackageName checks that the Package and Source fields conform to
+	// Debian policy.
+	CheckPackageName = "package-name"
+	// CheckVersion checks that the version conforms to Debian policy.
+	CheckVersion = "version"
+	// CheckArchitecture checks that the architecture is one known to Debian.
+	CheckArchitecture = "architecture"
+	// CheckFilename checks that the name of the deb file matches its control
+	// fields.
+	CheckFilename = "filename"
+	// CheckPermissions checks for unusual file permissions and ownership in the
+	// data archive.
+	CheckPermissions = "permissions"
+	// CheckInstalledSize checks that the Installed-Size field agrees with the
+	// size of the files in the data archive.
+	CheckInstalledSize = "installed-size"
+)
+
+// DefaultSeverities is the severity of each check, unless otherwise
+// configured.
+var DefaultSeverities = map[string]Severity{
+	CheckRequiredFields: SeverityError,
+	CheckPackageName:    SeverityError,
+	CheckVersion:        SeverityError,
+	CheckArchitecture:   SeverityError,
+	CheckFilename:       SeverityWarning,
+	CheckPermissions:    SeverityWarning,
+	CheckInstalledSize:  SeverityWarning,
+}
+
+// The tolerance of the installed-size check, the Installed-Size field may
+// differ from the size of the files in the data archive by whichever is larger
+// (as tools estimate the size of directories and symlinks differently).
+const (
+	installedSizeToleranceKiB     = 16
+	installedSizeTolerancePercent = 10
+)
+
+// The architectures supported by Debian and its ports.
+var knownArchitectures = []string{
+	"all", "alpha", "amd64", "arm64", "armel", "armhf", "hppa", "hurd-amd64",
+	"hurd-i386", "i386", "ia64", "kfreebsd-amd64", "kfreebsd-i386", "loong64",
+	"m68k", "mips64el", "mipsel", "powerpc", "ppc64", "ppc64el", "riscv64",
+	"s390x", "sh4", "sparc64", "x32",
+}
+
+// Finding is a failed check.
+type Finding struct {
+	// Check is the name of the check that failed.
+	Check string `json:"check"`
+	// Severity is the configured severity of the check.
+	Severity Severity `json:"severity"`
+	// Location is where the deb file was obtained from.
+	Location string `json:"location"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s [%s]", f.Severity, f.Location, f.Message, f.Check)
+}
+
+// Linter checks deb files.
+type Linter struct {
+	severities map[string]Severity
+}
+
+// NewLinter creates a new linter, the configuration is optional.
+func NewLinter(conf *v1alpha2.LintConfig) (*Linter, error) {
+	severities := make(map[string]Severity, len(DefaultSeverities))
+	for check, severity := range DefaultSeverities {
+		severities[check] = severity
+	}
+
+	if conf != nil {
+		for check, s := range conf.Severities {
+			if _, ok := DefaultSeverities[check]; !ok {
+				return nil, fmt.Errorf("unknown lint check: %s", check)
+			}
+
+			severity, err := ParseSeverity(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid severity for lint check %s: %w", check, err)
+			}
+
+			severities[check] = severity
+		}
+	}
+
+	return &Linter{severities: severities}, nil
+}
+
+// LintFile checks the deb file at path.
+func (l *Linter) LintFile(ctx context.Context, path string, limits deb.Limits) ([]Finding, error) {
+	pkg, err := deb.GetMetadata(ctx, path, limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package %s: %w", path, err)
+	}
+
+	return l.Lint(ctx, pkg, path, path, limits)
+}
+
+// LintResolved checks every deb file that will be placed into the pool, along
+// with any that were left out because their control fields are invalid.
+func (l *Linter) LintResolved(ctx context.Context, resolved *repository.Resolved) ([]Finding, error) {
+	poolPaths := make([]string, 0, len(resolved.PoolFiles))
+	for poolPath := range resolved.PoolFiles {
+		poolPaths = append(poolPaths, poolPath)
+	}
+	sort.Strings(poolPaths)
+
+	pkgs := make([]*repository.Package, 0, len(poolPaths)+len(resolved.Invalid))
+	for _, poolPath := range poolPaths {
+		pkgs = append(pkgs, resolved.PoolFiles[poolPath])
+	}
+	pkgs = append(pkgs, resolved.Invalid...)
+
+	var findings []Finding
+	for _, pkg := range pkgs {
+		pkgFindings, err := l.Lint(ctx, &pkg.Package, pkg.Path, pkg.Location, resolved.Limits())
+		if err != nil {
+			return nil, err
+		}
+
+		findings = append(findings, pkgFindings...)
+	}
+
+	return findings, nil
+}
+
+// Lint checks a deb file, given its control fields. The location is where the
+// deb file was obtained from, and is used to check the file name.
+func (l *Linter) Lint(ctx context.Context, pkg *types.Package, path, location string, limits deb.Limits) ([]Finding, error) {
+	var findings []Finding
+	report := func(check, format string, args ...any) {
+		if severity := l.severities[check]; severity != SeverityIgnore {
+			findings = append(findings, Finding{
+				Check:    check,
+				Severity: severity,
+				Location: location,
+				Message:  fmt.Sprintf(format, args...),
+			})
+		}
+	}
+
+	var missing []string
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"Package", pkg.Name},
+		{"Version", pkg.Version.String()},
+		{"Architecture", pkg.Architecture.String()},
+		{"Maintainer", pkg.Maintainer},
+		{"Description", pkg.Description},
+	} {
+		if strings.TrimSpace(field.value) == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		report(CheckRequiredFields, "missing required control fields: %s", strings.Join(missing, ", "))
+	}
+
+	if pkg.Name != "" {
+		if err := deb.ValidateNames(pkg); err != nil {
+			report(CheckPackageName, "%v", err)
+		}
+	}
+
+	if !pkg.Version.Empty() && !deb.ValidVersion(pkg.Version) {
+		report(CheckVersion, "invalid version: %q", pkg.Version.String())
+	}
+
+	if arch := pkg.Architecture.String(); arch != "" && arch != "any" {
+		if !deb.ValidArchitecture(arch) {
+			report(CheckArchitecture, "invalid architecture: %q", arch)
+		} else if !slices.Contains(knownArchitectures, arch) {
+			report(CheckArchitecture, "unknown architecture: %s", arch)
+		}
+	}
+
+	if filename := filenameFromLocation(location); strings.HasSuffix(filename, ".deb") && pkg.Name != "" {
+		expected := fmt.Sprintf("%s_%s_%s.deb", pkg.Name, pkg.Version.StringWithoutEpoch(), pkg.Architecture)
+		if filename != expected {
+			report(CheckFilename, "file name %s does not match control fields (expected %s)", filename, expected)
+		}
+	}
+
+	if l.severities[CheckPermissions] == SeverityIgnore && l.severities[CheckInstalledSize] == SeverityIgnore {
+		return findings, nil
+	}
+
+	files, err := deb.GetPackageFiles(ctx, path, limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contents of package %s: %w", location, err)
+	}
+
+	for _, file := range files {
+		if problems := permissionProblems(file); len(problems) > 0 {
+			report(CheckPermissions, "/%s %s", file.Name, strings.Join(problems, ", "))
+		}
+	}
+
+	expected := installedSize(files)
+	tolerance := max(installedSizeToleranceKiB, expected*installedSizeTolerancePercent/100)
+	if pkg.InstalledSize == 0 && expected > tolerance {
+		report(CheckInstalledSize, "missing Installed-Size field (expected about %d KiB)", expected)
+	} else if difference := pkg.InstalledSize - expected; pkg.InstalledSize != 0 && (difference > tolerance || -difference > tolerance) {
+		report(CheckInstalledSize, "Installed-Size is %d KiB, but the files in the package take up about %d KiB", pkg.InstalledSize, expected)
+	}
+
+	return findings, nil
+}
+
+// HasErrors returns true if any of the findings have a severity of error.
+func HasErrors(findings []Finding) bool {
+	return slices.ContainsFunc(findings, func(f Finding) bool {
+		return f.Severity == SeverityError
+	})
+}
+
+// filenameFromLocation returns the file name of a deb file, given the path or
+// URL it was obtained from.
+func filenameFromLocation(location string) string {
+	if u, err := url.Parse(location); err == nil && u.Scheme != "" && u.Host != "" {
+		return path.Base(u.Path)
+	}
+
+	return path.Base(filepath.ToSlash(location))
+}
+
+// installedSize estimates the installed size of a package (in KiB) in the same
+// way as dpkg-gencontrol, each regular file takes up its size rounded up to
+// the nearest KiB, and every other entry (eg. directories and symlinks) 1 KiB.
+func installedSize(files []deb.File) int {
+	var size int64
+	for _, file := range files {
+		if file.Mode.IsRegular() {
+			size += (file.Size + 1023) / 1024
+		} else {
+			size++
+		}
+	}
+
+	return int(size)
+}
+
+// permissionProblems returns a description of anything unusual about the
+// permissions or ownership of a file within the data archive.
+func permissionProblems(file deb.File) []string {
+	if file.Mode&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	var problems []string
+
+	if file.Mode&fs.ModeSetuid != 0 {
+		problems = append(problems, "is setuid")
+	}
+
+	if file.Mode&fs.ModeSetgid != 0 {
+		problems = append(problems, "is setgid")
+	}
+
+	// Sticky directories (eg. /tmp) are expected to be world-writable.
+	if file.Mode.Perm()&0o002 != 0 && !(file.Mode.IsDir() && file.Mode&fs.ModeSticky != 0) {
+		problems = append(problems, "is world-writable")
+	}
+
+	readable := fs.FileMode(0o444)
+	if file.Mode.IsDir() {
+		readable = 0o555
+	}
+	if file.Mode.Perm()&readable != readable {
+		problems = append(problems, fmt.Sprintf("has restrictive permissions (%04o)", file.Mode.Perm()))
+	}
+
+	// Only the statically allocated system ids (0-99) are the same on every
+	// system.
+	if file.UID > 99 || file.GID > 99 {
+		problems = append(problems, fmt.Sprintf("is owned by %d:%d", file.UID, file.GID))
+	}
+
+	return problems
+}
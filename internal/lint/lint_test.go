@@ -0,0 +1,248 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lint
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/repository"
+	"github.com/dpeckett/aptify/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintFile(t *testing.T) {
+	ctx := context.Background()
+
+	linter, err := NewLinter(nil)
+	require.NoError(t, err)
+
+	t.Run("Clean", func(t *testing.T) {
+		findings, err := linter.LintFile(ctx, filepath.Join("..", "..", "testdata", "package", "hello-world_1.0_amd64.deb"), deb.DefaultLimits)
+		require.NoError(t, err)
+		require.Empty(t, findings)
+	})
+
+	dir := t.TempDir()
+
+	writeDeb := func(name string, control string, files ...testutil.File) string {
+		return testutil.WriteDeb(t, filepath.Join(dir, name), testutil.Deb{
+			Control: control,
+			Files: append([]testutil.File{
+				{Name: "./", Typeflag: '5'},
+				{Name: "./usr/", Typeflag: '5'},
+			}, files...),
+		})
+	}
+
+	checks := func(findings []Finding) []string {
+		var checks []string
+		for _, finding := range findings {
+			checks = append(checks, finding.Check)
+		}
+		return checks
+	}
+
+	t.Run("Problems", func(t *testing.T) {
+		path := writeDeb("hello.deb", "Package: hello\nVersion: 1:2:3\nArchitecture: vax\n",
+			testutil.File{Name: "./usr/hello", Mode: 0o4755},
+			testutil.File{Name: "./usr/data", Mode: 0o666})
+
+		findings, err := linter.LintFile(ctx, path, deb.DefaultLimits)
+		require.NoError(t, err)
+
+		require.ElementsMatch(t, []string{
+			CheckRequiredFields,
+			CheckVersion,
+			CheckArchitecture,
+			CheckFilename,
+			CheckPermissions,
+			CheckPermissions,
+		}, checks(findings))
+		require.True(t, HasErrors(findings))
+	})
+
+	t.Run("Installed Size", func(t *testing.T) {
+		// A directory (1 KiB) and a 100 KiB (and 1 byte) file.
+		files := []testutil.File{{Name: "./usr/hello", Body: make([]byte, 100*1024+1)}}
+		const expected = 1 + 101
+
+		tests := []struct {
+			installedSize string
+			finding       bool
+		}{
+			{"", true},
+			{fmt.Sprint(expected), false},
+			{fmt.Sprint(expected + 16), false},
+			{fmt.Sprint(expected - 16), false},
+			{fmt.Sprint(expected + 17), true},
+			{"1", true},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.installedSize, func(t *testing.T) {
+				var fields []string
+				if tt.installedSize != "" {
+					fields = append(fields, "Installed-Size: "+tt.installedSize)
+				}
+
+				path := writeDeb("hello_1.0_amd64.deb", testutil.Control("hello", "1.0", "amd64", fields...), files...)
+
+				findings, err := linter.LintFile(ctx, path, deb.DefaultLimits)
+				require.NoError(t, err)
+
+				if tt.finding {
+					require.Equal(t, []string{CheckInstalledSize}, checks(findings))
+					require.Equal(t, SeverityWarning, findings[0].Severity)
+				} else {
+					require.Empty(t, findings)
+				}
+			})
+		}
+	})
+
+	t.Run("Severities", func(t *testing.T) {
+		path := writeDeb("hello_1.0_amd64.deb", testutil.Control("hello", "1.0", "amd64", "Installed-Size: 1000"),
+			testutil.File{Name: "./usr/hello", Mode: 0o600})
+
+		linter, err := NewLinter(&v1alpha2.LintConfig{
+			Severities: map[string]string{
+				CheckInstalledSize: string(SeverityError),
+				CheckPermissions:   string(SeverityIgnore),
+			},
+		})
+		require.NoError(t, err)
+
+		findings, err := linter.LintFile(ctx, path, deb.DefaultLimits)
+		require.NoError(t, err)
+		require.Equal(t, []string{CheckInstalledSize}, checks(findings))
+		require.True(t, HasErrors(findings))
+
+		linter, err = NewLinter(&v1alpha2.LintConfig{
+			Severities: map[string]string{
+				CheckInstalledSize: string(SeverityIgnore),
+				CheckPermissions:   string(SeverityIgnore),
+			},
+		})
+		require.NoError(t, err)
+
+		findings, err = linter.LintFile(ctx, path, deb.DefaultLimits)
+		require.NoError(t, err)
+		require.Empty(t, findings)
+	})
+
+	t.Run("Invalid Configuration", func(t *testing.T) {
+		_, err := NewLinter(&v1alpha2.LintConfig{Severities: map[string]string{"bogus": "error"}})
+		require.ErrorContains(t, err, "unknown lint check")
+
+		_, err = NewLinter(&v1alpha2.LintConfig{Severities: map[string]string{CheckInstalledSize: "fatal"}})
+		require.ErrorContains(t, err, "invalid severity")
+	})
+}
+
+func TestLintResolved(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	for _, pkg := range []struct {
+		name    string
+		version string
+	}{
+		{"hello", "1.0"},
+		{"hello", "1:2:3"},
+		{"Hello", "2.0"},
+	} {
+		// Epochs are not part of file names.
+		_, fileVersion, _ := strings.Cut(pkg.version, ":")
+		if fileVersion == "" {
+			fileVersion = pkg.version
+		}
+
+		testutil.WriteDeb(t, filepath.Join(dir, fmt.Sprintf("%s_%s_amd64.deb", pkg.name, fileVersion)), testutil.Deb{
+			Control: testutil.Control(pkg.name, pkg.version, "amd64"),
+		})
+	}
+
+	conf := &v1alpha2.Repository{
+		Releases: []v1alpha2.ReleaseConfig{{
+			Name: "stable",
+			Components: []v1alpha2.ComponentConfig{{
+				Name:     "main",
+				Packages: []string{filepath.Join(dir, "*.deb")},
+			}},
+		}},
+	}
+
+	// Invalid packages fail the build.
+	_, err := repository.Resolve(ctx, conf, repository.ResolveOptions{})
+	require.ErrorContains(t, err, "invalid")
+
+	// But are reported by lint.
+	resolved, err := repository.Resolve(ctx, conf, repository.ResolveOptions{SkipInvalid: true})
+	require.NoError(t, err)
+	require.Len(t, resolved.PoolFiles, 1)
+	require.Len(t, resolved.Invalid, 2)
+
+	linter, err := NewLinter(nil)
+	require.NoError(t, err)
+
+	findings, err := linter.LintResolved(ctx, resolved)
+	require.NoError(t, err)
+
+	require.Equal(t, []Finding{
+		{
+			Check:    CheckPackageName,
+			Severity: SeverityError,
+			Location: filepath.Join(dir, "Hello_2.0_amd64.deb"),
+			Message:  `invalid Package field: "Hello"`,
+		},
+		{
+			Check:    CheckVersion,
+			Severity: SeverityError,
+			Location: filepath.Join(dir, "hello_2:3_amd64.deb"),
+			Message:  `invalid version: "1:2:3"`,
+		},
+	}, findings)
+}
+
+func TestSeverityKeys(t *testing.T) {
+	// The config schema enumerates the check names, keep it in sync.
+	field, ok := reflect.TypeOf(v1alpha2.LintConfig{}).FieldByName("Severities")
+	require.True(t, ok)
+
+	var keys []string
+	for _, opt := range strings.Split(field.Tag.Get("jsonschema"), ",") {
+		if strings.HasPrefix(opt, "keys=") {
+			keys = strings.Split(strings.TrimPrefix(opt, "keys="), "|")
+		}
+	}
+
+	var checks []string
+	for check := range DefaultSeverities {
+		checks = append(checks, check)
+	}
+
+	require.ElementsMatch(t, checks, keys)
+}
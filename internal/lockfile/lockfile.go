@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lockfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dpeckett/aptify/internal/repository"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultName is the default name of the lockfile, it is stored alongside the
+// repository configuration.
+const DefaultName = "aptify.lock"
+
+// formatVersion is the current version of the lockfile format.
+const formatVersion = 1
+
+// Lockfile records the exact deb files that a repository configuration
+// resolved to, so that subsequent builds can be checked against it.
+type Lockfile struct {
+	// Version is the version of the lockfile format.
+	Version int `yaml:"version"`
+	// Packages is the list of resolved deb files.
+	Packages []Package `yaml:"packages"`
+}
+
+// Package is a deb file that was resolved for a component.
+type Package struct {
+	// Release is the name of the release the package belongs to.
+	Release string `yaml:"release"`
+	// Component is the name of the component the package belongs to.
+	Component string `yaml:"component"`
+	// Path is the path (or URL) of the deb file.
+	Path string `yaml:"path"`
+	// SHA256 is the sha256sum of the deb file.
+	SHA256 string `yaml:"sha256"`
+	// Name is the name of the package.
+	Name string `yaml:"name"`
+	// Version is the version of the package.
+	Version string `yaml:"version"`
+	// Architecture is the architecture of the package.
+	Architecture string `yaml:"architecture"`
+}
+
+// FromResolved creates a lockfile from the resolved packages.
+func FromResolved(resolved *repository.Resolved) *Lockfile {
+	lf := &Lockfile{Version: formatVersion}
+
+	for _, release := range resolved.Releases {
+		for _, component := range release.Components {
+			for _, pkg := range component.Packages {
+				lf.Packages = append(lf.Packages, Package{
+					Release:      release.Config.Name,
+					Component:    component.Name,
+					Path:         filepath.ToSlash(pkg.Location),
+					SHA256:       pkg.SHA256,
+					Name:         pkg.Name,
+					Version:      pkg.Version.String(),
+					Architecture: pkg.Architecture.String(),
+				})
+			}
+		}
+	}
+
+	sort.Slice(lf.Packages, func(i, j int) bool {
+		return lf.Packages[i].key() < lf.Packages[j].key()
+	})
+
+	return lf
+}
+
+// Read reads the lockfile at path.
+func Read(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+
+	var lf Lockfile
+	if err := yaml.Unmarshal(data, &lf); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lockfile: %w", err)
+	}
+
+	if lf.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported lockfile version: %d", lf.Version)
+	}
+
+	return &lf, nil
+}
+
+// WriteFile atomically writes the lockfile to path.
+func (lf *Lockfile) WriteFile(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString("# This file is generated by 'aptify lock', do not edit it by hand.\n")
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(lf); err != nil {
+		return fmt.Errorf("failed to marshal lockfile: %w", err)
+	}
+
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("failed to marshal lockfile: %w", err)
+	}
+
+	tempPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tempPath, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+
+	return nil
+}
+
+// Verify checks that the resolved packages match the lockfile exactly,
+// returning an error describing every difference if they don't.
+func (lf *Lockfile) Verify(resolved *repository.Resolved) error {
+	locked := make(map[string]Package)
+	for _, pkg := range lf.Packages {
+		locked[pkg.key()] = pkg
+	}
+
+	current := make(map[string]Package)
+	for _, pkg := range FromResolved(resolved).Packages {
+		current[pkg.key()] = pkg
+	}
+
+	var differences []string
+	for key, pkg := range current {
+		lockedPkg, ok := locked[key]
+		if !ok {
+			differences = append(differences, fmt.Sprintf("%s: not in lockfile", pkg))
+			continue
+		}
+
+		if lockedPkg.SHA256 != pkg.SHA256 {
+			differences = append(differences, fmt.Sprintf("%s: sha256 is %s, expected %s", pkg, pkg.SHA256, lockedPkg.SHA256))
+		} else if lockedPkg != pkg {
+			differences = append(differences, fmt.Sprintf("%s: metadata differs from lockfile (%s)", pkg, lockedPkg))
+		}
+	}
+
+	for key, pkg := range locked {
+		if _, ok := current[key]; !ok {
+			differences = append(differences, fmt.Sprintf("%s: no longer resolved", pkg))
+		}
+	}
+
+	if len(differences) > 0 {
+		sort.Strings(differences)
+		return fmt.Errorf("resolved packages do not match lockfile:\n  %s", strings.Join(differences, "\n  "))
+	}
+
+	return nil
+}
+
+// String returns a human readable description of the package.
+func (p Package) String() string {
+	return fmt.Sprintf("%s/%s %s (%s_%s_%s)", p.Release, p.Component, p.Path, p.Name, p.Version, p.Architecture)
+}
+
+func (p Package) key() string {
+	return strings.Join([]string{p.Release, p.Component, p.Path}, "\x00")
+}
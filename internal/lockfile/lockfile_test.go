@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package lockfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/repository"
+	"github.com/dpeckett/aptify/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockfile(t *testing.T) {
+	debsDir := t.TempDir()
+	writeDeb := func(name, version string, fields ...string) {
+		testutil.WriteDeb(t, filepath.Join(debsDir, name+"_"+version+"_amd64.deb"), testutil.Deb{
+			Control: testutil.Control(name, version, "amd64", fields...),
+		})
+	}
+
+	writeDeb("hello", "1.0")
+	writeDeb("world", "1.0")
+
+	conf := &v1alpha2.Repository{
+		Releases: []v1alpha2.ReleaseConfig{{
+			Name: "stable",
+			Components: []v1alpha2.ComponentConfig{{
+				Name:     "main",
+				Packages: []string{filepath.Join(debsDir, "*.deb")},
+			}},
+		}},
+	}
+
+	resolve := func(t *testing.T) *repository.Resolved {
+		resolved, err := repository.Resolve(context.Background(), conf, repository.ResolveOptions{})
+		require.NoError(t, err)
+		return resolved
+	}
+
+	path := filepath.Join(t.TempDir(), DefaultName)
+	require.NoError(t, FromResolved(resolve(t)).WriteFile(path))
+
+	lf, err := Read(path)
+	require.NoError(t, err)
+
+	require.Len(t, lf.Packages, 2)
+	require.Equal(t, "stable", lf.Packages[0].Release)
+	require.Equal(t, "main", lf.Packages[0].Component)
+	require.Equal(t, filepath.ToSlash(filepath.Join(debsDir, "hello_1.0_amd64.deb")), lf.Packages[0].Path)
+	require.Equal(t, "hello", lf.Packages[0].Name)
+	require.Equal(t, "1.0", lf.Packages[0].Version)
+	require.Equal(t, "amd64", lf.Packages[0].Architecture)
+	require.Len(t, lf.Packages[0].SHA256, 64)
+
+	t.Run("Unchanged", func(t *testing.T) {
+		require.NoError(t, lf.Verify(resolve(t)))
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		// Rebuild hello with different contents, and add a new package.
+		writeDeb("hello", "1.0", "Description: A rebuilt hello")
+		writeDeb("other", "1.0")
+		require.NoError(t, os.Remove(filepath.Join(debsDir, "world_1.0_amd64.deb")))
+
+		err := lf.Verify(resolve(t))
+		require.ErrorContains(t, err, "hello_1.0_amd64.deb (hello_1.0_amd64): sha256 is")
+		require.ErrorContains(t, err, "other_1.0_amd64.deb (other_1.0_amd64): not in lockfile")
+		require.ErrorContains(t, err, "world_1.0_amd64.deb (world_1.0_amd64): no longer resolved")
+	})
+
+	t.Run("Unsupported Version", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("version: 2\npackages: []\n"), 0o644))
+
+		_, err := Read(path)
+		require.ErrorContains(t, err, "unsupported lockfile version")
+	})
+}
@@ -0,0 +1,378 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package oci implements a minimal client for pulling artifacts from OCI
+// (distribution spec) registries.
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// MediaTypeImageManifest is the media type of OCI image manifests.
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	// MediaTypeArtifactManifest is the media type of (experimental) OCI
+	// artifact manifests, as pushed by older versions of ORAS.
+	MediaTypeArtifactManifest = "application/vnd.oci.artifact.manifest.v1+json"
+	// MediaTypeDockerManifest is the media type of Docker image manifests.
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// AnnotationTitle is the annotation containing the file name of a layer.
+	AnnotationTitle = "org.opencontainers.image.title"
+)
+
+// Reference is a repository within a registry, eg.
+// "registry.example.com/team/debs".
+type Reference struct {
+	// Registry is the host (and optional port) of the registry.
+	Registry string
+	// Repository is the name of the repository within the registry.
+	Repository string
+}
+
+// ParseReference parses a repository reference of the form
+// "registry/repository".
+func ParseReference(s string) (Reference, error) {
+	registry, repository, ok := strings.Cut(s, "/")
+	if !ok || registry == "" || repository == "" {
+		return Reference{}, fmt.Errorf("invalid repository reference %q: expected registry/repository", s)
+	}
+
+	if strings.ContainsAny(repository, ":@") {
+		return Reference{}, fmt.Errorf("invalid repository reference %q: must not include a tag or digest", s)
+	}
+
+	return Reference{Registry: registry, Repository: repository}, nil
+}
+
+func (r Reference) String() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// Descriptor describes a blob within a registry.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest is an OCI image (or artifact) manifest.
+type Manifest struct {
+	MediaType string       `json:"mediaType"`
+	Layers    []Descriptor `json:"layers"`
+	// Blobs is used instead of Layers by artifact manifests.
+	Blobs []Descriptor `json:"blobs"`
+}
+
+// Client is a client for an OCI registry.
+type Client struct {
+	ref      Reference
+	baseURL  string
+	client   *http.Client
+	username string
+	password string
+
+	mu    sync.Mutex
+	token string
+}
+
+// ClientOptions configures a registry client.
+type ClientOptions struct {
+	// HTTPClient is the HTTP client to use, defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Insecure uses plain HTTP rather than HTTPS.
+	Insecure bool
+	// Username and Password are optional credentials for the registry.
+	Username string
+	Password string
+}
+
+// NewClient creates a new client for the given repository.
+func NewClient(ref Reference, opts ClientOptions) *Client {
+	scheme := "https"
+	if opts.Insecure {
+		scheme = "http"
+	}
+
+	client := opts.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Client{
+		ref:      ref,
+		baseURL:  scheme + "://" + ref.Registry + "/v2/" + ref.Repository,
+		client:   client,
+		username: opts.Username,
+		password: opts.Password,
+	}
+}
+
+// Tags lists all the tags in the repository.
+func (c *Client) Tags(ctx context.Context) ([]string, error) {
+	var tags []string
+
+	next := c.baseURL + "/tags/list"
+	for next != "" {
+		resp, err := c.get(ctx, next, "application/json")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags: %w", err)
+		}
+
+		var tagList struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&tagList)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tag list: %w", err)
+		}
+
+		tags = append(tags, tagList.Tags...)
+
+		next, err = nextLink(resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tags, nil
+}
+
+// Manifest fetches the manifest for the given tag.
+func (c *Client) Manifest(ctx context.Context, tag string) (*Manifest, error) {
+	resp, err := c.get(ctx, c.baseURL+"/manifests/"+url.PathEscape(tag),
+		strings.Join([]string{MediaTypeImageManifest, MediaTypeArtifactManifest, MediaTypeDockerManifest}, ", "))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest for %s:%s: %w", c.ref, tag, err)
+	}
+	defer resp.Body.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest for %s:%s: %w", c.ref, tag, err)
+	}
+
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	switch manifest.MediaType {
+	case MediaTypeImageManifest, MediaTypeArtifactManifest, MediaTypeDockerManifest:
+	default:
+		return nil, fmt.Errorf("unsupported manifest media type for %s:%s: %s", c.ref, tag, manifest.MediaType)
+	}
+
+	manifest.Layers = append(manifest.Layers, manifest.Blobs...)
+	manifest.Blobs = nil
+
+	return &manifest, nil
+}
+
+// Blob opens the blob with the given digest. The caller is responsible for
+// verifying the contents against the digest.
+func (c *Client) Blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	resp, err := c.get(ctx, c.baseURL+"/blobs/"+digest, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob %s: %w", digest, err)
+	}
+
+	return resp.Body, nil
+}
+
+// get performs a GET request against the registry, authenticating if the
+// registry requests it.
+func (c *Client) get(ctx context.Context, u, accept string) (*http.Response, error) {
+	resp, err := c.do(ctx, u, accept)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+
+		if err := c.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+
+		resp, err = c.do(ctx, u, accept)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+func (c *Client) do(ctx context.Context, u, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	return c.client.Do(req)
+}
+
+// authenticate obtains a bearer token in response to an authentication
+// challenge (see https://distribution.github.io/distribution/spec/auth/token/).
+func (c *Client) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	if strings.EqualFold(scheme, "Basic") {
+		return fmt.Errorf("unauthorized (check the registry credentials)")
+	}
+
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unauthorized (unsupported authentication scheme %q)", scheme)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return fmt.Errorf("invalid authentication realm: %q", params["realm"])
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + c.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create token request: %w", err)
+	}
+
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to request token: unexpected status: %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("failed to decode token: %w", err)
+	}
+
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("token response did not include a token")
+	}
+
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, eg.
+// `Bearer realm="https://auth.example.com/token",service="registry"`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		var key string
+		key, rest, _ = strings.Cut(rest, "=")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return scheme, params
+}
+
+// nextLink returns the URL of the next page of results, if any.
+func nextLink(resp *http.Response) (string, error) {
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return "", nil
+	}
+
+	target, params, _ := strings.Cut(link, ";")
+	if !strings.Contains(params, `rel="next"`) {
+		return "", nil
+	}
+
+	next, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+	if err != nil {
+		return "", fmt.Errorf("invalid link header: %w", err)
+	}
+
+	return resp.Request.URL.ResolveReference(next).String(), nil
+}
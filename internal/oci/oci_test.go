@@ -0,0 +1,228 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// registry is a minimal OCI registry, that requires a bearer token.
+type registry struct {
+	tags      []string
+	manifests map[string]any
+	// contentTypes overrides the content type manifests are served with.
+	contentTypes map[string]string
+	blobs        map[string]string
+}
+
+func (reg *registry) serve(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			username, password, _ := r.BasicAuth()
+			if username != "user" || password != "pass" ||
+				r.URL.Query().Get("service") != "test" || r.URL.Query().Get("scope") != "repository:team/debs:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		const prefix = "/v2/team/debs/"
+		name, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case name == "tags/list":
+			// Serve the tags a page at a time.
+			last := r.URL.Query().Get("last")
+			var page []string
+			for i, tag := range reg.tags {
+				if last == "" || (i > 0 && reg.tags[i-1] == last) {
+					page = append(page, tag)
+					if i+1 < len(reg.tags) {
+						w.Header().Set("Link", `</v2/team/debs/tags/list?n=1&last=`+tag+`>; rel="next"`)
+					}
+					break
+				}
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]any{"name": "team/debs", "tags": page})
+		case strings.HasPrefix(name, "manifests/"):
+			tag := strings.TrimPrefix(name, "manifests/")
+
+			manifest, ok := reg.manifests[tag]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if contentType, ok := reg.contentTypes[tag]; ok {
+				w.Header().Set("Content-Type", contentType)
+			}
+
+			_ = json.NewEncoder(w).Encode(manifest)
+		case strings.HasPrefix(name, "blobs/"):
+			blob, ok := reg.blobs[strings.TrimPrefix(name, "blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			_, _ = io.WriteString(w, blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+
+	layer := Descriptor{MediaType: "application/vnd.debian.binary-package", Digest: "sha256:abc", Size: 5}
+
+	reg := &registry{
+		tags: []string{"1.0", "1.1", "2.0", "artifact", "docker", "index"},
+		manifests: map[string]any{
+			"1.0": Manifest{MediaType: MediaTypeImageManifest, Layers: []Descriptor{layer}},
+			"artifact": map[string]any{
+				"mediaType": MediaTypeArtifactManifest,
+				"blobs":     []Descriptor{layer},
+			},
+			"docker": map[string]any{
+				"layers": []Descriptor{layer},
+			},
+			"index": map[string]any{
+				"mediaType": "application/vnd.oci.image.index.v1+json",
+			},
+		},
+		contentTypes: map[string]string{
+			"docker": MediaTypeDockerManifest,
+		},
+		blobs: map[string]string{
+			"sha256:abc": "hello",
+		},
+	}
+	srv := reg.serve(t)
+
+	ref, err := ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/team/debs")
+	require.NoError(t, err)
+
+	client := NewClient(ref, ClientOptions{
+		HTTPClient: srv.Client(),
+		Insecure:   true,
+		Username:   "user",
+		Password:   "pass",
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		tags, err := client.Tags(ctx)
+		require.NoError(t, err)
+		require.Equal(t, reg.tags, tags)
+	})
+
+	t.Run("Manifest", func(t *testing.T) {
+		for _, tag := range []string{"1.0", "artifact", "docker"} {
+			manifest, err := client.Manifest(ctx, tag)
+			require.NoError(t, err, tag)
+			require.Equal(t, []Descriptor{layer}, manifest.Layers, tag)
+			require.Empty(t, manifest.Blobs, tag)
+		}
+
+		_, err := client.Manifest(ctx, "index")
+		require.ErrorContains(t, err, "unsupported manifest media type")
+
+		_, err = client.Manifest(ctx, "missing")
+		require.ErrorContains(t, err, "unexpected status: 404 Not Found")
+	})
+
+	t.Run("Blob", func(t *testing.T) {
+		r, err := client.Blob(ctx, "sha256:abc")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = r.Close()
+		})
+
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+	})
+
+	t.Run("Bad Credentials", func(t *testing.T) {
+		client := NewClient(ref, ClientOptions{
+			HTTPClient: srv.Client(),
+			Insecure:   true,
+			Username:   "user",
+			Password:   "wrong",
+		})
+
+		_, err := client.Tags(ctx)
+		require.ErrorContains(t, err, "failed to request token: unexpected status: 403 Forbidden")
+	})
+}
+
+func TestParseReference(t *testing.T) {
+	ref, err := ParseReference("registry.example.com:5000/team/debs")
+	require.NoError(t, err)
+	require.Equal(t, Reference{Registry: "registry.example.com:5000", Repository: "team/debs"}, ref)
+	require.Equal(t, "registry.example.com:5000/team/debs", ref.String())
+
+	for _, s := range []string{"registry.example.com", "/team/debs", "registry.example.com/team/debs:latest", "registry.example.com/team/debs@sha256:abc"} {
+		_, err := ParseReference(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/debs:pull"`)
+	require.Equal(t, "Bearer", scheme)
+	require.Equal(t, map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:team/debs:pull",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	require.Equal(t, "Basic", scheme)
+	require.Equal(t, map[string]string{"realm": "registry"}, params)
+}
@@ -0,0 +1,348 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/dpeckett/aptify/internal/sha256sum"
+	"github.com/dpeckett/aptify/internal/util"
+)
+
+// Mode is the strategy used to place package files into the pool.
+type Mode string
+
+const (
+	// ModeCopy copies the package file into the pool.
+	ModeCopy Mode = "copy"
+	// ModeHardlink hard links the package file into the pool.
+	ModeHardlink Mode = "hardlink"
+	// ModeReflink clones the package file into the pool using a copy-on-write
+	// reflink (where supported by the filesystem).
+	ModeReflink Mode = "reflink"
+	// ModeSymlink symbolically links the package file into the pool.
+	ModeSymlink Mode = "symlink"
+)
+
+// ParseMode parses a pool mode, an empty string is treated as ModeCopy.
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case "":
+		return ModeCopy, nil
+	case ModeCopy, ModeHardlink, ModeReflink, ModeSymlink:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported pool mode: %s", s)
+	}
+}
+
+// link creates a hard link (overridden in tests).
+var link = os.Link
+
+// Place places the file at src into the pool at dst using the given mode.
+// If dst already exists and its sha256sum matches, the file is left as is
+// (or replaced if it was placed using an incompatible mode). If a file with a
+// different sha256sum already exists at dst, an error is returned.
+// Hardlinks and reflinks fall back to copying if they are not supported
+// between the source and destination filesystems (or are not permitted).
+func Place(ctx context.Context, src, dst string, mode Mode, sha256 string) error {
+	upToDate, err := IsUpToDate(ctx, dst, mode, sha256)
+	if err != nil {
+		return err
+	}
+	if upToDate {
+		slog.Debug("Package already in pool", slog.String("path", dst))
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("failed to create pool subdirectory: %w", err)
+	}
+
+	// Place the file under a temporary name and then rename it into place, so
+	// that dst is never observed in a partially written state.
+	tempPath := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	_ = os.Remove(tempPath)
+
+	if err := place(ctx, src, tempPath, mode); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Rename(tempPath, dst); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("failed to rename package into place: %w", err)
+	}
+
+	return nil
+}
+
+// Transaction records the files placed into the pool by a build, so that they
+// can be undone if the build is aborted before it is published.
+type Transaction struct {
+	created []string
+	// replaced maps each replaced pool file to a backup of its previous
+	// contents.
+	replaced map[string]string
+}
+
+// NewTransaction creates a new, empty, pool transaction.
+func NewTransaction() *Transaction {
+	return &Transaction{replaced: make(map[string]string)}
+}
+
+// Place places the file at src into the pool at dst (see Place), recording
+// whether dst was created or replaced.
+func (tx *Transaction) Place(ctx context.Context, src, dst string, mode Mode, sha256 string) error {
+	upToDate, err := IsUpToDate(ctx, dst, mode, sha256)
+	if err != nil {
+		return err
+	}
+	if upToDate {
+		slog.Debug("Package already in pool", slog.String("path", dst))
+		return nil
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		if _, ok := tx.replaced[dst]; !ok {
+			backupPath := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".bak")
+			if err := backup(ctx, dst, backupPath); err != nil {
+				return fmt.Errorf("failed to back up pool file: %w", err)
+			}
+
+			tx.replaced[dst] = backupPath
+		}
+	} else if os.IsNotExist(err) {
+		tx.created = append(tx.created, dst)
+	} else {
+		return fmt.Errorf("failed to stat pool file: %w", err)
+	}
+
+	return Place(ctx, src, dst, mode, sha256)
+}
+
+// Commit discards the backups of any replaced files, once the build has been
+// published.
+func (tx *Transaction) Commit() error {
+	var errs []error
+	for _, backupPath := range tx.replaced {
+		if err := os.Remove(backupPath); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove pool file backup: %w", err))
+		}
+	}
+
+	tx.created = nil
+	clear(tx.replaced)
+
+	return errors.Join(errs...)
+}
+
+// Abort removes any files created by the transaction, and restores any files
+// that it replaced.
+func (tx *Transaction) Abort() error {
+	var errs []error
+	for _, dst := range tx.created {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove pool file: %w", err))
+		}
+	}
+
+	for dst, backupPath := range tx.replaced {
+		if err := restore(dst, backupPath); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore pool file: %w", err))
+		}
+	}
+
+	tx.created = nil
+	clear(tx.replaced)
+
+	return errors.Join(errs...)
+}
+
+// restore moves a backup back into place.
+func restore(path, backupPath string) error {
+	// If the file was never replaced, the backup may be a hard link to it (in
+	// which case renaming it would do nothing).
+	if fi, err := os.Lstat(path); err == nil {
+		if backupFi, err := os.Lstat(backupPath); err == nil && os.SameFile(fi, backupFi) {
+			return os.Remove(backupPath)
+		}
+	}
+
+	return os.Rename(backupPath, path)
+}
+
+// backup preserves the pool file at path, which is left in place. It is hard
+// linked where possible, and otherwise copied (or, for symlinks, recreated).
+func backup(ctx context.Context, path, backupPath string) error {
+	_ = os.Remove(backupPath)
+
+	err := link(path, backupPath)
+	if err == nil {
+		return nil
+	}
+	if !isLinkUnsupported(err) {
+		return err
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		return os.Symlink(target, backupPath)
+	}
+
+	if err := copyFile(ctx, path, backupPath); err != nil {
+		_ = os.Remove(backupPath)
+		return err
+	}
+
+	return nil
+}
+
+func place(ctx context.Context, src, dst string, mode Mode) error {
+	switch mode {
+	case ModeHardlink:
+		err := link(src, dst)
+		if err == nil {
+			return nil
+		}
+		if !isLinkUnsupported(err) {
+			return fmt.Errorf("failed to hard link package: %w", err)
+		}
+
+		slog.Debug("Unable to hard link package, falling back to copy",
+			slog.String("src", src), slog.String("dst", dst), slog.Any("error", err))
+	case ModeReflink:
+		err := reflink(src, dst)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errReflinkUnsupported) {
+			return fmt.Errorf("failed to reflink package: %w", err)
+		}
+
+		slog.Debug("Reflinks not supported, falling back to copy",
+			slog.String("src", src), slog.String("dst", dst))
+	case ModeSymlink:
+		absSrc, err := filepath.Abs(src)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path of package: %w", err)
+		}
+
+		if err := os.Symlink(absSrc, dst); err != nil {
+			return fmt.Errorf("failed to symlink package: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := copyFile(ctx, src, dst); err != nil {
+		return fmt.Errorf("failed to copy package: %w", err)
+	}
+
+	return nil
+}
+
+// isLinkUnsupported returns true if a hard link failed because it isn't
+// possible between the source and destination, eg. across filesystems, on
+// filesystems without hard link support, when prevented by
+// fs.protected_hardlinks, or when the source has too many links.
+func isLinkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EMLINK)
+}
+
+// copyFile copies the contents of src to dst, stopping early if the context
+// is cancelled.
+func copyFile(ctx context.Context, src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	fi, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dstFile, util.NewContextReader(ctx, srcFile)); err != nil {
+		_ = dstFile.Close()
+		return err
+	}
+
+	return dstFile.Close()
+}
+
+// IsUpToDate checks if the existing file at dst was placed using a compatible
+// mode and has the expected sha256sum. Files in the pool are immutable, so an
+// existing file with a different sha256sum is reported as an error rather
+// than being replaced (it may still be referenced by the published indices).
+func IsUpToDate(ctx context.Context, dst string, mode Mode, sha256 string) (bool, error) {
+	fi, err := os.Lstat(dst)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to stat pool file: %w", err)
+	}
+
+	isSymlink := fi.Mode()&os.ModeSymlink != 0
+	if !isSymlink && !fi.Mode().IsRegular() {
+		return false, fmt.Errorf("pool path is not a regular file: %s", dst)
+	}
+
+	existingSHA256, err := sha256sum.File(ctx, dst)
+	if err != nil {
+		// Most likely a dangling symlink.
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to hash pool file: %w", err)
+	}
+
+	if existingSHA256 != sha256 {
+		return false, fmt.Errorf("pool file %s already exists with a different sha256sum (package contents must not change without a new version)", dst)
+	}
+
+	// A file with the same contents may be replaced if it was placed using an
+	// incompatible mode.
+	return (mode == ModeSymlink) == isSymlink, nil
+}
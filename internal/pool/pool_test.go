@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package pool
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/sha256sum"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMode(t *testing.T) {
+	mode, err := ParseMode("")
+	require.NoError(t, err)
+	require.Equal(t, ModeCopy, mode)
+
+	mode, err = ParseMode("hardlink")
+	require.NoError(t, err)
+	require.Equal(t, ModeHardlink, mode)
+
+	_, err = ParseMode("hardlnk")
+	require.Error(t, err)
+}
+
+func TestPlace(t *testing.T) {
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "hello_1.0_amd64.deb")
+	require.NoError(t, os.WriteFile(src, []byte("hello"), 0o644))
+
+	sha256, err := sha256sum.File(ctx, src)
+	require.NoError(t, err)
+
+	t.Run("Copy", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "pool", "main", "h", "hello", "hello_1.0_amd64.deb")
+		require.NoError(t, Place(ctx, src, dst, ModeCopy, sha256))
+
+		require.False(t, sameFile(t, src, dst))
+
+		upToDate, err := IsUpToDate(ctx, dst, ModeCopy, sha256)
+		require.NoError(t, err)
+		require.True(t, upToDate)
+	})
+
+	t.Run("Hardlink", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "hello_1.0_amd64.deb")
+		require.NoError(t, Place(ctx, src, dst, ModeHardlink, sha256))
+
+		require.True(t, sameFile(t, src, dst))
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "hello_1.0_amd64.deb")
+		require.NoError(t, Place(ctx, src, dst, ModeSymlink, sha256))
+
+		target, err := os.Readlink(dst)
+		require.NoError(t, err)
+		require.Equal(t, src, target)
+
+		// A copy isn't compatible with a symlink, and vice versa.
+		upToDate, err := IsUpToDate(ctx, dst, ModeCopy, sha256)
+		require.NoError(t, err)
+		require.False(t, upToDate)
+
+		require.NoError(t, Place(ctx, src, dst, ModeCopy, sha256))
+
+		fi, err := os.Lstat(dst)
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "hello_1.0_amd64.deb")
+		require.NoError(t, os.WriteFile(dst, []byte("stale"), 0o644))
+
+		_, err := IsUpToDate(ctx, dst, ModeCopy, sha256)
+		require.ErrorContains(t, err, "different sha256sum")
+
+		require.Error(t, Place(ctx, src, dst, ModeCopy, sha256))
+
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, "stale", string(data))
+	})
+
+	t.Run("Dangling Symlink", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "hello_1.0_amd64.deb")
+		require.NoError(t, os.Symlink(filepath.Join(t.TempDir(), "missing.deb"), dst))
+
+		require.NoError(t, Place(ctx, src, dst, ModeSymlink, sha256))
+
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+	})
+
+	t.Run("Hardlink Fallback", func(t *testing.T) {
+		for _, errno := range []syscall.Errno{syscall.EXDEV, syscall.EPERM, syscall.EMLINK} {
+			t.Run(errno.Error(), func(t *testing.T) {
+				setLink(t, func(oldname, newname string) error {
+					return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errno}
+				})
+
+				dst := filepath.Join(t.TempDir(), "hello_1.0_amd64.deb")
+				require.NoError(t, Place(ctx, src, dst, ModeHardlink, sha256))
+
+				require.False(t, sameFile(t, src, dst))
+
+				data, err := os.ReadFile(dst)
+				require.NoError(t, err)
+				require.Equal(t, "hello", string(data))
+			})
+		}
+	})
+
+	t.Run("Hardlink Error", func(t *testing.T) {
+		setLink(t, func(oldname, newname string) error {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EIO}
+		})
+
+		dst := filepath.Join(t.TempDir(), "hello_1.0_amd64.deb")
+		require.Error(t, Place(ctx, src, dst, ModeHardlink, sha256))
+
+		_, err := os.Stat(dst)
+		require.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "hello_1.0_amd64.deb")
+	require.NoError(t, os.WriteFile(src, []byte("hello"), 0o644))
+
+	sha256, err := sha256sum.File(ctx, src)
+	require.NoError(t, err)
+
+	setup := func(t *testing.T) (string, string) {
+		dir := t.TempDir()
+
+		existing := filepath.Join(dir, "existing.deb")
+		require.NoError(t, Place(ctx, src, existing, ModeCopy, sha256))
+
+		return existing, filepath.Join(dir, "new.deb")
+	}
+
+	t.Run("Abort", func(t *testing.T) {
+		existing, created := setup(t)
+
+		tx := NewTransaction()
+		require.NoError(t, tx.Place(ctx, src, existing, ModeSymlink, sha256))
+		require.NoError(t, tx.Place(ctx, src, created, ModeSymlink, sha256))
+
+		require.NoError(t, tx.Abort())
+
+		fi, err := os.Lstat(existing)
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+
+		_, err = os.Lstat(created)
+		require.True(t, os.IsNotExist(err))
+
+		entries, err := os.ReadDir(filepath.Dir(existing))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		existing, created := setup(t)
+
+		tx := NewTransaction()
+		require.NoError(t, tx.Place(ctx, src, existing, ModeSymlink, sha256))
+		require.NoError(t, tx.Place(ctx, src, created, ModeSymlink, sha256))
+
+		require.NoError(t, tx.Commit())
+
+		for _, path := range []string{existing, created} {
+			upToDate, err := IsUpToDate(ctx, path, ModeSymlink, sha256)
+			require.NoError(t, err)
+			require.True(t, upToDate)
+		}
+
+		entries, err := os.ReadDir(filepath.Dir(existing))
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+	})
+}
+
+func setLink(t *testing.T, fn func(oldname, newname string) error) {
+	t.Helper()
+
+	link = fn
+	t.Cleanup(func() { link = os.Link })
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+
+	aInfo, err := os.Stat(a)
+	require.NoError(t, err)
+
+	bInfo, err := os.Stat(b)
+	require.NoError(t, err)
+
+	return os.SameFile(aInfo, bInfo)
+}
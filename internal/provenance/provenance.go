@@ -0,0 +1,312 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package provenance records where each package in a repository came from.
+package provenance
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const (
+	// ManifestName is the name of the provenance manifest, it is published in
+	// the dists directory alongside the releases.
+	ManifestName = "provenance.json"
+	// AttestationsName is the name of the file containing the signed
+	// attestations (one DSSE envelope per line).
+	AttestationsName = "provenance.intoto.jsonl"
+)
+
+// formatVersion is the current version of the manifest format.
+const formatVersion = 1
+
+// Options configures the provenance recorded for newly ingested packages.
+type Options struct {
+	// AptifyVersion is the version of aptify performing the build.
+	AptifyVersion string
+	// Metadata is additional metadata (eg. CI build identifiers) to record.
+	Metadata map[string]string
+	// Attestations also publishes signed in-toto attestations.
+	Attestations bool
+}
+
+// Manifest is the provenance of every package within the pool.
+type Manifest struct {
+	// Version is the version of the manifest format.
+	Version int `json:"version"`
+	// Packages is the list of packages, sorted by filename.
+	Packages []Entry `json:"packages"`
+}
+
+// Entry is the provenance of a single package.
+type Entry struct {
+	// Filename is the path of the package within the pool.
+	Filename string `json:"filename"`
+	// SHA256 is the sha256sum of the deb file.
+	SHA256 string `json:"sha256"`
+	// Name is the name of the package.
+	Name string `json:"name"`
+	// Version is the version of the package.
+	Version string `json:"version"`
+	// Architecture is the architecture of the package.
+	Architecture string `json:"architecture"`
+	// Source is the path (or URL) the deb file was obtained from.
+	Source string `json:"source"`
+	// Pattern is the glob pattern (or URL) that matched the deb file.
+	Pattern string `json:"pattern,omitempty"`
+	// IngestedAt is when the deb file was first added to the repository.
+	IngestedAt time.Time `json:"ingestedAt"`
+	// AptifyVersion is the version of aptify that ingested the deb file.
+	AptifyVersion string `json:"aptifyVersion"`
+	// Metadata is any additional metadata recorded when the deb file was
+	// ingested (eg. CI build identifiers).
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// NewManifest creates a manifest from the given entries. Entries for deb files
+// that were already present in the previous manifest (which may be nil) keep
+// their original provenance, and deb files that were previously published
+// under a different filename keep their original ingestion time.
+func NewManifest(entries []Entry, previous *Manifest) *Manifest {
+	previousEntries := make(map[string]Entry)
+	if previous != nil {
+		for _, entry := range previous.Packages {
+			previousEntries[entry.Filename] = entry
+		}
+	}
+
+	ingestionTimes := previous.IngestionTimes()
+
+	m := &Manifest{Version: formatVersion}
+	for _, entry := range entries {
+		if previousEntry, ok := previousEntries[entry.Filename]; ok && previousEntry.SHA256 == entry.SHA256 {
+			entry = previousEntry
+		} else if ingestedAt, ok := ingestionTimes[entry.SHA256]; ok {
+			entry.IngestedAt = ingestedAt
+		}
+
+		m.Packages = append(m.Packages, entry)
+	}
+
+	sort.Slice(m.Packages, func(i, j int) bool {
+		return m.Packages[i].Filename < m.Packages[j].Filename
+	})
+
+	return m
+}
+
+// IngestionTimes returns when each deb file (keyed by sha256sum) was first
+// added to the repository. It is safe to call on a nil manifest.
+func (m *Manifest) IngestionTimes() map[string]time.Time {
+	times := make(map[string]time.Time)
+	if m == nil {
+		return times
+	}
+
+	for _, entry := range m.Packages {
+		if ingestedAt, ok := times[entry.SHA256]; !ok || entry.IngestedAt.Before(ingestedAt) {
+			times[entry.SHA256] = entry.IngestedAt
+		}
+	}
+
+	return times
+}
+
+// Read reads a manifest, returning nil if it doesn't exist.
+func Read(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read provenance manifest: %w", err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode provenance manifest %s: %w", path, err)
+	}
+
+	if m.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported provenance manifest version: %d", m.Version)
+	}
+
+	return &m, nil
+}
+
+// Marshal returns the encoded manifest, as written by WriteFile.
+func (m *Manifest) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode provenance manifest: %w", err)
+	}
+
+	return append(data, '\n'), nil
+}
+
+// WriteFile writes the manifest to path.
+func (m *Manifest) WriteFile(path string) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write provenance manifest: %w", err)
+	}
+
+	return nil
+}
+
+// The in-toto statement, and SLSA provenance predicate, types.
+const (
+	statementType   = "https://in-toto.io/Statement/v1"
+	predicateType   = "https://slsa.dev/provenance/v1"
+	payloadType     = "application/vnd.in-toto+json"
+	buildType       = "https://github.com/dpeckett/aptify/ingest/v1"
+	builderID       = "https://github.com/dpeckett/aptify"
+	dssePAEPrefix   = "DSSEv1"
+	digestAlgorithm = "sha256"
+)
+
+type statement struct {
+	Type          string               `json:"_type"`
+	Subject       []resourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     predicate            `json:"predicate"`
+}
+
+type resourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+type predicate struct {
+	BuildDefinition buildDefinition `json:"buildDefinition"`
+	RunDetails      runDetails      `json:"runDetails"`
+}
+
+type buildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   map[string]string    `json:"externalParameters"`
+	InternalParameters   map[string]string    `json:"internalParameters,omitempty"`
+	ResolvedDependencies []resourceDescriptor `json:"resolvedDependencies"`
+}
+
+type runDetails struct {
+	Builder  builder     `json:"builder"`
+	Metadata runMetadata `json:"metadata"`
+}
+
+type builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type runMetadata struct {
+	StartedOn time.Time `json:"startedOn"`
+}
+
+// envelope is a DSSE envelope (https://github.com/secure-systems-lab/dsse).
+type envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     []byte      `json:"payload"`
+	Signatures  []signature `json:"signatures"`
+}
+
+type signature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// Attestations returns a signed in-toto attestation (with a SLSA provenance
+// predicate) for every package in the manifest, as a JSON lines file of DSSE
+// envelopes.
+func (m *Manifest) Attestations(privateKey *openpgp.Entity) ([]byte, error) {
+	keyID := fmt.Sprintf("%X", privateKey.PrimaryKey.Fingerprint)
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range m.Packages {
+		payload, err := json.Marshal(statementForEntry(entry))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode attestation for %s: %w", entry.Filename, err)
+		}
+
+		var sig bytes.Buffer
+		if err := openpgp.DetachSign(&sig, privateKey, bytes.NewReader(pae(payloadType, payload)), nil); err != nil {
+			return nil, fmt.Errorf("failed to sign attestation for %s: %w", entry.Filename, err)
+		}
+
+		if err := enc.Encode(envelope{
+			PayloadType: payloadType,
+			Payload:     payload,
+			Signatures:  []signature{{KeyID: keyID, Sig: sig.Bytes()}},
+		}); err != nil {
+			return nil, fmt.Errorf("failed to encode attestation for %s: %w", entry.Filename, err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func statementForEntry(entry Entry) statement {
+	digest := map[string]string{digestAlgorithm: entry.SHA256}
+
+	externalParameters := map[string]string{"source": entry.Source}
+	if entry.Pattern != "" {
+		externalParameters["pattern"] = entry.Pattern
+	}
+
+	return statement{
+		Type:          statementType,
+		Subject:       []resourceDescriptor{{Name: entry.Filename, Digest: digest}},
+		PredicateType: predicateType,
+		Predicate: predicate{
+			BuildDefinition: buildDefinition{
+				BuildType:            buildType,
+				ExternalParameters:   externalParameters,
+				InternalParameters:   entry.Metadata,
+				ResolvedDependencies: []resourceDescriptor{{URI: entry.Source, Digest: digest}},
+			},
+			RunDetails: runDetails{
+				Builder: builder{
+					ID:      builderID,
+					Version: map[string]string{"aptify": entry.AptifyVersion},
+				},
+				Metadata: runMetadata{StartedOn: entry.IngestedAt},
+			},
+		},
+	}
+}
+
+// pae is the DSSE pre-authentication encoding of a payload, this is what is
+// actually signed.
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("%s %d %s %d %s", dssePAEPrefix, len(payloadType), payloadType, len(payload), payload))
+}
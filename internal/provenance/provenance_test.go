@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package provenance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	firstDate  = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	secondDate = firstDate.Add(24 * time.Hour)
+)
+
+func TestNewManifest(t *testing.T) {
+	previous := NewManifest([]Entry{
+		{Filename: "pool/main/h/hello/hello_1.0_amd64.deb", SHA256: "aaaa", Source: "debs/hello_1.0_amd64.deb", IngestedAt: firstDate, AptifyVersion: "v1"},
+		{Filename: "pool/main/w/world/world_1.0_all.deb", SHA256: "bbbb", Source: "debs/world_1.0_all.deb", IngestedAt: firstDate, AptifyVersion: "v1"},
+	}, nil)
+
+	m := NewManifest([]Entry{
+		// Unchanged, keeps its original provenance.
+		{Filename: "pool/main/h/hello/hello_1.0_amd64.deb", SHA256: "aaaa", Source: "elsewhere/hello_1.0_amd64.deb", IngestedAt: secondDate, AptifyVersion: "v2"},
+		// Moved to another component, keeps its original ingestion time.
+		{Filename: "pool/contrib/w/world/world_1.0_all.deb", SHA256: "bbbb", Source: "debs/world_1.0_all.deb", IngestedAt: secondDate, AptifyVersion: "v2"},
+		// Rebuilt, so it is a new package.
+		{Filename: "pool/main/w/world/world_1.0_all.deb", SHA256: "cccc", Source: "debs/world_1.0_all.deb", IngestedAt: secondDate, AptifyVersion: "v2"},
+	}, previous)
+
+	require.Equal(t, formatVersion, m.Version)
+	require.Equal(t, []Entry{
+		{Filename: "pool/contrib/w/world/world_1.0_all.deb", SHA256: "bbbb", Source: "debs/world_1.0_all.deb", IngestedAt: firstDate, AptifyVersion: "v2"},
+		{Filename: "pool/main/h/hello/hello_1.0_amd64.deb", SHA256: "aaaa", Source: "debs/hello_1.0_amd64.deb", IngestedAt: firstDate, AptifyVersion: "v1"},
+		{Filename: "pool/main/w/world/world_1.0_all.deb", SHA256: "cccc", Source: "debs/world_1.0_all.deb", IngestedAt: secondDate, AptifyVersion: "v2"},
+	}, m.Packages)
+}
+
+func TestIngestionTimes(t *testing.T) {
+	var m *Manifest
+	require.Empty(t, m.IngestionTimes())
+
+	m = NewManifest([]Entry{
+		{Filename: "pool/main/h/hello/hello_1.0_amd64.deb", SHA256: "aaaa", IngestedAt: secondDate},
+		{Filename: "pool/contrib/h/hello/hello_1.0_amd64.deb", SHA256: "aaaa", IngestedAt: firstDate},
+		{Filename: "pool/main/w/world/world_1.0_all.deb", SHA256: "bbbb", IngestedAt: secondDate},
+	}, nil)
+
+	require.Equal(t, map[string]time.Time{
+		"aaaa": firstDate,
+		"bbbb": secondDate,
+	}, m.IngestionTimes())
+}
+
+func TestReadWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ManifestName)
+
+	t.Run("Missing", func(t *testing.T) {
+		m, err := Read(path)
+		require.NoError(t, err)
+		require.Nil(t, m)
+	})
+
+	t.Run("Round Trip", func(t *testing.T) {
+		m := NewManifest([]Entry{{
+			Filename:      "pool/main/h/hello/hello_1.0_amd64.deb",
+			SHA256:        "aaaa",
+			Name:          "hello",
+			Version:       "1.0",
+			Architecture:  "amd64",
+			Source:        "debs/hello_1.0_amd64.deb",
+			Pattern:       "debs/*.deb",
+			IngestedAt:    firstDate,
+			AptifyVersion: "v1",
+			Metadata:      map[string]string{"CI_JOB_ID": "42"},
+		}}, nil)
+
+		require.NoError(t, m.WriteFile(path))
+
+		read, err := Read(path)
+		require.NoError(t, err)
+		require.Equal(t, m, read)
+
+		data, err := m.Marshal()
+		require.NoError(t, err)
+
+		written, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, data, written)
+	})
+
+	t.Run("Unsupported Version", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte(`{"version": 2, "packages": []}`), 0o644))
+
+		_, err := Read(path)
+		require.ErrorContains(t, err, "unsupported provenance manifest version: 2")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("{"), 0o644))
+
+		_, err := Read(path)
+		require.ErrorContains(t, err, "failed to decode provenance manifest")
+	})
+}
+
+func TestAttestations(t *testing.T) {
+	privateKey, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	require.NoError(t, err)
+
+	m := NewManifest([]Entry{
+		{Filename: "pool/main/h/hello/hello_1.0_amd64.deb", SHA256: "aaaa", Source: "debs/hello_1.0_amd64.deb", Pattern: "debs/*.deb", IngestedAt: firstDate, AptifyVersion: "v1"},
+		{Filename: "pool/main/w/world/world_1.0_all.deb", SHA256: "bbbb", Source: "https://example.com/world_1.0_all.deb", IngestedAt: firstDate, AptifyVersion: "v1"},
+	}, nil)
+
+	attestations, err := m.Attestations(privateKey)
+	require.NoError(t, err)
+
+	var envelopes []envelope
+	scanner := bufio.NewScanner(bytes.NewReader(attestations))
+	for scanner.Scan() {
+		var env envelope
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &env))
+		envelopes = append(envelopes, env)
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, envelopes, 2)
+
+	for i, env := range envelopes {
+		entry := m.Packages[i]
+
+		require.Equal(t, payloadType, env.PayloadType)
+		require.Len(t, env.Signatures, 1)
+		require.Equal(t, fmt.Sprintf("%X", privateKey.PrimaryKey.Fingerprint), env.Signatures[0].KeyID)
+
+		// The signature covers the pre-authentication encoding of the payload.
+		keyring := openpgp.EntityList{privateKey}
+		_, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(pae(env.PayloadType, env.Payload)), bytes.NewReader(env.Signatures[0].Sig), nil)
+		require.NoError(t, err)
+
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(env.Payload), bytes.NewReader(env.Signatures[0].Sig), nil)
+		require.Error(t, err)
+
+		var stmt statement
+		require.NoError(t, json.Unmarshal(env.Payload, &stmt))
+
+		require.Equal(t, statementType, stmt.Type)
+		require.Equal(t, predicateType, stmt.PredicateType)
+		require.Equal(t, []resourceDescriptor{{Name: entry.Filename, Digest: map[string]string{"sha256": entry.SHA256}}}, stmt.Subject)
+		require.Equal(t, entry.Source, stmt.Predicate.BuildDefinition.ExternalParameters["source"])
+		require.Equal(t, entry.Pattern, stmt.Predicate.BuildDefinition.ExternalParameters["pattern"])
+		require.Equal(t, entry.IngestedAt, stmt.Predicate.RunDetails.Metadata.StartedOn)
+	}
+}
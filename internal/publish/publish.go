@@ -0,0 +1,413 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package publish
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// StateDirName is the name of the directory (within the repository) used to
+	// store aptify's internal state.
+	StateDirName = ".aptify"
+	// DefaultKeepGenerations is the default number of published generations to
+	// keep (the current generation and the one before it).
+	DefaultKeepGenerations = 2
+)
+
+// Generation ids are timestamps, so that they sort chronologically.
+const generationIDFormat = "20060102T150405.000000000Z"
+
+// Staging is an in-progress generation of the repository's dists directory.
+// The live dists directory is a symlink to the current generation, publishing
+// a staged generation atomically flips the symlink.
+type Staging struct {
+	repoDir string
+	id      string
+	dir     string
+}
+
+// Stage creates a new staging directory for the repository.
+func Stage(repoDir string) (*Staging, error) {
+	id := time.Now().UTC().Format(generationIDFormat)
+
+	dir := filepath.Join(repoDir, StateDirName, "staging", id)
+	if err := os.MkdirAll(filepath.Join(dir, "dists"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	return &Staging{
+		repoDir: repoDir,
+		id:      id,
+		dir:     dir,
+	}, nil
+}
+
+// DistsDir returns the staged dists directory.
+func (s *Staging) DistsDir() string {
+	return filepath.Join(s.dir, "dists")
+}
+
+// Abort discards the staged generation.
+func (s *Staging) Abort() error {
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("failed to remove staging directory: %w", err)
+	}
+
+	return nil
+}
+
+// Commit atomically publishes the staged generation and prunes old
+// generations (see Prune).
+func (s *Staging) Commit(keep int, grace time.Duration) error {
+	generationsDir := filepath.Join(s.repoDir, StateDirName, "generations")
+	if err := os.MkdirAll(generationsDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create generations directory: %w", err)
+	}
+
+	if err := migrateLegacyDists(s.repoDir); err != nil {
+		return err
+	}
+
+	if err := os.Rename(s.dir, filepath.Join(generationsDir, s.id)); err != nil {
+		return fmt.Errorf("failed to move staged generation: %w", err)
+	}
+
+	slog.Info("Publishing generation", slog.String("id", s.id))
+
+	if err := switchGeneration(s.repoDir, s.id); err != nil {
+		return err
+	}
+
+	_, err := Prune(s.repoDir, keep, grace, false)
+	return err
+}
+
+// GenerationTime returns the time a generation was published.
+func GenerationTime(id string) (time.Time, error) {
+	t, err := time.Parse(generationIDFormat, id)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse generation id %q: %w", id, err)
+	}
+
+	return t, nil
+}
+
+// Generations returns the ids of all published generations, oldest first.
+func Generations(repoDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(repoDir, StateDirName, "generations"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read generations directory: %w", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// CurrentGeneration returns the id of the currently published generation (or
+// an empty string if the repository has not been published yet).
+func CurrentGeneration(repoDir string) (string, error) {
+	target, err := os.Readlink(filepath.Join(repoDir, "dists"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("failed to read dists symlink: %w", err)
+	}
+
+	return filepath.Base(filepath.Dir(target)), nil
+}
+
+// Rollback republishes the generation preceding the current generation, and
+// discards the current generation.
+func Rollback(repoDir string) (string, error) {
+	current, err := CurrentGeneration(repoDir)
+	if err != nil {
+		return "", err
+	}
+
+	ids, err := Generations(repoDir)
+	if err != nil {
+		return "", err
+	}
+
+	idx := sort.SearchStrings(ids, current)
+	if current == "" || idx >= len(ids) || ids[idx] != current {
+		return "", fmt.Errorf("current generation not found")
+	}
+	if idx == 0 {
+		return "", fmt.Errorf("no previous generation to roll back to")
+	}
+
+	previous := ids[idx-1]
+
+	slog.Info("Rolling back generation",
+		slog.String("from", current), slog.String("to", previous))
+
+	if err := switchGeneration(repoDir, previous); err != nil {
+		return "", err
+	}
+
+	if err := os.RemoveAll(filepath.Join(repoDir, StateDirName, "generations", current)); err != nil {
+		return "", fmt.Errorf("failed to remove generation: %w", err)
+	}
+
+	return previous, nil
+}
+
+// switchGeneration atomically points the dists symlink at the given generation.
+func switchGeneration(repoDir, id string) error {
+	tempLink := filepath.Join(repoDir, ".dists.tmp")
+	_ = os.Remove(tempLink)
+
+	target := filepath.Join(StateDirName, "generations", id, "dists")
+	if err := os.Symlink(target, tempLink); err != nil {
+		return fmt.Errorf("failed to create dists symlink: %w", err)
+	}
+
+	if err := os.Rename(tempLink, filepath.Join(repoDir, "dists")); err != nil {
+		_ = os.Remove(tempLink)
+		return fmt.Errorf("failed to replace dists symlink: %w", err)
+	}
+
+	return nil
+}
+
+// migrateLegacyDists converts a dists directory written by an older version of
+// aptify into a generation, so that it can be replaced by a symlink. The
+// directory is copied into the generation first, so that it remains available
+// to clients until the symlink replaces it.
+func migrateLegacyDists(repoDir string) error {
+	distsDir := filepath.Join(repoDir, "dists")
+
+	fi, err := os.Lstat(distsDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to stat dists directory: %w", err)
+	}
+
+	if !fi.IsDir() {
+		return nil
+	}
+
+	id := fi.ModTime().UTC().Format(generationIDFormat)
+
+	slog.Info("Migrating existing dists directory to a generation", slog.String("id", id))
+
+	generationDir := filepath.Join(repoDir, StateDirName, "generations", id)
+	_ = os.RemoveAll(generationDir)
+
+	if err := copyDir(distsDir, filepath.Join(generationDir, "dists")); err != nil {
+		_ = os.RemoveAll(generationDir)
+		return fmt.Errorf("failed to copy dists directory: %w", err)
+	}
+
+	tempLink := filepath.Join(repoDir, ".dists.tmp")
+	_ = os.RemoveAll(tempLink)
+
+	target := filepath.Join(StateDirName, "generations", id, "dists")
+	if err := os.Symlink(target, tempLink); err != nil {
+		return fmt.Errorf("failed to create dists symlink: %w", err)
+	}
+
+	if err := replaceWithSymlink(tempLink, distsDir); err != nil {
+		_ = os.Remove(tempLink)
+		return err
+	}
+
+	return nil
+}
+
+// renameOverDir replaces the directory at dir with the file at path. This
+// takes two renames, so dir is briefly missing.
+func renameOverDir(path, dir string) error {
+	oldDir := filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".old")
+	_ = os.RemoveAll(oldDir)
+
+	if err := os.Rename(dir, oldDir); err != nil {
+		return fmt.Errorf("failed to move directory: %w", err)
+	}
+
+	if err := os.Rename(path, dir); err != nil {
+		_ = os.Rename(oldDir, dir)
+		return fmt.Errorf("failed to replace directory: %w", err)
+	}
+
+	if err := os.RemoveAll(oldDir); err != nil {
+		return fmt.Errorf("failed to remove old directory: %w", err)
+	}
+
+	return nil
+}
+
+// copyDir recursively copies the directory at src to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, relPath)
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dstPath, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			return os.Symlink(target, dstPath)
+		default:
+			return copyFile(path, dstPath, fi.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		_ = dstFile.Close()
+		return err
+	}
+
+	return dstFile.Close()
+}
+
+// Prune removes old generations. The current generation, and the keep most
+// recent generations, are always kept. Older generations are only removed once
+// they have been superseded for at least the grace period.
+func Prune(repoDir string, keep int, grace time.Duration, dryRun bool) ([]string, error) {
+	current, err := CurrentGeneration(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := Generations(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	keep = max(keep, 1)
+	if len(ids) <= keep {
+		return nil, nil
+	}
+
+	var removed []string
+	for i, id := range ids[:len(ids)-keep] {
+		if id == current {
+			continue
+		}
+
+		// A generation is superseded when the next generation is published.
+		supersededAt, err := GenerationTime(ids[i+1])
+		if err != nil {
+			return nil, err
+		}
+
+		if time.Since(supersededAt) < grace {
+			continue
+		}
+
+		if dryRun {
+			slog.Info("Would remove old generation", slog.String("id", id))
+		} else {
+			slog.Debug("Removing old generation", slog.String("id", id))
+
+			if err := os.RemoveAll(filepath.Join(repoDir, StateDirName, "generations", id)); err != nil {
+				return nil, fmt.Errorf("failed to remove generation: %w", err)
+			}
+		}
+
+		removed = append(removed, id)
+	}
+
+	return removed, nil
+}
+
+// StagingDirs returns the paths of any staging directories left behind by
+// builds, along with the time the staging directory was created.
+func StagingDirs(repoDir string) (map[string]time.Time, error) {
+	stagingDir := filepath.Join(repoDir, StateDirName, "staging")
+
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read staging directory: %w", err)
+	}
+
+	dirs := make(map[string]time.Time)
+	for _, entry := range entries {
+		createdAt, err := time.Parse(generationIDFormat, entry.Name())
+		if err != nil {
+			continue
+		}
+
+		dirs[filepath.Join(stagingDir, entry.Name())] = createdAt
+	}
+
+	return dirs, nil
+}
@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package publish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	repoDir := t.TempDir()
+
+	first := publishGeneration(t, repoDir, "first")
+	requireDists(t, repoDir, "first")
+
+	second := publishGeneration(t, repoDir, "second")
+	requireDists(t, repoDir, "second")
+
+	current, err := CurrentGeneration(repoDir)
+	require.NoError(t, err)
+	require.Equal(t, second, current)
+
+	ids, err := Generations(repoDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{first, second}, ids)
+
+	t.Run("Prune", func(t *testing.T) {
+		third := publishGeneration(t, repoDir, "third")
+
+		ids, err := Generations(repoDir)
+		require.NoError(t, err)
+		require.Equal(t, []string{second, third}, ids)
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		previous, err := Rollback(repoDir)
+		require.NoError(t, err)
+		require.Equal(t, second, previous)
+
+		requireDists(t, repoDir, "second")
+
+		_, err = Rollback(repoDir)
+		require.Error(t, err)
+	})
+}
+
+func TestPrune(t *testing.T) {
+	repoDir := t.TempDir()
+
+	var ids []string
+	for _, content := range []string{"first", "second", "third"} {
+		staging, err := Stage(repoDir)
+		require.NoError(t, err)
+
+		writeFile(t, filepath.Join(staging.DistsDir(), "bookworm", "Release"), content)
+
+		// Keep every generation, so that they can be pruned explicitly.
+		require.NoError(t, staging.Commit(10, 0))
+		ids = append(ids, staging.id)
+	}
+
+	t.Run("Grace Period", func(t *testing.T) {
+		removed, err := Prune(repoDir, 1, time.Hour, false)
+		require.NoError(t, err)
+		require.Empty(t, removed)
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		removed, err := Prune(repoDir, 1, 0, true)
+		require.NoError(t, err)
+		require.Equal(t, ids[:2], removed)
+
+		remaining, err := Generations(repoDir)
+		require.NoError(t, err)
+		require.Equal(t, ids, remaining)
+	})
+
+	removed, err := Prune(repoDir, 1, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, ids[:2], removed)
+
+	remaining, err := Generations(repoDir)
+	require.NoError(t, err)
+	require.Equal(t, ids[2:], remaining)
+
+	requireDists(t, repoDir, "third")
+}
+
+func TestAbort(t *testing.T) {
+	repoDir := t.TempDir()
+
+	staging, err := Stage(repoDir)
+	require.NoError(t, err)
+
+	dirs, err := StagingDirs(repoDir)
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+
+	require.NoError(t, staging.Abort())
+
+	dirs, err = StagingDirs(repoDir)
+	require.NoError(t, err)
+	require.Empty(t, dirs)
+
+	current, err := CurrentGeneration(repoDir)
+	require.NoError(t, err)
+	require.Empty(t, current)
+}
+
+func TestMigrateLegacyDists(t *testing.T) {
+	repoDir := t.TempDir()
+
+	writeFile(t, filepath.Join(repoDir, "dists", "bookworm", "Release"), "legacy")
+	require.NoError(t, os.Symlink("Release", filepath.Join(repoDir, "dists", "bookworm", "Release.link")))
+
+	require.NoError(t, migrateLegacyDists(repoDir))
+
+	fi, err := os.Lstat(filepath.Join(repoDir, "dists"))
+	require.NoError(t, err)
+	require.NotZero(t, fi.Mode()&os.ModeSymlink)
+
+	data, err := os.ReadFile(filepath.Join(repoDir, "dists", "bookworm", "Release.link"))
+	require.NoError(t, err)
+	require.Equal(t, "legacy", string(data))
+
+	ids, err := Generations(repoDir)
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	current, err := CurrentGeneration(repoDir)
+	require.NoError(t, err)
+	require.Equal(t, ids[0], current)
+
+	// Nothing is left behind in the repository directory.
+	entries, err := os.ReadDir(repoDir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.ElementsMatch(t, []string{StateDirName, "dists"}, names)
+
+	// Publishing a new generation keeps the migrated one.
+	publishGeneration(t, repoDir, "new")
+	requireDists(t, repoDir, "new")
+
+	ids, err = Generations(repoDir)
+	require.NoError(t, err)
+	require.Len(t, ids, 2)
+}
+
+func publishGeneration(t *testing.T, repoDir, content string) string {
+	t.Helper()
+
+	staging, err := Stage(repoDir)
+	require.NoError(t, err)
+
+	writeFile(t, filepath.Join(staging.DistsDir(), "bookworm", "Release"), content)
+
+	require.NoError(t, staging.Commit(DefaultKeepGenerations, 0))
+
+	return staging.id
+}
+
+func requireDists(t *testing.T, repoDir, content string) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(repoDir, "dists", "bookworm", "Release"))
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestRenameOverDir(t *testing.T) {
+	repoDir := t.TempDir()
+
+	writeFile(t, filepath.Join(repoDir, "generation", "bookworm", "Release"), "new")
+	writeFile(t, filepath.Join(repoDir, "dists", "bookworm", "Release"), "old")
+
+	tempLink := filepath.Join(repoDir, ".dists.tmp")
+	require.NoError(t, os.Symlink("generation", tempLink))
+
+	require.NoError(t, renameOverDir(tempLink, filepath.Join(repoDir, "dists")))
+
+	requireDists(t, repoDir, "new")
+
+	_, err := os.Lstat(filepath.Join(repoDir, ".dists.old"))
+	require.True(t, os.IsNotExist(err))
+}
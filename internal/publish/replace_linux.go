@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package publish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// replaceWithSymlink atomically replaces the directory at dir with the symlink
+// at tempLink, by exchanging the two and then removing the old directory.
+func replaceWithSymlink(tempLink, dir string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, tempLink, unix.AT_FDCWD, dir, unix.RENAME_EXCHANGE)
+	if err != nil {
+		// Not every filesystem (or kernel) supports exchanging paths.
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP) {
+			return renameOverDir(tempLink, dir)
+		}
+
+		return fmt.Errorf("failed to replace directory with symlink: %w", err)
+	}
+
+	// After the exchange, tempLink refers to the old directory.
+	if err := os.RemoveAll(tempLink); err != nil {
+		return fmt.Errorf("failed to remove old directory: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repolock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/publish"
+)
+
+// pollInterval is how often to retry acquiring a held lock.
+const pollInterval = 250 * time.Millisecond
+
+// Holder describes the process holding a repository lock.
+type Holder struct {
+	// PID is the process id of the holder.
+	PID int `json:"pid"`
+	// Hostname is the hostname of the machine the holder is running on.
+	Hostname string `json:"hostname"`
+	// AcquiredAt is when the lock was acquired.
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+// LockedError is returned when a repository lock could not be acquired
+// within the timeout.
+type LockedError struct {
+	// Path is the path to the lock file.
+	Path string
+	// Holder is the current holder of the lock (if known).
+	Holder *Holder
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("repository is locked by another process (%s)", e.Path)
+	}
+
+	return fmt.Sprintf("repository is locked by pid %d on host %s since %s (%s)",
+		e.Holder.PID, e.Holder.Hostname, e.Holder.AcquiredAt.Format(time.RFC3339), e.Path)
+}
+
+// Lock is an exclusive lock on a repository directory.
+type Lock struct {
+	f          *os.File
+	holderPath string
+}
+
+// Acquire takes an exclusive lock on the repository directory, waiting up to
+// timeout (or until the context is cancelled) for any other holder to release
+// it.
+func Acquire(ctx context.Context, repoDir string, timeout time.Duration) (*Lock, error) {
+	stateDir := filepath.Join(repoDir, publish.StateDirName)
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	path := filepath.Join(stateDir, "lock")
+	// The holder is recorded in a separate file, which is replaced atomically,
+	// as the lock file itself can't be replaced without breaking the lock.
+	holderPath := path + ".holder"
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for logged := false; ; logged = true {
+		err := tryLock(f)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, errWouldBlock) {
+			_ = f.Close()
+			return nil, fmt.Errorf("failed to acquire lock: %w", err)
+		}
+
+		if time.Now().After(deadline) {
+			_ = f.Close()
+			return nil, &LockedError{Path: path, Holder: readHolder(holderPath)}
+		}
+
+		if !logged {
+			slog.Info("Waiting for repository lock", slog.String("path", path))
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+
+	if err := writeHolder(holderPath); err != nil {
+		_ = unlock(f)
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &Lock{f: f, holderPath: holderPath}, nil
+}
+
+// Release releases the lock.
+func (l *Lock) Release() error {
+	if err := os.Remove(l.holderPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Debug("Failed to remove lock holder file", slog.Any("error", err))
+	}
+
+	if err := unlock(l.f); err != nil {
+		_ = l.f.Close()
+		return fmt.Errorf("failed to unlock repository: %w", err)
+	}
+
+	return l.f.Close()
+}
+
+// writeHolder records the current process as the holder of the lock. The
+// holder file is written under a temporary name and then renamed into place,
+// so that it is never observed in a partially written state.
+func writeHolder(path string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	holder, err := json.Marshal(&Holder{
+		PID:        os.Getpid(),
+		Hostname:   hostname,
+		AcquiredAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock holder: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".lock.holder-*")
+	if err != nil {
+		return fmt.Errorf("failed to create lock holder file: %w", err)
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+
+	if _, err := tempFile.Write(holder); err != nil {
+		return fmt.Errorf("failed to write lock holder file: %w", err)
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write lock holder file: %w", err)
+	}
+
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename lock holder file: %w", err)
+	}
+
+	return nil
+}
+
+// readHolder returns the holder of the lock, or nil if it is unknown (eg. the
+// holder hasn't been recorded yet).
+func readHolder(path string) *Holder {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var holder Holder
+	if err := json.Unmarshal(data, &holder); err != nil || holder.PID == 0 {
+		return nil
+	}
+
+	return &holder
+}
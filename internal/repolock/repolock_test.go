@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repolock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+
+	lock, err := Acquire(ctx, repoDir, time.Second)
+	require.NoError(t, err)
+
+	t.Run("Contended", func(t *testing.T) {
+		_, err := Acquire(ctx, repoDir, 0)
+
+		var lockedErr *LockedError
+		require.True(t, errors.As(err, &lockedErr))
+		require.NotNil(t, lockedErr.Holder)
+		require.Equal(t, os.Getpid(), lockedErr.Holder.PID)
+		require.Contains(t, lockedErr.Error(), "locked by pid")
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := Acquire(ctx, repoDir, time.Minute)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Wait For Release", func(t *testing.T) {
+		released := make(chan error, 1)
+		go func() {
+			time.Sleep(2 * pollInterval)
+			released <- lock.Release()
+		}()
+
+		lock, err := Acquire(ctx, repoDir, time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, <-released)
+		require.NoError(t, lock.Release())
+	})
+
+	// The holder is forgotten once the lock is released.
+	_, err = os.Stat(filepath.Join(repoDir, ".aptify", "lock.holder"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestReadHolder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lock.holder")
+
+	require.Nil(t, readHolder(path))
+
+	// A partially written holder is treated as unknown.
+	for _, data := range []string{"", `{"pid":`, `{"hostname":"example"}`} {
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+		require.Nil(t, readHolder(path))
+	}
+
+	require.NoError(t, writeHolder(path))
+
+	holder := readHolder(path)
+	require.NotNil(t, holder)
+	require.Equal(t, os.Getpid(), holder.PID)
+	require.NotEmpty(t, holder.Hostname)
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	err = &LockedError{Path: path}
+	require.Contains(t, err.Error(), "locked by another process")
+}
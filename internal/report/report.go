@@ -0,0 +1,271 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Report describes the outcome of a build. A nil report is valid and discards
+// everything recorded, which makes reporting optional for callers.
+type Report struct {
+	mu sync.Mutex
+	// AptifyVersion is the version of aptify that performed the build.
+	AptifyVersion string `json:"aptifyVersion"`
+	// StartedAt is when the build started.
+	StartedAt time.Time `json:"startedAt"`
+	// FinishedAt is when the build finished.
+	FinishedAt time.Time `json:"finishedAt"`
+	// Releases is the list of releases that were built.
+	Releases []Release `json:"releases"`
+	// IndexFiles is the list of index files that were written.
+	IndexFiles []IndexFile `json:"indexFiles"`
+	// SigningKeyFingerprint is the fingerprint of the key used to sign releases.
+	SigningKeyFingerprint string `json:"signingKeyFingerprint,omitempty"`
+	// Timings is how long each stage of the build took.
+	Timings []Timing `json:"timings"`
+	// Warnings is the list of warnings logged during the build.
+	Warnings []string `json:"warnings"`
+	// Error is the error that caused the build to fail (if any).
+	Error string `json:"error,omitempty"`
+}
+
+// Release is a release within the report.
+type Release struct {
+	Name       string      `json:"name"`
+	Components []Component `json:"components"`
+}
+
+// Component is a component within the report.
+type Component struct {
+	Name          string         `json:"name"`
+	Architectures []Architecture `json:"architectures"`
+}
+
+// Architecture is the set of packages indexed for a single architecture.
+type Architecture struct {
+	Name         string    `json:"name"`
+	PackageCount int       `json:"packageCount"`
+	Packages     []Package `json:"packages"`
+}
+
+// Package is an indexed package.
+type Package struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	// Filename is the path of the package within the pool.
+	Filename string `json:"filename"`
+	SHA256   string `json:"sha256"`
+	// Source is the path (or URL) of the deb file the package was read from.
+	Source string `json:"source"`
+	// Pattern is the glob pattern that matched the deb file.
+	Pattern string `json:"pattern"`
+}
+
+// IndexFile is an index file that was written.
+type IndexFile struct {
+	// Path is the path of the file relative to the repository directory.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Timing is how long a stage of the build took.
+type Timing struct {
+	Stage   string  `json:"stage"`
+	Seconds float64 `json:"seconds"`
+}
+
+// New creates a new report.
+func New(version string) *Report {
+	return &Report{
+		AptifyVersion: version,
+		StartedAt:     time.Now().UTC(),
+		Releases:      []Release{},
+		IndexFiles:    []IndexFile{},
+		Timings:       []Timing{},
+		Warnings:      []string{},
+	}
+}
+
+// Stage starts timing a stage of the build, the returned function must be
+// called when the stage is complete.
+func (r *Report) Stage(name string) func() {
+	start := time.Now()
+
+	return func() {
+		if r == nil {
+			return
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.Timings = append(r.Timings, Timing{
+			Stage:   name,
+			Seconds: time.Since(start).Seconds(),
+		})
+	}
+}
+
+// AddArchitecture records the packages indexed for a release/component/arch.
+func (r *Report) AddArchitecture(releaseName, componentName, architecture string, packages []Package) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var release *Release
+	for i := range r.Releases {
+		if r.Releases[i].Name == releaseName {
+			release = &r.Releases[i]
+		}
+	}
+	if release == nil {
+		r.Releases = append(r.Releases, Release{Name: releaseName, Components: []Component{}})
+		release = &r.Releases[len(r.Releases)-1]
+	}
+
+	var component *Component
+	for i := range release.Components {
+		if release.Components[i].Name == componentName {
+			component = &release.Components[i]
+		}
+	}
+	if component == nil {
+		release.Components = append(release.Components, Component{Name: componentName, Architectures: []Architecture{}})
+		component = &release.Components[len(release.Components)-1]
+	}
+
+	component.Architectures = append(component.Architectures, Architecture{
+		Name:         architecture,
+		PackageCount: len(packages),
+		Packages:     packages,
+	})
+}
+
+// AddIndexFile records an index file that was written.
+func (r *Report) AddIndexFile(indexFile IndexFile) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.IndexFiles = append(r.IndexFiles, indexFile)
+}
+
+// SetSigningKeyFingerprint records the fingerprint of the signing key.
+func (r *Report) SetSigningKeyFingerprint(fingerprint string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.SigningKeyFingerprint = fingerprint
+}
+
+// WriteFile finishes the report and writes it as JSON to the given path.
+func (r *Report) WriteFile(path string, buildErr error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.FinishedAt = time.Now().UTC()
+	if buildErr != nil {
+		r.Error = buildErr.Error()
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	return nil
+}
+
+// WarningRecorder returns a slog handler that records any warnings (and
+// errors) in the report before passing them on to the next handler.
+func (r *Report) WarningRecorder(next slog.Handler) slog.Handler {
+	return &warningRecorder{next: next, report: r}
+}
+
+type warningRecorder struct {
+	next   slog.Handler
+	report *Report
+	attrs  []slog.Attr
+}
+
+func (h *warningRecorder) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.next.Enabled(ctx, level)
+}
+
+func (h *warningRecorder) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn {
+		msg := record.Message
+		for _, attr := range h.attrs {
+			msg += " " + attr.String()
+		}
+		record.Attrs(func(attr slog.Attr) bool {
+			msg += " " + attr.String()
+			return true
+		})
+
+		h.report.mu.Lock()
+		h.report.Warnings = append(h.report.Warnings, msg)
+		h.report.mu.Unlock()
+	}
+
+	if !h.next.Enabled(ctx, record.Level) {
+		return nil
+	}
+
+	return h.next.Handle(ctx, record)
+}
+
+func (h *warningRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &warningRecorder{
+		next:   h.next.WithAttrs(attrs),
+		report: h.report,
+		attrs:  append(append([]slog.Attr{}, h.attrs...), attrs...),
+	}
+}
+
+func (h *warningRecorder) WithGroup(name string) slog.Handler {
+	return &warningRecorder{
+		next:   h.next.WithGroup(name),
+		report: h.report,
+		attrs:  h.attrs,
+	}
+}
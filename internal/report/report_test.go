@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	t.Run("Nil", func(t *testing.T) {
+		var r *Report
+
+		r.Stage("pool")()
+		r.AddArchitecture("stable", "main", "amd64", nil)
+		r.AddIndexFile(IndexFile{Path: "dists/stable/InRelease"})
+		r.SetSigningKeyFingerprint("ABCD")
+	})
+
+	r := New("v1.0.0")
+
+	r.Stage("pool")()
+	r.AddArchitecture("stable", "main", "amd64", []Package{{Name: "hello", Version: "1.0", Architecture: "amd64"}})
+	r.AddArchitecture("stable", "main", "arm64", []Package{})
+	r.AddArchitecture("stable", "contrib", "amd64", []Package{})
+	r.AddArchitecture("testing", "main", "amd64", []Package{})
+	r.AddIndexFile(IndexFile{Path: "dists/stable/InRelease", Size: 1, SHA256: "abc"})
+	r.SetSigningKeyFingerprint("ABCD")
+
+	logger := slog.New(r.WarningRecorder(slog.NewTextHandler(io.Discard, nil))).With(slog.String("release", "stable"))
+	logger.Info("Ignored")
+	logger.Warn("Ignoring conflicting deb file", slog.String("package", "hello"))
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	require.NoError(t, r.WriteFile(path, errors.New("build failed")))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var written Report
+	require.NoError(t, json.Unmarshal(data, &written))
+
+	require.Equal(t, "v1.0.0", written.AptifyVersion)
+	require.Equal(t, "build failed", written.Error)
+	require.Equal(t, "ABCD", written.SigningKeyFingerprint)
+	require.False(t, written.FinishedAt.Before(written.StartedAt))
+
+	require.Len(t, written.Releases, 2)
+	require.Equal(t, "stable", written.Releases[0].Name)
+	require.Len(t, written.Releases[0].Components, 2)
+	require.Len(t, written.Releases[0].Components[0].Architectures, 2)
+	require.Equal(t, 1, written.Releases[0].Components[0].Architectures[0].PackageCount)
+
+	require.Equal(t, []IndexFile{{Path: "dists/stable/InRelease", Size: 1, SHA256: "abc"}}, written.IndexFiles)
+
+	require.Len(t, written.Timings, 1)
+	require.Equal(t, "pool", written.Timings[0].Stage)
+
+	require.Equal(t, []string{"Ignoring conflicting deb file release=stable package=hello"}, written.Warnings)
+}
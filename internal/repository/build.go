@@ -0,0 +1,299 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/dpeckett/aptify/internal/pool"
+	"github.com/dpeckett/aptify/internal/provenance"
+	"github.com/dpeckett/aptify/internal/publish"
+	"github.com/dpeckett/aptify/internal/report"
+	"github.com/dpeckett/aptify/internal/sha256sum"
+	"github.com/dpeckett/deb822/types/arch"
+)
+
+// BuildOptions configures how a repository is built.
+type BuildOptions struct {
+	// PrivateKey is the key used to sign releases.
+	PrivateKey *openpgp.Entity
+	// Date is the date to stamp releases with.
+	Date time.Time
+	// PoolMode is how package files are placed into the pool.
+	PoolMode pool.Mode
+	// KeepGenerations is the number of published generations to keep.
+	KeepGenerations int
+	// GracePeriod is how long to keep superseded generations.
+	GracePeriod time.Duration
+	// Report is an optional report to record the outcome of the build in.
+	Report *report.Report
+	// Provenance configures the provenance recorded for newly ingested
+	// packages.
+	Provenance provenance.Options
+}
+
+// Build populates the pool with the resolved packages, and then atomically
+// publishes a new generation of indices.
+func Build(ctx context.Context, repoDir string, resolved *Resolved, opts BuildOptions) error {
+	poolPaths := make([]string, 0, len(resolved.PoolFiles))
+	for poolPath := range resolved.PoolFiles {
+		poolPaths = append(poolPaths, poolPath)
+	}
+	sort.Strings(poolPaths)
+
+	// Place packages into the pool directory. If the build is aborted, any
+	// pool files it created (or replaced) are undone, so that the pool still
+	// matches the published generation.
+	tx := pool.NewTransaction()
+
+	var committed bool
+	defer func() {
+		if !committed {
+			if err := tx.Abort(); err != nil {
+				slog.Warn("Failed to undo changes to the pool", slog.Any("error", err))
+			}
+		}
+	}()
+
+	endStage := opts.Report.Stage("pool")
+	for _, poolPath := range poolPaths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		pkg := resolved.PoolFiles[poolPath]
+
+		if err := tx.Place(ctx, pkg.Path, filepath.Join(repoDir, poolPath), opts.PoolMode, pkg.SHA256); err != nil {
+			return fmt.Errorf("failed to place package in pool: %w", err)
+		}
+	}
+	endStage()
+
+	// Write the indices into a staging directory, so that clients never see a
+	// partially written set of indices.
+	staging, err := publish.Stage(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to stage repository: %w", err)
+	}
+
+	defer func() {
+		if !committed {
+			if err := staging.Abort(); err != nil {
+				slog.Warn("Failed to clean up staging directory", slog.Any("error", err))
+			}
+		}
+	}()
+
+	// Create package and contents indices.
+	endStage = opts.Report.Stage("indices")
+	architecturesForRelease := make([][]arch.Arch, len(resolved.Releases))
+	for i := range resolved.Releases {
+		release := &resolved.Releases[i]
+
+		indices, architectures, err := releaseIndices(ctx, release, resolved.cache, resolved.limits, resolved.compression, opts.Report)
+		if err != nil {
+			return err
+		}
+		architecturesForRelease[i] = architectures
+
+		releaseDir := filepath.Join(staging.DistsDir(), release.Config.Name)
+		if err := os.MkdirAll(releaseDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create release directory: %w", err)
+		}
+
+		if err := writeIndices(releaseDir, indices); err != nil {
+			return err
+		}
+	}
+	endStage()
+
+	// Create (signed) release files.
+	endStage = opts.Report.Stage("sign")
+	opts.Report.SetSigningKeyFingerprint(fmt.Sprintf("%X", opts.PrivateKey.PrimaryKey.Fingerprint))
+
+	for i := range resolved.Releases {
+		release := &resolved.Releases[i]
+
+		releaseDir := filepath.Join(staging.DistsDir(), release.Config.Name)
+		if err := writeReleaseFile(ctx, releaseDir, release, architecturesForRelease[i], opts.Date, opts.PrivateKey); err != nil {
+			return fmt.Errorf("failed to write release: %w", err)
+		}
+
+		if opts.Report != nil {
+			hashes, err := sha256sum.Directory(ctx, releaseDir)
+			if err != nil {
+				return fmt.Errorf("failed to hash release: %w", err)
+			}
+
+			for _, hash := range hashes {
+				opts.Report.AddIndexFile(report.IndexFile{
+					Path:   filepath.ToSlash(filepath.Join("dists", release.Config.Name, hash.Filename)),
+					Size:   hash.Size,
+					SHA256: hash.Hash,
+				})
+			}
+		}
+	}
+	endStage()
+
+	// Record where each package in the pool came from.
+	endStage = opts.Report.Stage("provenance")
+	if err := writeProvenance(repoDir, staging.DistsDir(), resolved, poolPaths, opts); err != nil {
+		return err
+	}
+	endStage()
+
+	endStage = opts.Report.Stage("publish")
+	defer endStage()
+
+	// Save a copy of the signing key.
+	var publicKey bytes.Buffer
+	publicKeyWriter, err := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	if err := opts.PrivateKey.Serialize(publicKeyWriter); err != nil {
+		return fmt.Errorf("failed to serialize public key: %w", err)
+	}
+
+	if err := publicKeyWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close public key writer: %w", err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(repoDir, "signing_key.asc"), publicKey.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write signing key: %w", err)
+	}
+
+	// Last chance to bail out, once the new generation has been published
+	// the build is complete.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Atomically publish the staged indices.
+	if err := staging.Commit(opts.KeepGenerations, opts.GracePeriod); err != nil {
+		return fmt.Errorf("failed to publish repository: %w", err)
+	}
+	committed = true
+
+	if err := tx.Commit(); err != nil {
+		slog.Warn("Failed to clean up pool", slog.Any("error", err))
+	}
+
+	return nil
+}
+
+// writeProvenance writes the provenance manifest (and optionally the signed
+// attestations) into the staged dists directory.
+func writeProvenance(repoDir, distsDir string, resolved *Resolved, poolPaths []string, opts BuildOptions) error {
+	manifest, err := provenanceManifest(repoDir, resolved, poolPaths, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := manifest.WriteFile(filepath.Join(distsDir, provenance.ManifestName)); err != nil {
+		return err
+	}
+
+	if !opts.Provenance.Attestations {
+		return nil
+	}
+
+	attestations, err := manifest.Attestations(opts.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to create attestations: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(distsDir, provenance.AttestationsName), attestations, 0o644); err != nil {
+		return fmt.Errorf("failed to write attestations: %w", err)
+	}
+
+	return nil
+}
+
+// provenanceManifest returns the provenance manifest of the pool. Packages
+// that were already present in the published repository keep their original
+// provenance, only newly ingested packages are stamped with the build date.
+func provenanceManifest(repoDir string, resolved *Resolved, poolPaths []string, opts BuildOptions) (*provenance.Manifest, error) {
+	previous, err := provenance.Read(filepath.Join(repoDir, "dists", provenance.ManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]provenance.Entry, 0, len(poolPaths))
+	for _, poolPath := range poolPaths {
+		pkg := resolved.PoolFiles[poolPath]
+
+		entries = append(entries, provenance.Entry{
+			Filename:      filepath.ToSlash(poolPath),
+			SHA256:        pkg.SHA256,
+			Name:          pkg.Name,
+			Version:       pkg.Version.String(),
+			Architecture:  pkg.Architecture.String(),
+			Source:        pkg.Location,
+			Pattern:       pkg.Pattern,
+			IngestedAt:    opts.Date.UTC(),
+			AptifyVersion: opts.Provenance.AptifyVersion,
+			Metadata:      opts.Provenance.Metadata,
+		})
+	}
+
+	return provenance.NewManifest(entries, previous), nil
+}
+
+func writeIndices(releaseDir string, indices map[string][]byte) error {
+	for name, data := range indices {
+		path := filepath.Join(releaseDir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("failed to create dists subdirectory: %w", err)
+		}
+
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and then renames it into place.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tempPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tempPath, data, perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
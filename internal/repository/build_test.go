@@ -0,0 +1,303 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/pool"
+	"github.com/dpeckett/aptify/internal/provenance"
+	"github.com/dpeckett/aptify/internal/publish"
+	"github.com/dpeckett/aptify/internal/sha256sum"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildReproducible(t *testing.T) {
+	debsDir := t.TempDir()
+	writeDeb(t, debsDir, "hello", "1.0", "amd64")
+	writeDeb(t, debsDir, "hello", "1.1", "amd64")
+	writeDeb(t, debsDir, "hello", "1.0", "arm64")
+	writeDeb(t, debsDir, "world", "2.0", "all")
+
+	conf := singleComponent(filepath.Join(debsDir, "*.deb"))
+	privateKey := newPrivateKey(t)
+
+	firstRepoDir, secondRepoDir := t.TempDir(), t.TempDir()
+	build(t, firstRepoDir, conf, privateKey)
+	build(t, secondRepoDir, conf, privateKey)
+
+	first := distsHashes(t, firstRepoDir)
+	second := distsHashes(t, secondRepoDir)
+
+	require.NotEmpty(t, first)
+	require.Equal(t, first, second)
+
+	inRelease, err := os.ReadFile(filepath.Join(firstRepoDir, "dists", "stable", "InRelease"))
+	require.NoError(t, err)
+	require.Contains(t, string(inRelease), "Date: Sat, 01 Jun 2024 12:00:00 UTC")
+	require.Contains(t, string(inRelease), "Architectures: all amd64 arm64")
+}
+
+func TestBuildCancelled(t *testing.T) {
+	debsDir := t.TempDir()
+	writeDeb(t, debsDir, "hello", "1.0", "amd64")
+
+	privateKey := newPrivateKey(t)
+	repoDir := t.TempDir()
+	build(t, repoDir, singleComponent(filepath.Join(debsDir, "*.deb")), privateKey)
+
+	published := distsHashes(t, repoDir)
+
+	writeDeb(t, debsDir, "hello", "1.1", "amd64")
+	writeDeb(t, debsDir, "world", "1.0", "all")
+	resolved := resolve(t, singleComponent(filepath.Join(debsDir, "*.deb")))
+
+	// Cancel the build at every point it checks for cancellation, until it
+	// manages to complete.
+	for n := int64(0); ; n++ {
+		require.Less(t, n, int64(10000), "build never completed")
+
+		err := Build(&cancelAfter{Context: context.Background(), remaining: n}, repoDir, resolved, BuildOptions{
+			PrivateKey:      privateKey,
+			Date:            testDate,
+			PoolMode:        pool.ModeCopy,
+			KeepGenerations: 2,
+		})
+		if err == nil {
+			break
+		}
+		require.ErrorIs(t, err, context.Canceled)
+
+		// The published repository is untouched.
+		require.Equal(t, published, distsHashes(t, repoDir))
+
+		staged, err := os.ReadDir(filepath.Join(repoDir, publish.StateDirName, "staging"))
+		if !os.IsNotExist(err) {
+			require.NoError(t, err)
+		}
+		require.Empty(t, staged)
+
+		// No partially written pool files are left behind.
+		err = filepath.WalkDir(filepath.Join(repoDir, "pool"), func(path string, d fs.DirEntry, err error) error {
+			require.NoError(t, err)
+			require.False(t, strings.HasSuffix(path, ".tmp"), path)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	require.NotEqual(t, published, distsHashes(t, repoDir))
+}
+
+func TestBuildCancelledAfterPlacement(t *testing.T) {
+	debsDir := t.TempDir()
+	writeDeb(t, debsDir, "hello", "1.0", "amd64")
+
+	privateKey := newPrivateKey(t)
+	repoDir := t.TempDir()
+	build(t, repoDir, singleComponent(filepath.Join(debsDir, "*.deb")), privateKey)
+
+	published := distsHashes(t, repoDir)
+	verifyPool(t, repoDir)
+
+	// Switching to symlinks replaces the existing pool file, as well as
+	// creating new ones.
+	writeDeb(t, debsDir, "world", "1.0", "all")
+	resolved := resolve(t, singleComponent(filepath.Join(debsDir, "*.deb")))
+
+	for n := int64(0); ; n++ {
+		require.Less(t, n, int64(10000), "build never completed")
+
+		err := Build(&cancelAfter{Context: context.Background(), remaining: n}, repoDir, resolved, BuildOptions{
+			PrivateKey:      privateKey,
+			Date:            testDate,
+			PoolMode:        pool.ModeSymlink,
+			KeepGenerations: 2,
+		})
+		if err == nil {
+			break
+		}
+		require.ErrorIs(t, err, context.Canceled)
+
+		// The previous generation is still published, and the pool matches it.
+		require.Equal(t, published, distsHashes(t, repoDir))
+		verifyPool(t, repoDir)
+
+		fi, err := os.Lstat(filepath.Join(repoDir, "pool", "main", "h", "hello", "hello_1.0_amd64.deb"))
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+	}
+
+	verifyPool(t, repoDir)
+}
+
+func TestBuildProvenance(t *testing.T) {
+	debsDir := t.TempDir()
+	writeDeb(t, debsDir, "hello", "1.0", "amd64")
+
+	privateKey := newPrivateKey(t)
+	repoDir := t.TempDir()
+
+	buildAt := func(t *testing.T, conf *v1alpha2.Repository, date time.Time) *provenance.Manifest {
+		t.Helper()
+
+		err := Build(context.Background(), repoDir, resolve(t, conf), BuildOptions{
+			PrivateKey:      privateKey,
+			Date:            date,
+			PoolMode:        pool.ModeCopy,
+			KeepGenerations: 2,
+			Provenance:      provenance.Options{AptifyVersion: "v1", Attestations: true},
+		})
+		require.NoError(t, err)
+
+		m, err := provenance.Read(filepath.Join(repoDir, "dists", provenance.ManifestName))
+		require.NoError(t, err)
+
+		require.FileExists(t, filepath.Join(repoDir, "dists", provenance.AttestationsName))
+
+		return m
+	}
+
+	m := buildAt(t, singleComponent(filepath.Join(debsDir, "*.deb")), testDate)
+	require.Len(t, m.Packages, 1)
+	require.Equal(t, "pool/main/h/hello/hello_1.0_amd64.deb", m.Packages[0].Filename)
+	require.Equal(t, testDate, m.Packages[0].IngestedAt)
+
+	// Moving the package to another component keeps its ingestion time, while
+	// new packages are stamped with the build date.
+	writeDeb(t, debsDir, "world", "1.0", "all")
+
+	conf := singleComponent(filepath.Join(debsDir, "*.deb"))
+	conf.Releases[0].Components[0].Name = "contrib"
+
+	laterDate := testDate.Add(24 * time.Hour)
+	m = buildAt(t, conf, laterDate)
+	require.Len(t, m.Packages, 2)
+
+	require.Equal(t, "pool/contrib/h/hello/hello_1.0_amd64.deb", m.Packages[0].Filename)
+	require.Equal(t, testDate, m.Packages[0].IngestedAt)
+
+	require.Equal(t, "pool/contrib/w/world/world_1.0_all.deb", m.Packages[1].Filename)
+	require.Equal(t, laterDate, m.Packages[1].IngestedAt)
+}
+
+// cancelAfter is a context that is cancelled once its error has been checked
+// a given number of times.
+type cancelAfter struct {
+	context.Context
+	remaining int64
+}
+
+func (ctx *cancelAfter) Err() error {
+	if atomic.AddInt64(&ctx.remaining, -1) < 0 {
+		return context.Canceled
+	}
+
+	return nil
+}
+
+// distsHashes returns the sha256sum of every (unsigned) file in the published
+// dists directory.
+func distsHashes(t *testing.T, repoDir string) map[string]string {
+	t.Helper()
+
+	distsDir := filepath.Join(repoDir, "dists")
+
+	hashes := make(map[string]string)
+	err := filepath.WalkDir(distsDir+"/", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// The signature in InRelease is timestamped when it is made.
+		if d.IsDir() || d.Name() == "InRelease" {
+			return nil
+		}
+
+		hash, err := sha256sum.File(context.Background(), path)
+		if err != nil {
+			return err
+		}
+
+		hashes[strings.TrimPrefix(path, distsDir+"/")] = hash
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	return hashes
+}
+
+// verifyPool checks that the pool contains exactly the files referenced by the
+// published Packages indices, and that each of them has the expected hash.
+func verifyPool(t *testing.T, repoDir string) {
+	t.Helper()
+
+	expected := make(map[string]string)
+	err := filepath.WalkDir(filepath.Join(repoDir, "dists")+"/", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.Name() != "Packages" {
+			return err
+		}
+
+		packages, err := ReadPackagesIndice(path)
+		if err != nil {
+			return err
+		}
+
+		for _, pkg := range packages {
+			expected[pkg.Filename] = pkg.SHA256
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	actual := make(map[string]string)
+	err = filepath.WalkDir(filepath.Join(repoDir, "pool"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		hash, err := sha256sum.File(context.Background(), path)
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(repoDir, path)
+		if err != nil {
+			return err
+		}
+
+		actual[filepath.ToSlash(relPath)] = hash
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NotEmpty(t, expected)
+	require.Equal(t, expected, actual)
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/deb"
+)
+
+// Cache caches package metadata and contents between builds, so that deb
+// files that haven't changed don't need to be read again. A nil cache is valid
+// and caches nothing.
+type Cache struct {
+	mu       sync.Mutex
+	metadata map[string]cachedPackage
+	contents map[string][]string
+}
+
+type cachedPackage struct {
+	size    int64
+	modTime time.Time
+	pkg     Package
+}
+
+// NewCache creates a new, empty, cache.
+func NewCache() *Cache {
+	return &Cache{
+		metadata: make(map[string]cachedPackage),
+		contents: make(map[string][]string),
+	}
+}
+
+// readPackage reads the metadata of the deb file at path, using the cached
+// metadata if the file has not been modified.
+func (c *Cache) readPackage(ctx context.Context, path string, limits deb.Limits) (*Package, error) {
+	if c == nil {
+		return readPackage(ctx, path, limits)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat package: %w", err)
+	}
+
+	c.mu.Lock()
+	cached, ok := c.metadata[path]
+	c.mu.Unlock()
+
+	if ok && cached.size == fi.Size() && cached.modTime.Equal(fi.ModTime()) {
+		pkg := cached.pkg
+		return &pkg, nil
+	}
+
+	pkg, err := readPackage(ctx, path, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.metadata[path] = cachedPackage{
+		size:    fi.Size(),
+		modTime: fi.ModTime(),
+		pkg:     *pkg,
+	}
+	c.mu.Unlock()
+
+	return pkg, nil
+}
+
+// packageContents returns the list of files within the deb file at path.
+func (c *Cache) packageContents(ctx context.Context, path, sha256 string, limits deb.Limits) ([]string, error) {
+	if c == nil {
+		return deb.GetPackageContents(ctx, path, limits)
+	}
+
+	c.mu.Lock()
+	contents, ok := c.contents[sha256]
+	c.mu.Unlock()
+
+	if ok {
+		return contents, nil
+	}
+
+	contents, err := deb.GetPackageContents(ctx, path, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.contents[sha256] = contents
+	c.mu.Unlock()
+
+	return contents, nil
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// DuplicatePolicy determines what happens when multiple deb files with
+// different contents share the same package name, version and architecture.
+type DuplicatePolicy string
+
+const (
+	// DuplicatePolicyError fails the build.
+	DuplicatePolicyError DuplicatePolicy = "error"
+	// DuplicatePolicyFirstWins uses the first matching deb file.
+	DuplicatePolicyFirstWins DuplicatePolicy = "first-wins"
+	// DuplicatePolicyLastWins uses the last matching deb file.
+	DuplicatePolicyLastWins DuplicatePolicy = "last-wins"
+	// DuplicatePolicyHighestMtime uses the most recently modified deb file.
+	DuplicatePolicyHighestMtime DuplicatePolicy = "highest-mtime"
+)
+
+// ParseDuplicatePolicy parses a duplicate policy, an empty string is treated
+// as DuplicatePolicyError.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(s); policy {
+	case "":
+		return DuplicatePolicyError, nil
+	case DuplicatePolicyError, DuplicatePolicyFirstWins, DuplicatePolicyLastWins, DuplicatePolicyHighestMtime:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported duplicate policy: %s", s)
+	}
+}
+
+// selectDuplicate chooses which of the candidate packages (all sharing the same
+// name, version and architecture, in the order they were matched) to use.
+// Candidates with identical contents have already been de-duplicated.
+func selectDuplicate(policy DuplicatePolicy, candidates []*Package) (*Package, error) {
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	var selected *Package
+	switch policy {
+	case DuplicatePolicyFirstWins:
+		selected = candidates[0]
+	case DuplicatePolicyLastWins:
+		selected = candidates[len(candidates)-1]
+	case DuplicatePolicyHighestMtime:
+		selected = candidates[0]
+		for _, candidate := range candidates[1:] {
+			if candidate.modTime.After(selected.modTime) {
+				selected = candidate
+			}
+		}
+	default:
+		var descriptions []string
+		for _, candidate := range candidates {
+			descriptions = append(descriptions, fmt.Sprintf("%s (sha256 %s)", candidate.Location, candidate.SHA256))
+		}
+
+		return nil, fmt.Errorf("conflicting deb files for package %s: %s; set duplicatePolicy to choose one",
+			candidates[0].ID(), strings.Join(descriptions, ", "))
+	}
+
+	for _, candidate := range candidates {
+		if candidate != selected {
+			slog.Warn("Ignoring conflicting deb file",
+				slog.String("package", candidate.ID()),
+				slog.String("path", candidate.Location),
+				slog.String("selected", selected.Location),
+				slog.String("policy", string(policy)))
+		}
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	policy, err := ParseDuplicatePolicy("")
+	require.NoError(t, err)
+	require.Equal(t, DuplicatePolicyError, policy)
+
+	for _, policy := range []DuplicatePolicy{DuplicatePolicyError, DuplicatePolicyFirstWins, DuplicatePolicyLastWins, DuplicatePolicyHighestMtime} {
+		parsed, err := ParseDuplicatePolicy(string(policy))
+		require.NoError(t, err)
+		require.Equal(t, policy, parsed)
+	}
+
+	_, err = ParseDuplicatePolicy("newest")
+	require.Error(t, err)
+}
+
+func TestResolveDuplicates(t *testing.T) {
+	firstDir := t.TempDir()
+	first := writeDeb(t, firstDir, "hello", "1.0", "amd64")
+
+	// Same package name, version and architecture, but different contents.
+	secondDir := t.TempDir()
+	second := writeDeb(t, secondDir, "hello", "1.0", "amd64", "Description: A rebuilt hello")
+
+	// The first deb file is the most recently modified.
+	require.NoError(t, os.Chtimes(first, testDate, testDate))
+	require.NoError(t, os.Chtimes(second, testDate.Add(-time.Hour), testDate.Add(-time.Hour)))
+
+	conf := singleComponent(filepath.Join(firstDir, "*.deb"), filepath.Join(secondDir, "*.deb"))
+
+	resolveWithPolicy := func(policy DuplicatePolicy) (*Resolved, error) {
+		conf.Settings.DuplicatePolicy = string(policy)
+		return Resolve(context.Background(), conf, ResolveOptions{})
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := resolveWithPolicy("")
+		require.ErrorContains(t, err, "conflicting deb files for package hello_1.0_amd64")
+	})
+
+	tests := []struct {
+		policy   DuplicatePolicy
+		expected string
+	}{
+		{DuplicatePolicyFirstWins, first},
+		{DuplicatePolicyLastWins, second},
+		{DuplicatePolicyHighestMtime, first},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			resolved, err := resolveWithPolicy(tt.policy)
+			require.NoError(t, err)
+
+			packages := resolved.Releases[0].Components[0].Packages
+			require.Len(t, packages, 1)
+			require.Equal(t, tt.expected, packages[0].Location)
+		})
+	}
+
+	t.Run("Identical", func(t *testing.T) {
+		copyDir := t.TempDir()
+		data, err := os.ReadFile(first)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(copyDir, filepath.Base(first)), data, 0o644))
+
+		resolved := resolve(t, singleComponent(filepath.Join(firstDir, "*.deb"), filepath.Join(copyDir, "*.deb")))
+
+		packages := resolved.Releases[0].Components[0].Packages
+		require.Len(t, packages, 1)
+		require.Equal(t, first, packages[0].Location)
+	})
+}
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/pool"
+	"github.com/dpeckett/aptify/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// testDate is the date test repositories are stamped with.
+var testDate = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func newPrivateKey(t *testing.T) *openpgp.Entity {
+	t.Helper()
+
+	privateKey, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	require.NoError(t, err)
+
+	return privateKey
+}
+
+// writeDeb writes a deb file for a package (with a single file) into dir.
+func writeDeb(t *testing.T, dir, name, version, architecture string, fields ...string) string {
+	t.Helper()
+
+	return testutil.WriteDeb(t, filepath.Join(dir, name+"_"+version+"_"+architecture+".deb"), testutil.Deb{
+		Control: testutil.Control(name, version, architecture, fields...),
+		Files: []testutil.File{
+			{Name: "./usr/", Typeflag: '5'},
+			{Name: "./usr/share/", Typeflag: '5'},
+			{Name: "./usr/share/" + name + "/" + version, Body: []byte(name + " " + version)},
+		},
+	})
+}
+
+// singleComponent returns a config for a repository with one release, with a
+// single component that includes the given package patterns.
+func singleComponent(patterns ...string) *v1alpha2.Repository {
+	return &v1alpha2.Repository{
+		Releases: []v1alpha2.ReleaseConfig{{
+			Name: "stable",
+			Components: []v1alpha2.ComponentConfig{{
+				Name:     "main",
+				Packages: patterns,
+			}},
+		}},
+	}
+}
+
+func resolve(t *testing.T, conf *v1alpha2.Repository) *Resolved {
+	t.Helper()
+
+	resolved, err := Resolve(context.Background(), conf, ResolveOptions{})
+	require.NoError(t, err)
+
+	return resolved
+}
+
+// build resolves and builds the repository into repoDir.
+func build(t *testing.T, repoDir string, conf *v1alpha2.Repository, privateKey *openpgp.Entity) *Resolved {
+	t.Helper()
+
+	resolved := resolve(t, conf)
+
+	err := Build(context.Background(), repoDir, resolved, BuildOptions{
+		PrivateKey:      privateKey,
+		Date:            testDate,
+		PoolMode:        pool.ModeCopy,
+		KeepGenerations: 2,
+	})
+	require.NoError(t, err)
+
+	return resolved
+}
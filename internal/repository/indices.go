@@ -0,0 +1,284 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	stdtime "time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/report"
+	"github.com/dpeckett/aptify/internal/sha256sum"
+	"github.com/dpeckett/deb822"
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/list"
+	"github.com/dpeckett/deb822/types/time"
+	"github.com/dpeckett/uncompr"
+)
+
+// releaseIndices generates the Packages and Contents indices for a release.
+// Returns the contents of each index keyed by its path relative to the release
+// directory, and the list of architectures within the release. The indexed
+// packages are recorded in the (optional) report.
+func releaseIndices(ctx context.Context, release *Release, cache *Cache, limits deb.Limits, compression []string, rep *report.Report) (map[string][]byte, []arch.Arch, error) {
+	packagesNames := []string{"Packages"}
+	for _, ext := range compression {
+		packagesNames = append(packagesNames, "Packages."+ext)
+	}
+
+	indices := make(map[string][]byte)
+	releaseArchs := make(map[string]bool)
+
+	for _, component := range release.Components {
+		packagesForArch := make(map[string][]types.Package)
+		for _, pkg := range component.Packages {
+			packagesForArch[pkg.Architecture.String()] = append(packagesForArch[pkg.Architecture.String()], pkg.Package)
+		}
+
+		pkgsByFilename := make(map[string]*Package)
+		for i := range component.Packages {
+			pkgsByFilename[component.Packages[i].Filename] = &component.Packages[i]
+		}
+
+		// Listed architectures are always indexed, so that clients get an empty
+		// list rather than an error when there are no packages.
+		for _, architecture := range release.Config.Architectures {
+			if _, ok := packagesForArch[architecture]; !ok {
+				packagesForArch[architecture] = nil
+			}
+		}
+
+		// Iterate in a stable order, so that builds are reproducible.
+		componentArchs := make([]string, 0, len(packagesForArch))
+		for architecture := range packagesForArch {
+			componentArchs = append(componentArchs, architecture)
+		}
+		sort.Strings(componentArchs)
+
+		for _, architecture := range componentArchs {
+			packages := packagesForArch[architecture]
+
+			sort.Slice(packages, func(i, j int) bool {
+				if cmp := packages[i].Compare(packages[j]); cmp != 0 {
+					return cmp < 0
+				}
+
+				return packages[i].Filename < packages[j].Filename
+			})
+
+			archDir := filepath.Join(component.Name, "binary-"+architecture)
+
+			slog.Info("Generating Packages indice",
+				slog.String("release", release.Config.Name), slog.String("dir", archDir),
+				slog.Int("count", len(packages)))
+
+			for _, name := range packagesNames {
+				data, err := packagesIndice(name, packages)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to generate package lists: %w", err)
+				}
+
+				indices[filepath.Join(archDir, name)] = data
+			}
+
+			name := filepath.Join(component.Name, fmt.Sprintf("Contents-%s.gz", architecture))
+
+			slog.Info("Generating Contents indice",
+				slog.String("release", release.Config.Name), slog.String("name", name))
+
+			data, err := contentsIndice(ctx, name, packages, pkgsByFilename, cache, limits)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to generate contents file: %w", err)
+			}
+
+			indices[name] = data
+
+			if rep != nil {
+				reportPackages := make([]report.Package, 0, len(packages))
+				for _, pkg := range packages {
+					reportPackages = append(reportPackages, report.Package{
+						Name:         pkg.Name,
+						Version:      pkg.Version.String(),
+						Architecture: pkg.Architecture.String(),
+						Filename:     filepath.ToSlash(pkg.Filename),
+						SHA256:       pkg.SHA256,
+						Source:       pkgsByFilename[pkg.Filename].Location,
+						Pattern:      pkgsByFilename[pkg.Filename].Pattern,
+					})
+				}
+
+				rep.AddArchitecture(release.Config.Name, component.Name, architecture, reportPackages)
+			}
+
+			releaseArchs[architecture] = true
+		}
+	}
+
+	architectures := make([]arch.Arch, 0, len(releaseArchs))
+	for architecture := range releaseArchs {
+		architectures = append(architectures, arch.MustParse(architecture))
+	}
+
+	sort.Slice(architectures, func(i, j int) bool {
+		return architectures[i].String() < architectures[j].String()
+	})
+
+	return indices, architectures, nil
+}
+
+func packagesIndice(name string, packages []types.Package) ([]byte, error) {
+	var packageList bytes.Buffer
+	if err := deb822.Marshal(&packageList, packages); err != nil {
+		return nil, fmt.Errorf("failed to marshal packages: %w", err)
+	}
+
+	return compress(name, packageList.Bytes())
+}
+
+func contentsIndice(ctx context.Context, name string, packages []types.Package, pkgsByFilename map[string]*Package, cache *Cache, limits deb.Limits) ([]byte, error) {
+	contents := make(map[string][]string)
+	for _, pkg := range packages {
+		pkgContents, err := cache.packageContents(ctx, pkgsByFilename[pkg.Filename].Path, pkg.SHA256, limits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get package contents: %w", err)
+		}
+
+		qualifiedPackageName := pkg.Name
+		if pkg.Section != "" {
+			qualifiedPackageName = fmt.Sprintf("%s/%s", pkg.Section, pkg.Name)
+		}
+
+		for _, path := range pkgContents {
+			contents[path] = append(contents[path], qualifiedPackageName)
+		}
+	}
+
+	paths := make([]string, 0, len(contents))
+	for k := range contents {
+		paths = append(paths, k)
+	}
+
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, path := range paths {
+		if _, err := fmt.Fprintf(&buf, "%s %s\n", path, strings.Join(contents[path], ",")); err != nil {
+			return nil, fmt.Errorf("failed to write contents: %w", err)
+		}
+	}
+
+	return compress(name, buf.Bytes())
+}
+
+// compress compresses the data based on the file extension of name.
+// The compressed streams don't embed timestamps or file names, so the output
+// only depends on the input.
+func compress(name string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := uncompr.NewWriter(&buf, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compression writer: %w", err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress %s: %w", name, err)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close compression writer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeReleaseFile(ctx context.Context, releaseDir string, release *Release, architectures []arch.Arch, date stdtime.Time, privateKey *openpgp.Entity) error {
+	slog.Info("Writing Release file", slog.String("dir", releaseDir))
+
+	var components []string
+	for _, component := range release.Components {
+		components = append(components, component.Name)
+	}
+
+	r := types.Release{
+		Origin:        release.Config.Origin,
+		Label:         release.Config.Label,
+		Suite:         release.Config.Suite,
+		Version:       release.Config.Version,
+		Codename:      release.Config.Name,
+		Changelogs:    "no",
+		Date:          time.Time(date.UTC()),
+		Architectures: list.SpaceDelimited[arch.Arch](architectures),
+		Components:    list.SpaceDelimited[string](components),
+		Description:   release.Config.Description,
+	}
+
+	var err error
+	r.SHA256, err = sha256sum.Directory(ctx, releaseDir)
+	if err != nil {
+		return fmt.Errorf("failed to hash release: %w", err)
+	}
+
+	releaseFile, err := os.Create(filepath.Join(releaseDir, "InRelease"))
+	if err != nil {
+		return fmt.Errorf("failed to create Release file: %w", err)
+	}
+	defer releaseFile.Close()
+
+	encoder, err := deb822.NewEncoder(releaseFile, privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to create encoder: %w", err)
+	}
+	defer encoder.Close()
+
+	if err := encoder.Encode(r); err != nil {
+		return fmt.Errorf("failed to encode release: %w", err)
+	}
+
+	return nil
+}
+
+// ReadPackagesIndice reads an (uncompressed) Packages indice.
+func ReadPackagesIndice(path string) ([]types.Package, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Packages file: %w", err)
+	}
+	defer f.Close()
+
+	dec, err := deb822.NewDecoder(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Packages file decoder: %w", err)
+	}
+
+	var packages []types.Package
+	if err := dec.Decode(&packages); err != nil {
+		return nil, fmt.Errorf("failed to decode Packages file: %w", err)
+	}
+
+	return packages, nil
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReleaseArchitectures(t *testing.T) {
+	debsDir := t.TempDir()
+	writeDeb(t, debsDir, "hello", "1.0", "amd64")
+	writeDeb(t, debsDir, "world", "1.0", "all")
+
+	conf := singleComponent(filepath.Join(debsDir, "*.deb"))
+	conf.Releases[0].Architectures = []string{"amd64", "arm64"}
+
+	repoDir := t.TempDir()
+	build(t, repoDir, conf, newPrivateKey(t))
+
+	releaseDir := filepath.Join(repoDir, "dists", "stable")
+
+	inRelease, err := os.ReadFile(filepath.Join(releaseDir, "InRelease"))
+	require.NoError(t, err)
+	require.Contains(t, string(inRelease), "Architectures: all amd64 arm64\n")
+
+	// Listed architectures without any packages still have (empty) indices.
+	packages, err := os.ReadFile(filepath.Join(releaseDir, "main", "binary-arm64", "Packages"))
+	require.NoError(t, err)
+	require.Empty(t, packages)
+
+	_, err = os.Stat(filepath.Join(releaseDir, "main", "Contents-arm64.gz"))
+	require.NoError(t, err)
+
+	packages, err = os.ReadFile(filepath.Join(releaseDir, "main", "binary-amd64", "Packages"))
+	require.NoError(t, err)
+	require.Contains(t, string(packages), "Package: hello\n")
+
+	t.Run("Unlisted Architecture", func(t *testing.T) {
+		writeDeb(t, debsDir, "hello", "1.0", "riscv64")
+
+		_, err := Resolve(context.Background(), conf, ResolveOptions{})
+		require.ErrorContains(t, err, "has architecture riscv64, which is not one of the architectures of release stable")
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		conf := singleComponent(filepath.Join(debsDir, "hello_1.0_amd64.deb"))
+		conf.Defaults.Architectures = []string{"amd64", "arm64"}
+
+		resolved := resolve(t, conf)
+		require.Equal(t, []string{"amd64", "arm64"}, resolved.Releases[0].Config.Architectures)
+	})
+
+	t.Run("Invalid Architecture", func(t *testing.T) {
+		conf := singleComponent(filepath.Join(debsDir, "*.deb"))
+		conf.Releases[0].Architectures = []string{"amd64", "../arm64"}
+
+		_, err := Resolve(context.Background(), conf, ResolveOptions{})
+		require.ErrorContains(t, err, `invalid architecture for release stable: "../arm64"`)
+	})
+}
@@ -0,0 +1,554 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dpeckett/aptify/internal/pool"
+	"github.com/dpeckett/aptify/internal/provenance"
+	"github.com/dpeckett/aptify/internal/sha256sum"
+)
+
+// Action is the kind of change that would be made to the repository.
+type Action string
+
+const (
+	ActionAdd     Action = "add"
+	ActionRemove  Action = "remove"
+	ActionReplace Action = "replace"
+)
+
+// Plan describes the changes a build would make to the repository.
+type Plan struct {
+	// Packages is the list of packages that would be added, removed or replaced.
+	Packages []PackageChange `json:"packages"`
+	// PoolFiles is the list of pool files that would be placed into the pool,
+	// or that would no longer be referenced (and removed by gc).
+	PoolFiles []FileChange `json:"poolFiles"`
+	// IndexFiles is the list of index files that would change.
+	IndexFiles []FileChange `json:"indexFiles"`
+}
+
+// PackageChange is a change to a package within a release/component/arch.
+type PackageChange struct {
+	Action          Action `json:"action"`
+	Release         string `json:"release"`
+	Component       string `json:"component"`
+	Architecture    string `json:"architecture"`
+	Name            string `json:"name"`
+	Version         string `json:"version,omitempty"`
+	PreviousVersion string `json:"previousVersion,omitempty"`
+}
+
+// FileChange is a change to a file within the repository.
+type FileChange struct {
+	Action Action `json:"action"`
+	// Path is the path of the file relative to the repository directory.
+	Path string `json:"path"`
+}
+
+// PlanBuild compares the resolved packages against the currently published
+// generation of the repository, and returns the changes a build (with the
+// given options) would make. The repository directory is not modified.
+func PlanBuild(ctx context.Context, repoDir string, resolved *Resolved, opts BuildOptions) (*Plan, error) {
+	var plan Plan
+
+	existingFiles, err := publishedFiles(repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Release names (and component names) may contain slashes, so the
+	// directories containing an InRelease file are used to tell them apart.
+	var releaseDirs []string
+	for name := range existingFiles {
+		if filepath.Base(name) == "InRelease" {
+			releaseDirs = append(releaseDirs, filepath.ToSlash(filepath.Dir(name)))
+		}
+	}
+
+	// Read the currently published packages.
+	existingPackages := make(packageVersions)
+	existingPoolFiles := make(map[string]bool)
+	for name, path := range existingFiles {
+		if filepath.Base(name) != "Packages" {
+			continue
+		}
+
+		packages, err := ReadPackagesIndice(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key := indexKeyForPath(releaseDirs, filepath.ToSlash(filepath.Dir(name)))
+		for _, pkg := range packages {
+			existingPackages.add(key, pkg.Name, pkg.Version.String(), pkg.SHA256)
+			existingPoolFiles[pkg.Filename] = true
+		}
+	}
+
+	plan.Packages = diffPackages(existingPackages, resolvedVersions(resolved))
+
+	// Pool files that need to be placed.
+	for poolPath, pkg := range resolved.PoolFiles {
+		dst := filepath.Join(repoDir, poolPath)
+
+		upToDate, err := pool.IsUpToDate(ctx, dst, opts.PoolMode, pkg.SHA256)
+		if err != nil {
+			return nil, err
+		}
+
+		if !upToDate {
+			action := ActionAdd
+			if _, err := os.Lstat(dst); err == nil {
+				action = ActionReplace
+			}
+
+			plan.PoolFiles = append(plan.PoolFiles, FileChange{Action: action, Path: poolPath})
+		}
+	}
+
+	// Pool files that will no longer be referenced.
+	for poolPath := range existingPoolFiles {
+		if _, ok := resolved.PoolFiles[poolPath]; !ok {
+			plan.PoolFiles = append(plan.PoolFiles, FileChange{Action: ActionRemove, Path: poolPath})
+		}
+	}
+
+	sortFileChanges(plan.PoolFiles)
+
+	// The names of both the existing and resolved releases, so that each
+	// existing file can be attributed to the release it belongs to.
+	releaseNames := slices.Clone(releaseDirs)
+	for _, release := range resolved.Releases {
+		releaseNames = append(releaseNames, release.Config.Name)
+	}
+
+	// Index files that would change.
+	generatedFiles := make(map[string]bool)
+	for i := range resolved.Releases {
+		release := &resolved.Releases[i]
+
+		indices, _, err := releaseIndices(ctx, release, resolved.cache, resolved.limits, resolved.compression, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var releaseChanged bool
+		for name, data := range indices {
+			name = filepath.Join(release.Config.Name, name)
+			generatedFiles[name] = true
+
+			action, err := diffIndexFile(ctx, existingFiles, name, data)
+			if err != nil {
+				return nil, err
+			}
+
+			if action != "" {
+				plan.IndexFiles = append(plan.IndexFiles, FileChange{Action: action, Path: filepath.Join("dists", name)})
+				releaseChanged = true
+			}
+		}
+
+		// Indices that are no longer generated.
+		for name := range existingFiles {
+			if releaseOf(releaseNames, name) != release.Config.Name ||
+				filepath.Base(name) == "InRelease" || generatedFiles[name] {
+				continue
+			}
+
+			plan.IndexFiles = append(plan.IndexFiles, FileChange{Action: ActionRemove, Path: filepath.Join("dists", name)})
+			releaseChanged = true
+		}
+
+		inReleaseName := filepath.Join(release.Config.Name, "InRelease")
+		generatedFiles[inReleaseName] = true
+
+		if _, ok := existingFiles[inReleaseName]; !ok {
+			plan.IndexFiles = append(plan.IndexFiles, FileChange{Action: ActionAdd, Path: filepath.Join("dists", inReleaseName)})
+		} else if releaseChanged {
+			plan.IndexFiles = append(plan.IndexFiles, FileChange{Action: ActionReplace, Path: filepath.Join("dists", inReleaseName)})
+		}
+	}
+
+	// The provenance manifest (and attestations) of the pool.
+	poolPaths := make([]string, 0, len(resolved.PoolFiles))
+	for poolPath := range resolved.PoolFiles {
+		poolPaths = append(poolPaths, poolPath)
+	}
+
+	manifest, err := provenanceManifest(repoDir, resolved, poolPaths, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestData, err := manifest.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	generatedFiles[provenance.ManifestName] = true
+
+	manifestAction, err := diffIndexFile(ctx, existingFiles, provenance.ManifestName, manifestData)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifestAction != "" {
+		plan.IndexFiles = append(plan.IndexFiles, FileChange{Action: manifestAction, Path: filepath.Join("dists", provenance.ManifestName)})
+	}
+
+	// The attestations are signed, so like InRelease they are only replaced
+	// when the manifest changes.
+	if opts.Provenance.Attestations {
+		generatedFiles[provenance.AttestationsName] = true
+
+		if _, ok := existingFiles[provenance.AttestationsName]; !ok {
+			plan.IndexFiles = append(plan.IndexFiles, FileChange{Action: ActionAdd, Path: filepath.Join("dists", provenance.AttestationsName)})
+		} else if manifestAction != "" {
+			plan.IndexFiles = append(plan.IndexFiles, FileChange{Action: ActionReplace, Path: filepath.Join("dists", provenance.AttestationsName)})
+		}
+	}
+
+	// Releases that have been removed entirely.
+	for name := range existingFiles {
+		if !generatedFiles[name] && !isGeneratedRelease(resolved, releaseOf(releaseNames, name)) {
+			plan.IndexFiles = append(plan.IndexFiles, FileChange{Action: ActionRemove, Path: filepath.Join("dists", name)})
+		}
+	}
+
+	sortFileChanges(plan.IndexFiles)
+
+	return &plan, nil
+}
+
+// DiffPackages returns the packages that were added, removed or replaced
+// between two resolved repositories.
+func DiffPackages(previous, current *Resolved) []PackageChange {
+	return diffPackages(resolvedVersions(previous), resolvedVersions(current))
+}
+
+// Empty returns true if the plan contains no changes.
+func (p *Plan) Empty() bool {
+	return len(p.Packages) == 0 && len(p.PoolFiles) == 0 && len(p.IndexFiles) == 0
+}
+
+// WriteText writes a human-readable description of the plan.
+func (p *Plan) WriteText(w io.Writer) error {
+	if p.Empty() {
+		_, err := fmt.Fprintln(w, "No changes.")
+		return err
+	}
+
+	symbols := map[Action]string{
+		ActionAdd:     "+",
+		ActionRemove:  "-",
+		ActionReplace: "~",
+	}
+
+	var lines []string
+	if len(p.Packages) > 0 {
+		lines = append(lines, "Packages:")
+		for _, change := range p.Packages {
+			version := change.Version
+			if change.Action == ActionRemove {
+				version = change.PreviousVersion
+			} else if change.Action == ActionReplace && change.PreviousVersion != change.Version {
+				version = change.PreviousVersion + " -> " + change.Version
+			}
+
+			lines = append(lines, fmt.Sprintf("  %s %s/%s [%s] %s %s", symbols[change.Action],
+				change.Release, change.Component, change.Architecture, change.Name, version))
+		}
+	}
+
+	if len(p.PoolFiles) > 0 {
+		lines = append(lines, "Pool files:")
+		for _, change := range p.PoolFiles {
+			line := fmt.Sprintf("  %s %s", symbols[change.Action], change.Path)
+			if change.Action == ActionRemove {
+				line += " (unreferenced, removed by gc)"
+			}
+
+			lines = append(lines, line)
+		}
+	}
+
+	if len(p.IndexFiles) > 0 {
+		lines = append(lines, "Index files:")
+		for _, change := range p.IndexFiles {
+			lines = append(lines, fmt.Sprintf("  %s %s", symbols[change.Action], change.Path))
+		}
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// diffIndexFile returns the action needed to bring the existing file (relative
+// to the dists directory) up to date with data, or an empty action if the file
+// is unchanged.
+func diffIndexFile(ctx context.Context, existingFiles map[string]string, name string, data []byte) (Action, error) {
+	existingPath, ok := existingFiles[name]
+	if !ok {
+		return ActionAdd, nil
+	}
+
+	existingSHA256, err := sha256sum.File(ctx, existingPath)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	if existingSHA256 != hex.EncodeToString(sum[:]) {
+		return ActionReplace, nil
+	}
+
+	return "", nil
+}
+
+// publishedFiles returns all the files in the currently published dists
+// directory, keyed by their path relative to the dists directory.
+func publishedFiles(repoDir string) (map[string]string, error) {
+	files := make(map[string]string)
+
+	distsDir, err := filepath.EvalSymlinks(filepath.Join(repoDir, "dists"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return files, nil
+		}
+
+		return nil, fmt.Errorf("failed to resolve dists directory: %w", err)
+	}
+
+	err = filepath.WalkDir(distsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		name, err := filepath.Rel(distsDir, path)
+		if err != nil {
+			return err
+		}
+
+		files[name] = path
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk dists directory: %w", err)
+	}
+
+	return files, nil
+}
+
+func isGeneratedRelease(resolved *Resolved, releaseName string) bool {
+	for _, release := range resolved.Releases {
+		if release.Config.Name == releaseName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// releaseOf returns the release a file (relative to the dists directory)
+// belongs to, ie. the longest of the release names that contains it.
+func releaseOf(releaseNames []string, name string) string {
+	name = filepath.ToSlash(name)
+
+	var release string
+	for _, releaseName := range releaseNames {
+		if strings.HasPrefix(name, releaseName+"/") && len(releaseName) > len(release) {
+			release = releaseName
+		}
+	}
+
+	return release
+}
+
+// indexKey identifies the Packages index of a release/component/arch.
+type indexKey struct {
+	release      string
+	component    string
+	architecture string
+}
+
+// indexKeyForPath returns the key of the Packages index in the given directory
+// (relative to the dists directory), of the form release/component/binary-arch.
+func indexKeyForPath(releaseDirs []string, dir string) indexKey {
+	architecture := strings.TrimPrefix(path.Base(dir), "binary-")
+	rest := path.Dir(dir)
+
+	release := releaseOf(releaseDirs, rest)
+	if release == "" {
+		release, _, _ = strings.Cut(rest, "/")
+	}
+
+	return indexKey{
+		release:      release,
+		component:    strings.TrimPrefix(rest, release+"/"),
+		architecture: architecture,
+	}
+}
+
+// packageVersions maps each Packages index to the versions (and sha256sums)
+// of the packages within it, keyed by package name.
+type packageVersions map[indexKey]map[string]map[string]string
+
+// resolvedVersions returns the versions (and sha256sums) of every resolved
+// package.
+func resolvedVersions(resolved *Resolved) packageVersions {
+	packages := make(packageVersions)
+	if resolved == nil {
+		return packages
+	}
+
+	for _, release := range resolved.Releases {
+		for _, component := range release.Components {
+			for _, pkg := range component.Packages {
+				key := indexKey{release: release.Config.Name, component: component.Name, architecture: pkg.Architecture.String()}
+				packages.add(key, pkg.Name, pkg.Version.String(), pkg.SHA256)
+			}
+		}
+	}
+
+	return packages
+}
+
+// add records a package version (and its sha256sum) in the given index.
+func (p packageVersions) add(key indexKey, name, version, sha256 string) {
+	if _, ok := p[key]; !ok {
+		p[key] = make(map[string]map[string]string)
+	}
+
+	if _, ok := p[key][name]; !ok {
+		p[key][name] = make(map[string]string)
+	}
+
+	p[key][name][version] = sha256
+}
+
+func diffPackages(existing, updated packageVersions) []PackageChange {
+	keys := make(map[indexKey]bool)
+	for key := range existing {
+		keys[key] = true
+	}
+	for key := range updated {
+		keys[key] = true
+	}
+
+	var changes []PackageChange
+	for key := range keys {
+		names := make(map[string]bool)
+		for name := range existing[key] {
+			names[name] = true
+		}
+		for name := range updated[key] {
+			names[name] = true
+		}
+
+		for name := range names {
+			newChange := func(action Action, version, previousVersion string) PackageChange {
+				return PackageChange{
+					Action:          action,
+					Release:         key.release,
+					Component:       key.component,
+					Architecture:    key.architecture,
+					Name:            name,
+					Version:         version,
+					PreviousVersion: previousVersion,
+				}
+			}
+
+			var added, removed []string
+			for version, sha256 := range updated[key][name] {
+				existingSHA256, ok := existing[key][name][version]
+				if !ok {
+					added = append(added, version)
+				} else if existingSHA256 != sha256 {
+					changes = append(changes, newChange(ActionReplace, version, version))
+				}
+			}
+
+			for version := range existing[key][name] {
+				if _, ok := updated[key][name][version]; !ok {
+					removed = append(removed, version)
+				}
+			}
+
+			// A single version being swapped for another is a replacement.
+			if len(added) == 1 && len(removed) == 1 {
+				changes = append(changes, newChange(ActionReplace, added[0], removed[0]))
+				continue
+			}
+
+			for _, version := range added {
+				changes = append(changes, newChange(ActionAdd, version, ""))
+			}
+
+			for _, version := range removed {
+				changes = append(changes, newChange(ActionRemove, "", version))
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Release != b.Release {
+			return a.Release < b.Release
+		}
+		if a.Component != b.Component {
+			return a.Component < b.Component
+		}
+		if a.Architecture != b.Architecture {
+			return a.Architecture < b.Architecture
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+
+		return a.Version+a.PreviousVersion < b.Version+b.PreviousVersion
+	})
+
+	return changes
+}
+
+func sortFileChanges(changes []FileChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+}
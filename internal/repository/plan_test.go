@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/pool"
+	"github.com/dpeckett/aptify/internal/provenance"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanBuild(t *testing.T) {
+	ctx := context.Background()
+
+	debsDir := t.TempDir()
+	writeDeb(t, debsDir, "hello", "1.0", "amd64")
+	writeDeb(t, debsDir, "world", "1.0", "amd64")
+
+	repoDir := t.TempDir()
+	conf := singleComponent(filepath.Join(debsDir, "*.deb"))
+
+	t.Run("New Repository", func(t *testing.T) {
+		plan, err := PlanBuild(ctx, repoDir, resolve(t, conf), BuildOptions{PoolMode: pool.ModeCopy})
+		require.NoError(t, err)
+
+		require.Equal(t, []PackageChange{
+			{Action: ActionAdd, Release: "stable", Component: "main", Architecture: "amd64", Name: "hello", Version: "1.0"},
+			{Action: ActionAdd, Release: "stable", Component: "main", Architecture: "amd64", Name: "world", Version: "1.0"},
+		}, plan.Packages)
+
+		require.Equal(t, []FileChange{
+			{Action: ActionAdd, Path: "pool/main/h/hello/hello_1.0_amd64.deb"},
+			{Action: ActionAdd, Path: "pool/main/w/world/world_1.0_amd64.deb"},
+		}, plan.PoolFiles)
+
+		require.Contains(t, plan.IndexFiles, FileChange{Action: ActionAdd, Path: "dists/stable/InRelease"})
+		require.Contains(t, plan.IndexFiles, FileChange{Action: ActionAdd, Path: "dists/stable/main/binary-amd64/Packages"})
+		require.Contains(t, plan.IndexFiles, FileChange{Action: ActionAdd, Path: "dists/provenance.json"})
+	})
+
+	build(t, repoDir, conf, newPrivateKey(t))
+
+	t.Run("No Changes", func(t *testing.T) {
+		plan, err := PlanBuild(ctx, repoDir, resolve(t, conf), BuildOptions{PoolMode: pool.ModeCopy})
+		require.NoError(t, err)
+		require.True(t, plan.Empty(), plan)
+
+		var text bytes.Buffer
+		require.NoError(t, plan.WriteText(&text))
+		require.Equal(t, "No changes.\n", text.String())
+	})
+
+	t.Run("Attestations", func(t *testing.T) {
+		opts := BuildOptions{
+			PoolMode:   pool.ModeCopy,
+			Provenance: provenance.Options{Attestations: true},
+		}
+
+		plan, err := PlanBuild(ctx, repoDir, resolve(t, conf), opts)
+		require.NoError(t, err)
+		require.Equal(t, []FileChange{
+			{Action: ActionAdd, Path: "dists/provenance.intoto.jsonl"},
+		}, plan.IndexFiles)
+	})
+
+	t.Run("Changes", func(t *testing.T) {
+		updatedDebsDir := t.TempDir()
+		writeDeb(t, updatedDebsDir, "hello", "1.1", "amd64")
+		writeDeb(t, updatedDebsDir, "other", "1.0", "amd64")
+
+		plan, err := PlanBuild(ctx, repoDir, resolve(t, singleComponent(filepath.Join(updatedDebsDir, "*.deb"))), BuildOptions{PoolMode: pool.ModeCopy})
+		require.NoError(t, err)
+
+		require.Equal(t, []PackageChange{
+			{Action: ActionReplace, Release: "stable", Component: "main", Architecture: "amd64", Name: "hello", Version: "1.1", PreviousVersion: "1.0"},
+			{Action: ActionAdd, Release: "stable", Component: "main", Architecture: "amd64", Name: "other", Version: "1.0"},
+			{Action: ActionRemove, Release: "stable", Component: "main", Architecture: "amd64", Name: "world", PreviousVersion: "1.0"},
+		}, plan.Packages)
+
+		require.Equal(t, []FileChange{
+			{Action: ActionRemove, Path: "pool/main/h/hello/hello_1.0_amd64.deb"},
+			{Action: ActionAdd, Path: "pool/main/h/hello/hello_1.1_amd64.deb"},
+			{Action: ActionAdd, Path: "pool/main/o/other/other_1.0_amd64.deb"},
+			{Action: ActionRemove, Path: "pool/main/w/world/world_1.0_amd64.deb"},
+		}, plan.PoolFiles)
+
+		require.Contains(t, plan.IndexFiles, FileChange{Action: ActionReplace, Path: "dists/stable/InRelease"})
+		require.Contains(t, plan.IndexFiles, FileChange{Action: ActionReplace, Path: "dists/provenance.json"})
+
+		var text bytes.Buffer
+		require.NoError(t, plan.WriteText(&text))
+		require.Contains(t, text.String(), "~ stable/main [amd64] hello 1.0 -> 1.1")
+		require.Contains(t, text.String(), "- pool/main/w/world/world_1.0_amd64.deb (unreferenced, removed by gc)")
+	})
+}
+
+func TestPlanBuildNestedReleaseNames(t *testing.T) {
+	ctx := context.Background()
+
+	debsDir := t.TempDir()
+	writeDeb(t, debsDir, "hello", "1.0", "amd64")
+
+	updatesDebsDir := t.TempDir()
+	writeDeb(t, updatesDebsDir, "hello", "1.1", "amd64")
+
+	release := func(name, component, debsDir string) v1alpha2.ReleaseConfig {
+		return v1alpha2.ReleaseConfig{
+			Name: name,
+			Components: []v1alpha2.ComponentConfig{{
+				Name:     component,
+				Packages: []string{filepath.Join(debsDir, "*.deb")},
+			}},
+		}
+	}
+
+	conf := &v1alpha2.Repository{
+		Releases: []v1alpha2.ReleaseConfig{
+			release("bookworm", "main", debsDir),
+			release("bookworm/updates", "updates/main", updatesDebsDir),
+		},
+	}
+
+	repoDir := t.TempDir()
+	resolved := build(t, repoDir, conf, newPrivateKey(t))
+
+	plan, err := PlanBuild(ctx, repoDir, resolved, BuildOptions{PoolMode: pool.ModeCopy})
+	require.NoError(t, err)
+	require.True(t, plan.Empty(), plan)
+
+	// Only the files of the removed release are removed.
+	conf.Releases = conf.Releases[:1]
+
+	plan, err = PlanBuild(ctx, repoDir, resolve(t, conf), BuildOptions{PoolMode: pool.ModeCopy})
+	require.NoError(t, err)
+
+	require.Equal(t, []PackageChange{
+		{Action: ActionRemove, Release: "bookworm/updates", Component: "updates/main", Architecture: "amd64", Name: "hello", PreviousVersion: "1.1"},
+	}, plan.Packages)
+
+	require.Contains(t, plan.IndexFiles, FileChange{Action: ActionRemove, Path: "dists/bookworm/updates/InRelease"})
+
+	for _, change := range plan.IndexFiles {
+		require.NotContains(t, []string{"dists/bookworm/InRelease", "dists/bookworm/main/binary-amd64/Packages"}, change.Path)
+	}
+}
+
+func TestDiffPackages(t *testing.T) {
+	debsDir := t.TempDir()
+	writeDeb(t, debsDir, "hello", "1.0", "amd64")
+
+	previous := resolve(t, singleComponent(filepath.Join(debsDir, "*.deb")))
+
+	writeDeb(t, debsDir, "hello", "1.0", "arm64")
+
+	current := resolve(t, singleComponent(filepath.Join(debsDir, "*.deb")))
+
+	require.Empty(t, DiffPackages(previous, previous))
+	require.Equal(t, []PackageChange{
+		{Action: ActionAdd, Release: "stable", Component: "main", Architecture: "arm64", Name: "hello", Version: "1.0"},
+	}, DiffPackages(previous, current))
+	require.Equal(t, []PackageChange{
+		{Action: ActionRemove, Release: "stable", Component: "main", Architecture: "amd64", Name: "hello", PreviousVersion: "1.0"},
+		{Action: ActionRemove, Release: "stable", Component: "main", Architecture: "arm64", Name: "hello", PreviousVersion: "1.0"},
+	}, DiffPackages(current, nil))
+}
+
+func TestIndexKeyForPath(t *testing.T) {
+	releaseDirs := []string{"bookworm", "bookworm/updates"}
+
+	require.Equal(t, indexKey{release: "bookworm", component: "main", architecture: "amd64"},
+		indexKeyForPath(releaseDirs, "bookworm/main/binary-amd64"))
+	require.Equal(t, indexKey{release: "bookworm/updates", component: "main", architecture: "arm64"},
+		indexKeyForPath(releaseDirs, "bookworm/updates/main/binary-arm64"))
+	require.Equal(t, indexKey{release: "trixie", component: "non-free/firmware", architecture: "all"},
+		indexKeyForPath(releaseDirs, "trixie/non-free/firmware/binary-all"))
+}
@@ -0,0 +1,472 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/fetch"
+	"github.com/dpeckett/aptify/internal/provenance"
+	"github.com/dpeckett/aptify/internal/sha256sum"
+	"github.com/dpeckett/deb822/types"
+)
+
+// Resolved is the resolved contents of a repository.
+type Resolved struct {
+	// Releases is the list of resolved releases.
+	Releases []Release
+	// PoolFiles maps pool paths to the package that will be placed there.
+	PoolFiles map[string]*Package
+	// Invalid is the list of deb files that were left out because their
+	// control fields are invalid (see ResolveOptions.SkipInvalid).
+	Invalid []*Package
+
+	cache       *Cache
+	limits      deb.Limits
+	compression []string
+}
+
+// Release is a resolved release.
+type Release struct {
+	// Config is the configuration of the release.
+	Config v1alpha2.ReleaseConfig
+	// Components is the list of resolved components within the release.
+	Components []Component
+}
+
+// Component is a resolved component.
+type Component struct {
+	// Name is the name of the component.
+	Name string
+	// Packages is the list of packages within the component.
+	Packages []Package
+}
+
+// Package is a resolved package.
+type Package struct {
+	types.Package
+	// Path is the path to the deb file the package was read from.
+	Path string
+	// Pattern is the glob pattern (or URL) that matched the deb file.
+	Pattern string
+	// Location is where the deb file was obtained from, this is the URL for
+	// downloaded packages and the same as Path otherwise.
+	Location string
+	// modTime is the modification time of the deb file.
+	modTime time.Time
+}
+
+// ResolveOptions configures how packages are resolved.
+type ResolveOptions struct {
+	// Cache is an optional cache, used to avoid re-reading unmodified deb files.
+	Cache *Cache
+	// Fetcher is used to download packages from URLs.
+	Fetcher *fetch.Fetcher
+	// RepositoryDir is the output repository directory (if any), it is never
+	// searched for deb files.
+	RepositoryDir string
+	// Date is the date of the build, package ages (for retention policies) are
+	// measured against it. Defaults to the current time.
+	Date time.Time
+	// Provenance is the provenance manifest of the published repository (if
+	// any), it records when each deb file was first ingested. Deb files that
+	// have not been ingested yet are treated as being ingested at Date.
+	Provenance *provenance.Manifest
+	// SkipInvalid leaves deb files with invalid control fields out of the
+	// resolved packages (recording them in Resolved.Invalid) rather than
+	// failing, eg. so that they can be linted.
+	SkipInvalid bool
+}
+
+// Resolve finds all the packages referenced by the repository configuration
+// and reads their metadata. The repository directory is not modified.
+func Resolve(ctx context.Context, conf *v1alpha2.Repository, opts ResolveOptions) (*Resolved, error) {
+	cache := opts.Cache
+	limits := limitsFromConfig(conf.Settings.Limits)
+
+	duplicatePolicy, err := ParseDuplicatePolicy(conf.Settings.DuplicatePolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duplicate policy: %w", err)
+	}
+
+	compression, err := parseCompression(conf.Settings.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression: %w", err)
+	}
+
+	releaseConfs := releasesWithDefaults(conf)
+
+	date := opts.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	ingestionTimes := opts.Provenance.IngestionTimes()
+
+	var skip []string
+	if opts.RepositoryDir != "" {
+		skip = append(skip, opts.RepositoryDir)
+	}
+
+	// Only read each deb file once. Keyed by location, as downloaded (and
+	// extracted) deb files with identical contents share a path in the cache.
+	pkgsByLocation := make(map[string]*Package)
+
+	// All the distinct deb files for each package id, in the order they were
+	// first matched.
+	candidatesByID := make(map[string][]*Package)
+
+	type occurrence struct {
+		releaseIdx, componentIdx int
+		pkg                      *Package
+	}
+	var occurrences []occurrence
+
+	// Deb files that have been selected by at least one component.
+	selectedLocations := make(map[string]bool)
+
+	// Deb files with invalid control fields (when they are skipped).
+	var invalid []*Package
+	invalidLocations := make(map[string]bool)
+
+	for _, releaseConf := range releaseConfs {
+		for _, architecture := range releaseConf.Architectures {
+			if !deb.ValidArchitecture(architecture) {
+				return nil, fmt.Errorf("invalid architecture for release %s: %q", releaseConf.Name, architecture)
+			}
+		}
+	}
+
+	for releaseIdx, releaseConf := range releaseConfs {
+		for componentIdx, componentConf := range releaseConf.Components {
+			filter, err := newPackageFilter(componentConf.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter for %s/%s: %w", releaseConf.Name, componentConf.Name, err)
+			}
+
+			matches, err := matchPackages(ctx, componentConf, opts.Fetcher, skip, limits)
+			if err != nil {
+				return nil, err
+			}
+
+			downloaded, err := fetchPackages(ctx, componentConf, opts.Fetcher, limits)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, downloaded...)
+
+			pulled, err := pullPackages(ctx, componentConf, opts.Fetcher, limits)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, pulled...)
+
+			for _, m := range matches {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+
+				pkg, ok := pkgsByLocation[m.location]
+				if !ok {
+					pkg, err = cache.readPackage(ctx, m.path, limits)
+					if err != nil {
+						return nil, err
+					}
+
+					pkg.Pattern = m.pattern
+					pkg.Location = m.location
+					pkgsByLocation[m.location] = pkg
+				}
+
+				if !filter.matches(&pkg.Package) {
+					slog.Debug("Package excluded by filter",
+						slog.String("release", releaseConf.Name), slog.String("component", componentConf.Name),
+						slog.String("path", m.path))
+					continue
+				}
+
+				if opts.SkipInvalid {
+					if err := deb.Validate(&pkg.Package); err != nil {
+						slog.Debug("Skipping invalid package",
+							slog.String("path", pkg.Location), slog.Any("error", err))
+
+						if !invalidLocations[m.location] {
+							invalidLocations[m.location] = true
+							invalid = append(invalid, pkg)
+						}
+						continue
+					}
+				}
+
+				if architecture := pkg.Architecture.String(); len(releaseConf.Architectures) > 0 &&
+					architecture != "all" && !slices.Contains(releaseConf.Architectures, architecture) {
+					return nil, fmt.Errorf("package %s has architecture %s, which is not one of the architectures of release %s (use a filter to exclude it)",
+						pkg.Location, architecture, releaseConf.Name)
+				}
+
+				// Only deb files that are selected by a component take part in
+				// duplicate detection.
+				if !selectedLocations[m.location] {
+					selectedLocations[m.location] = true
+					candidatesByID[pkg.ID()] = addCandidate(candidatesByID[pkg.ID()], pkg)
+				}
+
+				occurrences = append(occurrences, occurrence{releaseIdx, componentIdx, pkg})
+			}
+		}
+	}
+
+	selectedByID := make(map[string]*Package)
+	for id, candidates := range candidatesByID {
+		selected, err := selectDuplicate(duplicatePolicy, candidates)
+		if err != nil {
+			return nil, err
+		}
+
+		selectedByID[id] = selected
+	}
+
+	resolved := &Resolved{
+		PoolFiles:   make(map[string]*Package),
+		Invalid:     invalid,
+		cache:       cache,
+		limits:      limits,
+		compression: compression,
+	}
+
+	for _, releaseConf := range releaseConfs {
+		release := Release{Config: releaseConf}
+		for _, componentConf := range releaseConf.Components {
+			release.Components = append(release.Components, Component{Name: componentConf.Name})
+		}
+		resolved.Releases = append(resolved.Releases, release)
+	}
+
+	seen := make(map[string]bool)
+	for _, o := range occurrences {
+		pkg := selectedByID[o.pkg.ID()]
+
+		componentConf := releaseConfs[o.releaseIdx].Components[o.componentIdx]
+		component := &resolved.Releases[o.releaseIdx].Components[o.componentIdx]
+
+		// Only include each package once per component.
+		key := fmt.Sprintf("%d/%d/%s", o.releaseIdx, o.componentIdx, pkg.ID())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		// Use the component name from the first release that includes the package.
+		if pkg.Filename == "" {
+			poolPath, err := poolPathForPackage(componentConf.Name, &pkg.Package)
+			if err != nil {
+				return nil, fmt.Errorf("invalid package %s: %w", pkg.Location, err)
+			}
+			pkg.Filename = poolPath
+		}
+
+		component.Packages = append(component.Packages, *pkg)
+	}
+
+	for releaseIdx, releaseConf := range releaseConfs {
+		for componentIdx, componentConf := range releaseConf.Components {
+			component := &resolved.Releases[releaseIdx].Components[componentIdx]
+
+			if err := applyRetention(releaseConf.Name, component, componentConf.Retention, date, ingestionTimes); err != nil {
+				return nil, fmt.Errorf("failed to apply retention policy to %s/%s: %w",
+					releaseConf.Name, componentConf.Name, err)
+			}
+
+			// Only packages that are still referenced need to be placed in the pool.
+			for _, pkg := range component.Packages {
+				// As epochs are not part of file names, different packages can
+				// (rarely) map to the same pool path.
+				if existing, ok := resolved.PoolFiles[pkg.Filename]; ok && existing.SHA256 != pkg.SHA256 {
+					return nil, fmt.Errorf("packages %s and %s would both be stored at %s",
+						existing.Location, pkg.Location, pkg.Filename)
+				}
+
+				resolved.PoolFiles[pkg.Filename] = pkgsByLocation[pkg.Location]
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+// Limits returns the resource limits used when reading the resolved deb files.
+func (r *Resolved) Limits() deb.Limits {
+	return r.limits
+}
+
+// addCandidate adds a package to the list of candidates for its package id,
+// unless a deb file with identical contents is already present.
+func addCandidate(candidates []*Package, pkg *Package) []*Package {
+	for _, candidate := range candidates {
+		if candidate.SHA256 == pkg.SHA256 {
+			slog.Debug("Ignoring identical duplicate deb file",
+				slog.String("path", pkg.Location), slog.String("duplicateOf", candidate.Location))
+			return candidates
+		}
+	}
+
+	return append(candidates, pkg)
+}
+
+func readPackage(ctx context.Context, path string, limits deb.Limits) (*Package, error) {
+	pkg, err := deb.GetMetadata(ctx, path, limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get package metadata: %w", err)
+	}
+
+	pkg.SHA256, err = sha256sum.File(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash package: %w", err)
+	}
+
+	// Get the size of the package file.
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get package size: %w", err)
+	}
+	pkg.Size = int(fi.Size())
+
+	return &Package{
+		Package: *pkg,
+		Path:    path,
+		modTime: fi.ModTime(),
+	}, nil
+}
+
+// poolPathForPackage returns the path (relative to the repository directory)
+// that a package is stored at, following the layout of the Debian archive. The
+// control fields are validated, so that crafted packages can't escape the pool.
+func poolPathForPackage(componentName string, pkg *types.Package) (string, error) {
+	if err := deb.Validate(pkg); err != nil {
+		return "", err
+	}
+
+	source := deb.SourceName(pkg)
+
+	prefix := source[:1]
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		prefix = source[:4]
+	}
+
+	// Like the Debian archive, epochs are not included in file names.
+	poolPath := path.Join("pool", componentName, prefix, source,
+		fmt.Sprintf("%s_%s_%s.deb", pkg.Name, pkg.Version.StringWithoutEpoch(), pkg.Architecture))
+
+	if !filepath.IsLocal(poolPath) || !strings.HasPrefix(poolPath, "pool/") {
+		return "", fmt.Errorf("pool path %q is outside of the pool directory", poolPath)
+	}
+
+	return poolPath, nil
+}
+
+// releasesWithDefaults returns the release configurations, with the defaults
+// applied to any unset settings.
+func releasesWithDefaults(conf *v1alpha2.Repository) []v1alpha2.ReleaseConfig {
+	defaults := conf.Defaults
+
+	releaseConfs := make([]v1alpha2.ReleaseConfig, 0, len(conf.Releases))
+	for _, releaseConf := range conf.Releases {
+		if releaseConf.Origin == "" {
+			releaseConf.Origin = defaults.Origin
+		}
+
+		if releaseConf.Label == "" {
+			releaseConf.Label = defaults.Label
+		}
+
+		if releaseConf.Architectures == nil {
+			releaseConf.Architectures = defaults.Architectures
+		}
+
+		// Copy the components, so that the configuration isn't modified.
+		releaseConf.Components = slices.Clone(releaseConf.Components)
+		for i := range releaseConf.Components {
+			if releaseConf.Components[i].Retention == nil {
+				releaseConf.Components[i].Retention = defaults.Retention
+			}
+		}
+
+		releaseConfs = append(releaseConfs, releaseConf)
+	}
+
+	return releaseConfs
+}
+
+// supportedCompression is the list of compressed variants of the Packages
+// indices that can be generated.
+var supportedCompression = []string{"gz", "xz", "lz4", "zst"}
+
+// parseCompression validates the list of compressed variants of the Packages
+// indices to generate, if unspecified only an xz compressed variant is
+// generated.
+func parseCompression(compression []string) ([]string, error) {
+	if compression == nil {
+		return []string{"xz"}, nil
+	}
+
+	for _, ext := range compression {
+		if !slices.Contains(supportedCompression, ext) {
+			return nil, fmt.Errorf("unsupported compression: %s (expected one of %s)",
+				ext, strings.Join(supportedCompression, ", "))
+		}
+	}
+
+	return compression, nil
+}
+
+// limitsFromConfig returns the resource limits for reading deb files. Zero
+// values use the default limit, negative values disable the limit.
+func limitsFromConfig(conf *v1alpha2.LimitsConfig) deb.Limits {
+	limits := deb.DefaultLimits
+	if conf == nil {
+		return limits
+	}
+
+	if conf.MaxControlSize != 0 {
+		limits.MaxControlSize = max(conf.MaxControlSize, 0)
+	}
+
+	if conf.MaxDataSize != 0 {
+		limits.MaxDataSize = max(conf.MaxDataSize, 0)
+	}
+
+	if conf.MaxEntries != 0 {
+		limits.MaxEntries = max(conf.MaxEntries, 0)
+	}
+
+	if conf.MaxRatio != 0 {
+		limits.MaxRatio = max(conf.MaxRatio, 0)
+	}
+
+	return limits
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/testutil"
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolPathForPackage(t *testing.T) {
+	tests := []struct {
+		pkg      types.Package
+		expected string
+	}{
+		{
+			pkg:      types.Package{Name: "hello", Version: version.MustParse("1:1.0-1"), Architecture: arch.MustParse("amd64")},
+			expected: "pool/main/h/hello/hello_1.0-1_amd64.deb",
+		},
+		{
+			pkg:      types.Package{Name: "libfoo1", Source: "libfoo (1.0)", Version: version.MustParse("1.0"), Architecture: arch.MustParse("arm64")},
+			expected: "pool/main/libf/libfoo/libfoo1_1.0_arm64.deb",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			poolPath, err := poolPathForPackage("main", &tt.pkg)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, poolPath)
+		})
+	}
+
+	t.Run("Never Leaves Pool", func(t *testing.T) {
+		values := []string{"..", "../..", "/", "/etc", "a/../../b", "a\nb", "", ".", "~", "1:../x"}
+
+		for _, value := range values {
+			candidates := []types.Package{
+				{Name: value, Version: version.MustParse("1.0"), Architecture: arch.MustParse("amd64")},
+				{Name: "hello", Source: value, Version: version.MustParse("1.0"), Architecture: arch.MustParse("amd64")},
+				{Name: "hello", Version: version.Version{Version: value}, Architecture: arch.MustParse("amd64")},
+				{Name: "hello", Version: version.Version{Version: "1.0", Revision: value}, Architecture: arch.MustParse("amd64")},
+				{Name: "hello", Version: version.MustParse("1.0"), Architecture: arch.Arch{ABI: "gnu", OS: "linux", CPU: value}},
+			}
+
+			for _, pkg := range candidates {
+				poolPath, err := poolPathForPackage("main", &pkg)
+				if err != nil {
+					continue
+				}
+
+				require.True(t, filepath.IsLocal(poolPath), poolPath)
+				require.Equal(t, poolPath, path.Clean(poolPath))
+				require.True(t, strings.HasPrefix(poolPath, "pool/main/"), poolPath)
+				require.NotContains(t, poolPath, "\n")
+			}
+		}
+	})
+
+	t.Run("Invalid Component", func(t *testing.T) {
+		pkg := types.Package{Name: "hello", Version: version.MustParse("1.0"), Architecture: arch.MustParse("amd64")}
+
+		_, err := poolPathForPackage("../..", &pkg)
+		require.Error(t, err)
+	})
+}
+
+func TestResolveInvalidPackage(t *testing.T) {
+	debsDir := t.TempDir()
+	testutil.WriteDeb(t, filepath.Join(debsDir, "evil.deb"), testutil.Deb{
+		Control: testutil.Control("../../evil", "1.0", "amd64"),
+	})
+
+	_, err := Resolve(context.Background(), singleComponent(filepath.Join(debsDir, "*.deb")), ResolveOptions{})
+	require.ErrorContains(t, err, `invalid Package field: "../../evil"`)
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/deb822/types/version"
+)
+
+// applyRetention removes any package versions from the component that are not
+// kept by the retention policy. The age of a package is measured from when its
+// deb file was first ingested (keyed by sha256sum) until the build date.
+func applyRetention(releaseName string, component *Component, retention *v1alpha2.RetentionConfig,
+	date time.Time, ingestionTimes map[string]time.Time) error {
+	if retention == nil || (retention.KeepLatest <= 0 && retention.KeepNewerThan <= 0) {
+		return nil
+	}
+
+	pinned := make(map[string][]version.Version)
+	for _, pin := range retention.Pinned {
+		name, versionStr, ok := strings.Cut(pin, "=")
+		if !ok {
+			return fmt.Errorf("invalid pinned version %q: expected name=version", pin)
+		}
+
+		v, err := version.Parse(versionStr)
+		if err != nil {
+			return fmt.Errorf("invalid pinned version %q: %w", pin, err)
+		}
+
+		pinned[strings.TrimSpace(name)] = append(pinned[strings.TrimSpace(name)], v)
+	}
+
+	isPinned := func(pkg *Package) bool {
+		for _, v := range pinned[pkg.Name] {
+			if v.Compare(pkg.Version) == 0 {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// Group the versions of each package (per architecture).
+	packagesByName := make(map[string][]*Package)
+	for i := range component.Packages {
+		pkg := &component.Packages[i]
+		key := pkg.Name + "_" + pkg.Architecture.String()
+		packagesByName[key] = append(packagesByName[key], pkg)
+	}
+
+	age := func(pkg *Package) time.Duration {
+		ingestedAt, ok := ingestionTimes[pkg.SHA256]
+		if !ok {
+			return 0
+		}
+
+		return date.Sub(ingestedAt)
+	}
+
+	keep := make(map[*Package]bool)
+	for _, packages := range packagesByName {
+		// Newest versions first.
+		sort.SliceStable(packages, func(i, j int) bool {
+			return packages[i].Version.Compare(packages[j].Version) > 0
+		})
+
+		for i, pkg := range packages {
+			keep[pkg] = (retention.KeepLatest > 0 && i < retention.KeepLatest) ||
+				(retention.KeepNewerThan > 0 && age(pkg) < retention.KeepNewerThan) ||
+				isPinned(pkg)
+		}
+	}
+
+	retained := make([]Package, 0, len(component.Packages))
+	for i := range component.Packages {
+		pkg := &component.Packages[i]
+		if !keep[pkg] {
+			slog.Info("Dropping package version due to retention policy",
+				slog.String("release", releaseName), slog.String("component", component.Name),
+				slog.String("package", pkg.ID()))
+			continue
+		}
+
+		retained = append(retained, *pkg)
+	}
+
+	component.Packages = retained
+
+	return nil
+}
@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/provenance"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+
+	debsDir := t.TempDir()
+	for _, v := range []string{"1.0", "1.1", "1.2", "2.0"} {
+		path := writeDeb(t, debsDir, "hello", v, "amd64")
+
+		// Modification times should have no effect on the age of a package.
+		require.NoError(t, os.Chtimes(path, time.Unix(0, 0), time.Unix(0, 0)))
+	}
+
+	conf := singleComponent(filepath.Join(debsDir, "*.deb"))
+
+	versions := func(resolved *Resolved) []string {
+		var versions []string
+		for _, pkg := range resolved.Releases[0].Components[0].Packages {
+			versions = append(versions, pkg.Version.String())
+		}
+		return versions
+	}
+
+	t.Run("Keep Latest", func(t *testing.T) {
+		conf.Releases[0].Components[0].Retention = &v1alpha2.RetentionConfig{
+			KeepLatest: 2,
+			Pinned:     []string{"hello=1.0"},
+		}
+
+		require.ElementsMatch(t, []string{"1.0", "1.2", "2.0"}, versions(resolve(t, conf)))
+	})
+
+	t.Run("Invalid Pin", func(t *testing.T) {
+		conf.Releases[0].Components[0].Retention = &v1alpha2.RetentionConfig{
+			KeepLatest: 1,
+			Pinned:     []string{"hello"},
+		}
+
+		_, err := Resolve(ctx, conf, ResolveOptions{})
+		require.ErrorContains(t, err, "invalid pinned version")
+	})
+
+	t.Run("Keep Newer Than", func(t *testing.T) {
+		conf.Releases[0].Components[0].Retention = &v1alpha2.RetentionConfig{
+			KeepNewerThan: 7 * 24 * time.Hour,
+		}
+
+		resolved := resolve(t, conf)
+
+		// Everything is new, so everything is kept.
+		require.Len(t, versions(resolved), 4)
+
+		// Record when each deb file was ingested, 2.0 was only ingested recently.
+		var entries []provenance.Entry
+		for _, pkg := range resolved.Releases[0].Components[0].Packages {
+			ingestedAt := testDate.Add(-30 * 24 * time.Hour)
+			if pkg.Version.String() == "2.0" {
+				ingestedAt = testDate.Add(-24 * time.Hour)
+			}
+
+			entries = append(entries, provenance.Entry{
+				Filename:   pkg.Filename,
+				SHA256:     pkg.SHA256,
+				IngestedAt: ingestedAt,
+			})
+		}
+		previous := provenance.NewManifest(entries, nil)
+
+		resolved, err := Resolve(ctx, conf, ResolveOptions{Date: testDate, Provenance: previous})
+		require.NoError(t, err)
+		require.Equal(t, []string{"2.0"}, versions(resolved))
+
+		// Ages are measured against the build date, not the current time.
+		resolved, err = Resolve(ctx, conf, ResolveOptions{Date: testDate.Add(-29 * 24 * time.Hour), Provenance: previous})
+		require.NoError(t, err)
+		require.Len(t, versions(resolved), 4)
+	})
+
+	t.Run("Published Repository", func(t *testing.T) {
+		conf.Releases[0].Components[0].Retention = nil
+
+		repoDir := t.TempDir()
+		build(t, repoDir, conf, newPrivateKey(t))
+
+		previous, err := provenance.Read(filepath.Join(repoDir, "dists", provenance.ManifestName))
+		require.NoError(t, err)
+
+		newDebsDir := t.TempDir()
+		writeDeb(t, newDebsDir, "hello", "3.0", "amd64")
+
+		conf := singleComponent(filepath.Join(debsDir, "*.deb"), filepath.Join(newDebsDir, "*.deb"))
+		conf.Releases[0].Components[0].Retention = &v1alpha2.RetentionConfig{
+			KeepNewerThan: 7 * 24 * time.Hour,
+		}
+
+		resolved, err := Resolve(ctx, conf, ResolveOptions{Date: testDate.Add(8 * 24 * time.Hour), Provenance: previous})
+		require.NoError(t, err)
+		require.Equal(t, []string{"3.0"}, versions(resolved))
+	})
+}
@@ -0,0 +1,412 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dpeckett/aptify/internal/bundle"
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/fetch"
+	"github.com/dpeckett/aptify/internal/glob"
+	"github.com/dpeckett/aptify/internal/oci"
+	"github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/version"
+)
+
+// match is a deb file that was matched by one of a component's patterns.
+type match struct {
+	path     string
+	pattern  string
+	location string
+}
+
+// matchPackages returns the deb files matched by a component's package
+// patterns, less any files that match one of its exclude patterns. Deb files
+// within archives are extracted into the fetcher's cache. Recursive patterns,
+// and directories, never descend into any of the skipped directories (eg. the
+// output repository).
+func matchPackages(ctx context.Context, componentConf v1alpha2.ComponentConfig, fetcher *fetch.Fetcher, skip []string, limits deb.Limits) ([]match, error) {
+	for _, pattern := range componentConf.Exclude {
+		if err := glob.Validate(pattern); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %s: %w", pattern, err)
+		}
+	}
+
+	var matches []match
+	for _, pattern := range componentConf.Packages {
+		if archivePattern, innerPattern, ok := bundle.Split(pattern); ok {
+			bundleMatches, err := matchBundlePackages(ctx, archivePattern, innerPattern, componentConf.Exclude, skip, fetcher, limits)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, m := range bundleMatches {
+				m.pattern = pattern
+				matches = append(matches, m)
+			}
+
+			continue
+		}
+
+		paths, err := glob.Glob(pattern, skip...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find deb files for %s: %w", pattern, err)
+		}
+
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+			}
+
+			if !fi.IsDir() {
+				matches = append(matches, match{path: path, pattern: pattern, location: path})
+				continue
+			}
+
+			// Only a directory that is named explicitly (rather than matched by
+			// a glob) includes every deb file beneath it.
+			if glob.HasMeta(pattern) {
+				slog.Debug("Ignoring directory matched by pattern",
+					slog.String("path", path), slog.String("pattern", pattern))
+				continue
+			}
+
+			if glob.Within(path, skip...) {
+				slog.Debug("Skipping directory", slog.String("path", path))
+				continue
+			}
+
+			debPaths, err := glob.Glob(filepath.Join(path, "**", "*.deb"), skip...)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find deb files in %s: %w", path, err)
+			}
+
+			for _, debPath := range debPaths {
+				matches = append(matches, match{path: debPath, pattern: pattern, location: debPath})
+			}
+		}
+	}
+
+	matches = slices.DeleteFunc(matches, func(m match) bool {
+		return isExcluded(componentConf.Exclude, m.location)
+	})
+
+	return matches, nil
+}
+
+// matchBundlePackages extracts the deb files matching innerPattern from every
+// archive matching archivePattern. Files are only extracted again when an
+// archive changes. Archives within any of the skipped directories are ignored.
+func matchBundlePackages(ctx context.Context, archivePattern, innerPattern string, excludes, skip []string, fetcher *fetch.Fetcher, limits deb.Limits) ([]match, error) {
+	if fetcher == nil {
+		return nil, fmt.Errorf("reading packages from archives is not supported")
+	}
+
+	archivePaths, err := glob.Glob(archivePattern, skip...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find archives for %s: %w", archivePattern, err)
+	}
+
+	var matches []match
+	for _, archivePath := range archivePaths {
+		members, err := bundle.Extract(ctx, archivePath, innerPattern, limits, fetcher, func(name string) bool {
+			return isExcluded(excludes, archivePath+bundle.Separator+name)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range members {
+			matches = append(matches, match{path: member.Path, location: archivePath + bundle.Separator + member.Name})
+		}
+	}
+
+	return matches, nil
+}
+
+// isExcluded returns true if the location matches any of the exclude patterns.
+func isExcluded(excludes []string, location string) bool {
+	return slices.ContainsFunc(excludes, func(pattern string) bool {
+		ok, _ := glob.Match(pattern, location)
+		return ok
+	})
+}
+
+// SourcePatterns returns the local file paths/glob patterns that the
+// component's packages are read from (eg. so they can be watched for changes).
+func SourcePatterns(componentConf v1alpha2.ComponentConfig) []string {
+	var patterns []string
+	for _, pattern := range componentConf.Packages {
+		if archivePattern, _, ok := bundle.Split(pattern); ok {
+			pattern = archivePattern
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns
+}
+
+// fetchPackages downloads the deb files referenced by a component's URLs.
+func fetchPackages(ctx context.Context, componentConf v1alpha2.ComponentConfig, fetcher *fetch.Fetcher, limits deb.Limits) ([]match, error) {
+	if len(componentConf.URLs) > 0 && fetcher == nil {
+		return nil, fmt.Errorf("downloading packages is not supported")
+	}
+
+	var matches []match
+	for _, urlConf := range componentConf.URLs {
+		header, err := fetch.HeaderFromEnv(urlConf.HeadersFromEnv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get headers for %s: %w", urlConf.URL, err)
+		}
+
+		path, err := fetcher.Fetch(ctx, urlConf.URL, urlConf.SHA256, header, limits)
+		if err != nil {
+			return nil, err
+		}
+
+		matches = append(matches, match{path: path, pattern: urlConf.URL, location: urlConf.URL})
+	}
+
+	return matches, nil
+}
+
+// DefaultOCIMediaType is the default media type of OCI layers containing deb
+// files.
+const DefaultOCIMediaType = "application/vnd.debian.binary-package"
+
+// pullPackages pulls the deb files from a component's OCI repositories.
+func pullPackages(ctx context.Context, componentConf v1alpha2.ComponentConfig, fetcher *fetch.Fetcher, limits deb.Limits) ([]match, error) {
+	if len(componentConf.OCI) > 0 && fetcher == nil {
+		return nil, fmt.Errorf("pulling packages is not supported")
+	}
+
+	var matches []match
+	for _, ociConf := range componentConf.OCI {
+		ref, err := oci.ParseReference(ociConf.Repository)
+		if err != nil {
+			return nil, err
+		}
+
+		if ociConf.Tags != "" {
+			if _, err := path.Match(ociConf.Tags, ""); err != nil {
+				return nil, fmt.Errorf("invalid tag pattern for %s: %w", ref, err)
+			}
+		}
+
+		mediaType := ociConf.MediaType
+		if mediaType == "" {
+			mediaType = DefaultOCIMediaType
+		}
+
+		opts := oci.ClientOptions{Insecure: ociConf.Insecure}
+		if ociConf.UsernameFromEnv != "" {
+			opts.Username = os.Getenv(ociConf.UsernameFromEnv)
+		}
+		if ociConf.PasswordFromEnv != "" {
+			opts.Password = os.Getenv(ociConf.PasswordFromEnv)
+		}
+
+		client := oci.NewClient(ref, opts)
+
+		tags, err := client.Tags(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags for %s: %w", ref, err)
+		}
+		sort.Strings(tags)
+
+		for _, tag := range tags {
+			if ociConf.Tags != "" {
+				ok, err := path.Match(ociConf.Tags, tag)
+				if err != nil {
+					return nil, fmt.Errorf("invalid tag pattern for %s: %w", ref, err)
+				}
+
+				if !ok {
+					continue
+				}
+			}
+
+			manifest, err := client.Manifest(ctx, tag)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, layer := range manifest.Layers {
+				if layer.MediaType != mediaType {
+					continue
+				}
+
+				algorithm, sha256, _ := strings.Cut(layer.Digest, ":")
+				if algorithm != "sha256" {
+					return nil, fmt.Errorf("unsupported digest algorithm for %s:%s: %s", ref, tag, layer.Digest)
+				}
+
+				location := fmt.Sprintf("%s:%s@%s", ref, tag, layer.Digest)
+
+				blobPath, err := fetcher.FetchWith(ctx, location, sha256, limits, func(ctx context.Context) (io.ReadCloser, error) {
+					return client.Blob(ctx, layer.Digest)
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				matches = append(matches, match{path: blobPath, pattern: ociConf.Repository, location: location})
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+// packageFilter selects packages based on their control fields.
+// A nil filter matches every package.
+type packageFilter struct {
+	name          *regexp.Regexp
+	constraints   []versionConstraint
+	architectures []string
+	sections      []string
+}
+
+func newPackageFilter(conf *v1alpha2.FilterConfig) (*packageFilter, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	f := &packageFilter{
+		architectures: conf.Architectures,
+		sections:      conf.Sections,
+	}
+
+	if conf.Name != "" {
+		var err error
+		f.name, err = regexp.Compile("^(?:" + conf.Name + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern: %w", err)
+		}
+	}
+
+	if conf.Version != "" {
+		var err error
+		f.constraints, err = parseVersionConstraints(conf.Version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// matches returns true if the package satisfies every field of the filter.
+func (f *packageFilter) matches(pkg *types.Package) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.name != nil && !f.name.MatchString(pkg.Name) {
+		return false
+	}
+
+	for _, c := range f.constraints {
+		if !c.satisfiedBy(pkg.Version) {
+			return false
+		}
+	}
+
+	if len(f.architectures) > 0 && !slices.Contains(f.architectures, pkg.Architecture.String()) {
+		return false
+	}
+
+	if len(f.sections) > 0 && !slices.Contains(f.sections, pkg.Section) {
+		return false
+	}
+
+	return true
+}
+
+// versionConstraint is a relation to a version, eg. ">= 2.0".
+type versionConstraint struct {
+	op      string
+	version version.Version
+}
+
+// Longer operators must come first, so that eg. ">=" isn't parsed as ">".
+var versionOperators = []string{"<<", "<=", ">=", ">>", "!=", "="}
+
+func parseVersionConstraints(s string) ([]versionConstraint, error) {
+	var constraints []versionConstraint
+	for _, constraint := range strings.Split(s, ",") {
+		constraint = strings.TrimSpace(constraint)
+
+		var op string
+		for _, candidate := range versionOperators {
+			if strings.HasPrefix(constraint, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("invalid version constraint %q: expected one of %s",
+				constraint, strings.Join(versionOperators, ", "))
+		}
+
+		v, err := version.Parse(strings.TrimSpace(strings.TrimPrefix(constraint, op)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %w", constraint, err)
+		}
+
+		constraints = append(constraints, versionConstraint{op: op, version: v})
+	}
+
+	return constraints, nil
+}
+
+func (c versionConstraint) satisfiedBy(v version.Version) bool {
+	cmp := v.Compare(c.version)
+
+	switch c.op {
+	case "<<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">=":
+		return cmp >= 0
+	case ">>":
+		return cmp > 0
+	default:
+		return false
+	}
+}
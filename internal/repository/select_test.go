@@ -0,0 +1,259 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
+	"github.com/dpeckett/aptify/internal/deb"
+	"github.com/dpeckett/aptify/internal/fetch"
+	"github.com/dpeckett/aptify/internal/oci"
+	"github.com/dpeckett/aptify/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectPackages(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	repoDir := filepath.Join(dir, "repository")
+
+	writeDeb(t, filepath.Join(dir, "dist"), "hello", "1.0", "amd64", "Section: utils")
+	writeDeb(t, filepath.Join(dir, "dist", "nightly"), "hello", "2.0", "amd64", "Section: utils")
+	writeDeb(t, filepath.Join(dir, "dist", "nightly"), "hello-dbgsym", "2.0", "amd64", "Section: debug")
+	writeDeb(t, filepath.Join(dir, "dist", "nightly"), "world", "1.0", "arm64", "Section: net")
+
+	ids := func(t *testing.T, componentConf v1alpha2.ComponentConfig) []string {
+		conf := singleComponent()
+		conf.Releases[0].Components[0] = componentConf
+
+		resolved, err := Resolve(ctx, conf, ResolveOptions{RepositoryDir: repoDir})
+		require.NoError(t, err)
+
+		var ids []string
+		for _, pkg := range resolved.Releases[0].Components[0].Packages {
+			require.NotContains(t, pkg.Location, repoDir)
+			ids = append(ids, pkg.ID())
+		}
+		return ids
+	}
+
+	// Publish a repository beneath the directory of build artifacts.
+	publishedDir := t.TempDir()
+	writeDeb(t, publishedDir, "published", "1.0", "amd64")
+	build(t, repoDir, singleComponent(filepath.Join(publishedDir, "*.deb")), newPrivateKey(t))
+	_, err := os.Stat(filepath.Join(repoDir, "pool", "main", "p", "published", "published_1.0_amd64.deb"))
+	require.NoError(t, err)
+
+	all := []string{"hello_1.0_amd64", "hello_2.0_amd64", "hello-dbgsym_2.0_amd64", "world_1.0_arm64"}
+
+	t.Run("Recursive", func(t *testing.T) {
+		// The output repository is never searched for deb files.
+		require.ElementsMatch(t, all, ids(t, v1alpha2.ComponentConfig{
+			Name:     "main",
+			Packages: []string{filepath.Join(dir, "**", "*.deb")},
+		}))
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		require.ElementsMatch(t, all, ids(t, v1alpha2.ComponentConfig{
+			Name:     "main",
+			Packages: []string{dir},
+		}))
+
+		// Directories matched by a glob are not searched.
+		require.ElementsMatch(t, []string{"hello_1.0_amd64"}, ids(t, v1alpha2.ComponentConfig{
+			Name:     "main",
+			Packages: []string{filepath.Join(dir, "dist", "*")},
+		}))
+	})
+
+	t.Run("Exclude", func(t *testing.T) {
+		require.ElementsMatch(t, []string{"hello_1.0_amd64", "hello_2.0_amd64", "world_1.0_arm64"}, ids(t, v1alpha2.ComponentConfig{
+			Name:     "main",
+			Packages: []string{filepath.Join(dir, "dist")},
+			Exclude:  []string{filepath.Join("**", "*-dbgsym_*.deb")},
+		}))
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			filter   v1alpha2.FilterConfig
+			expected []string
+		}{
+			{"Name", v1alpha2.FilterConfig{Name: "hello"}, []string{"hello_1.0_amd64", "hello_2.0_amd64"}},
+			{"Version", v1alpha2.FilterConfig{Version: ">= 1.0, << 2.0"}, []string{"hello_1.0_amd64", "world_1.0_arm64"}},
+			{"Architectures", v1alpha2.FilterConfig{Architectures: []string{"arm64"}}, []string{"world_1.0_arm64"}},
+			{"Sections", v1alpha2.FilterConfig{Sections: []string{"utils", "net"}}, []string{"hello_1.0_amd64", "hello_2.0_amd64", "world_1.0_arm64"}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				filter := tt.filter
+				require.ElementsMatch(t, tt.expected, ids(t, v1alpha2.ComponentConfig{
+					Name:     "main",
+					Packages: []string{filepath.Join(dir, "dist")},
+					Filter:   &filter,
+				}))
+			})
+		}
+	})
+
+	t.Run("Invalid Filter", func(t *testing.T) {
+		conf := singleComponent(filepath.Join(dir, "dist"))
+		conf.Releases[0].Components[0].Filter = &v1alpha2.FilterConfig{Version: "~ 1.0"}
+
+		_, err := Resolve(ctx, conf, ResolveOptions{})
+		require.Error(t, err)
+	})
+}
+
+func TestPullPackages(t *testing.T) {
+	ctx := context.Background()
+
+	debsDir := t.TempDir()
+	blobs := make(map[string][]byte)
+	manifests := make(map[string]oci.Manifest)
+	for _, tag := range []string{"1.0", "2.0", "latest"} {
+		data, err := os.ReadFile(writeDeb(t, debsDir, "hello", strings.Replace(tag, "latest", "3.0", 1), "amd64"))
+		require.NoError(t, err)
+
+		sum := sha256.Sum256(data)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		blobs[digest] = data
+
+		manifests[tag] = oci.Manifest{
+			MediaType: oci.MediaTypeImageManifest,
+			Layers: []oci.Descriptor{
+				{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: "sha256:" + strings.Repeat("0", 64)},
+				{MediaType: DefaultOCIMediaType, Digest: digest, Size: int64(len(data))},
+			},
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _ := strings.CutPrefix(r.URL.Path, "/v2/team/debs/")
+		switch {
+		case name == "tags/list":
+			_ = json.NewEncoder(w).Encode(map[string]any{"tags": []string{"latest", "2.0", "1.0"}})
+		case strings.HasPrefix(name, "manifests/"):
+			_ = json.NewEncoder(w).Encode(manifests[strings.TrimPrefix(name, "manifests/")])
+		case strings.HasPrefix(name, "blobs/"):
+			blob, ok := blobs[strings.TrimPrefix(name, "blobs/")]
+			if !ok {
+				// Only layers with the deb media type should be pulled.
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	componentConf := v1alpha2.ComponentConfig{
+		Name: "main",
+		OCI: []v1alpha2.OCIConfig{{
+			Repository: strings.TrimPrefix(srv.URL, "http://") + "/team/debs",
+			Tags:       "[0-9]*",
+			Insecure:   true,
+		}},
+	}
+
+	fetcher := fetch.NewFetcher(t.TempDir(), nil)
+
+	matches, err := pullPackages(ctx, componentConf, fetcher, deb.DefaultLimits)
+	require.NoError(t, err)
+
+	var locations []string
+	for _, m := range matches {
+		locations = append(locations, strings.TrimPrefix(m.location, componentConf.OCI[0].Repository))
+	}
+	require.Len(t, locations, 2)
+	require.True(t, strings.HasPrefix(locations[0], ":1.0@sha256:"))
+	require.True(t, strings.HasPrefix(locations[1], ":2.0@sha256:"))
+
+	t.Run("Invalid Tag Pattern", func(t *testing.T) {
+		componentConf := componentConf
+		componentConf.OCI = []v1alpha2.OCIConfig{componentConf.OCI[0]}
+		componentConf.OCI[0].Tags = "[0-9"
+
+		_, err := pullPackages(ctx, componentConf, fetcher, deb.DefaultLimits)
+		require.ErrorContains(t, err, "invalid tag pattern")
+	})
+}
+
+func TestBundlePackages(t *testing.T) {
+	debsDir := t.TempDir()
+
+	var files []testutil.File
+	for _, name := range []string{"hello", "hello-dbgsym"} {
+		data, err := os.ReadFile(writeDeb(t, debsDir, name, "1.0", "amd64"))
+		require.NoError(t, err)
+
+		files = append(files, testutil.File{Name: "debs/" + name + "_1.0_amd64.deb", Body: data})
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "artifacts.tar.gz")
+	require.NoError(t, os.WriteFile(archivePath, testutil.TarGz(t, files), 0o644))
+
+	conf := singleComponent(archivePath + "!/**/*.deb")
+	conf.Releases[0].Components[0].Exclude = []string{"**/*-dbgsym_*.deb"}
+
+	resolved, err := Resolve(context.Background(), conf, ResolveOptions{Fetcher: fetch.NewFetcher(t.TempDir(), nil)})
+	require.NoError(t, err)
+
+	packages := resolved.Releases[0].Components[0].Packages
+	require.Len(t, packages, 1)
+	require.Equal(t, "hello_1.0_amd64", packages[0].ID())
+	require.Equal(t, archivePath+"!/debs/hello_1.0_amd64.deb", packages[0].Location)
+	require.Equal(t, archivePath+"!/**/*.deb", packages[0].Pattern)
+
+	t.Run("Repository Directory", func(t *testing.T) {
+		// Archives within the output repository are never read.
+		conf := singleComponent(filepath.Join(filepath.Dir(archivePath), "*.tar.gz") + "!/**/*.deb")
+
+		resolved, err := Resolve(context.Background(), conf, ResolveOptions{
+			Fetcher:       fetch.NewFetcher(t.TempDir(), nil),
+			RepositoryDir: filepath.Dir(archivePath),
+		})
+		require.NoError(t, err)
+		require.Empty(t, resolved.Releases[0].Components[0].Packages)
+	})
+
+	t.Run("Decompression Bomb", func(t *testing.T) {
+		conf := singleComponent(archivePath + "!/**/*.deb")
+		conf.Settings.Limits = &v1alpha2.LimitsConfig{MaxDataSize: 1}
+
+		_, err := Resolve(context.Background(), conf, ResolveOptions{Fetcher: fetch.NewFetcher(t.TempDir(), nil)})
+		require.ErrorContains(t, err, "exceeds the data size limit")
+	})
+}
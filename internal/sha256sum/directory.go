@@ -19,6 +19,7 @@
 package sha256sum
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -27,7 +28,7 @@ import (
 )
 
 // Directory returns the sha256sum of all files in a directory.
-func Directory(dir string) ([]filehash.FileHash, error) {
+func Directory(ctx context.Context, dir string) ([]filehash.FileHash, error) {
 	var hashes []filehash.FileHash
 	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
@@ -38,7 +39,7 @@ func Directory(dir string) ([]filehash.FileHash, error) {
 			return nil
 		}
 
-		sum, err := File(path)
+		sum, err := File(ctx, path)
 		if err != nil {
 			return err
 		}
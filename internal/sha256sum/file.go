@@ -19,15 +19,18 @@
 package sha256sum
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/dpeckett/aptify/internal/util"
 )
 
 // File returns the sha256sum of a file.
-func File(path string) (string, error) {
+func File(ctx context.Context, path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return "", fmt.Errorf("failed to open file: %w", err)
@@ -35,7 +38,7 @@ func File(path string) (string, error) {
 	defer f.Close()
 
 	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	if _, err := io.Copy(h, util.NewContextReader(ctx, f)); err != nil {
 		return "", fmt.Errorf("failed to hash file: %w", err)
 	}
 
@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package testutil provides helpers for tests.
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// File is a file within an archive.
+type File struct {
+	// Name is the path of the file within the archive.
+	Name string
+	// Mode is the permissions (and type) of the file, defaults to 0o644 (or
+	// 0o755 for directories).
+	Mode int64
+	// Typeflag is the tar type of the file, defaults to a regular file.
+	Typeflag byte
+	// Body is the contents of the file.
+	Body []byte
+	// Linkname is the target of a link.
+	Linkname string
+}
+
+// Deb describes a deb file.
+type Deb struct {
+	// Control is the contents of the control file.
+	Control string
+	// Files is the contents of the data archive.
+	Files []File
+	// DataArchive overrides the (gzip compressed) data archive.
+	DataArchive []byte
+}
+
+// Control returns a control file for a package with the given name, version
+// and architecture, along with any additional fields.
+func Control(name, version, architecture string, fields ...string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Package: %s\nVersion: %s\nArchitecture: %s\nMaintainer: Test <test@example.com>\nDescription: Test package\n", name, version, architecture)
+	for _, field := range fields {
+		sb.WriteString(field + "\n")
+	}
+
+	return sb.String()
+}
+
+// WriteDeb writes a deb file to path, and returns the path.
+func WriteDeb(t testing.TB, path string, deb Deb) string {
+	t.Helper()
+
+	controlArchive := TarGz(t, []File{{Name: "./control", Body: []byte(deb.Control)}})
+
+	dataArchive := deb.DataArchive
+	if dataArchive == nil {
+		dataArchive = TarGz(t, deb.Files)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlArchive},
+		{"data.tar.gz", dataArchive},
+	} {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", member.name, 0, 0, 0, "100644", len(member.data))
+		buf.Write(member.data)
+		if len(member.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+
+	return path
+}
+
+// Tar returns an (uncompressed) tar archive containing the given files.
+func Tar(t testing.TB, files []File) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.Name,
+			Mode:     f.Mode,
+			Typeflag: f.Typeflag,
+			Size:     int64(len(f.Body)),
+			Linkname: f.Linkname,
+			ModTime:  time.Unix(0, 0),
+		}
+
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Mode = 0o755
+			}
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr))
+
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(f.Body)
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+// TarGz returns a gzip compressed tar archive containing the given files.
+func TarGz(t testing.TB, files []File) []byte {
+	t.Helper()
+
+	return Gzip(t, Tar(t, files))
+}
+
+// Gzip returns the gzip compressed data.
+func Gzip(t testing.TB, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+
+	_, err := gw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	return buf.Bytes()
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// BuildDate returns the date to stamp build outputs with. An explicit date
+// (in RFC 3339 format) takes precedence, followed by the SOURCE_DATE_EPOCH
+// environment variable (see https://reproducible-builds.org/specs/source-date-epoch/),
+// otherwise the current time is used.
+func BuildDate(date string) (time.Time, error) {
+	if date != "" {
+		t, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse date: %w", err)
+		}
+
+		return t.UTC(), nil
+	}
+
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse SOURCE_DATE_EPOCH: %w", err)
+		}
+
+		return time.Unix(secs, 0).UTC(), nil
+	}
+
+	return time.Now().UTC(), nil
+}
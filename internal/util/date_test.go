@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildDate(t *testing.T) {
+	t.Run("Explicit", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "0")
+
+		date, err := BuildDate("2024-06-01T12:00:00+02:00")
+		require.NoError(t, err)
+		require.Equal(t, time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC), date)
+	})
+
+	t.Run("SOURCE_DATE_EPOCH", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "1717243200")
+
+		date, err := BuildDate("")
+		require.NoError(t, err)
+		require.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), date)
+	})
+
+	t.Run("Now", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "")
+
+		date, err := BuildDate("")
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now(), date, time.Minute)
+		require.Equal(t, time.UTC, date.Location())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := BuildDate("yesterday")
+		require.Error(t, err)
+
+		t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+
+		_, err = BuildDate("")
+		require.Error(t, err)
+	})
+}
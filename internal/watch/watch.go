@@ -0,0 +1,277 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package watch
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/aptify/internal/glob"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Options configures a watch.
+type Options struct {
+	// Debounce is how long to wait for a burst of changes to settle before
+	// running the function.
+	Debounce time.Duration
+	// Patterns returns the list of file paths/glob patterns to watch. It is
+	// evaluated again after every run, so that the watched paths can change.
+	Patterns func() []string
+	// Exclude is a list of directories that are never watched (along with
+	// everything beneath them), eg. the output repository.
+	Exclude []string
+}
+
+// Run calls fn once, and then again every time a file matching one of the
+// watched patterns changes, until the context is cancelled. Errors returned by
+// fn are logged, but do not stop the watch.
+func Run(ctx context.Context, opts Options, fn func(changed []string) error) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	run := func(changed []string) []string {
+		if err := fn(changed); err != nil && ctx.Err() == nil {
+			slog.Error("Build failed", slog.Any("error", err))
+		}
+
+		patterns := opts.Patterns()
+		updateWatches(watcher, patterns, opts.Exclude)
+
+		slog.Info("Watching for changes")
+
+		return patterns
+	}
+
+	patterns := run(nil)
+
+	changed := make(map[string]bool)
+	timer := time.NewTimer(opts.Debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if event.Has(fsnotify.Chmod) || glob.Within(event.Name, opts.Exclude...) || !matchesAny(patterns, event.Name) {
+				continue
+			}
+
+			slog.Debug("File changed", slog.String("path", event.Name), slog.String("op", event.Op.String()))
+
+			changed[event.Name] = true
+			timer.Reset(opts.Debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			slog.Warn("Watcher error", slog.Any("error", err))
+		case <-timer.C:
+			paths := make([]string, 0, len(changed))
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+
+			clear(changed)
+
+			patterns = run(paths)
+		}
+	}
+}
+
+// updateWatches watches the directories that contain the given patterns (and
+// stops watching any directories that are no longer needed). Recursive
+// patterns, and directories, are watched along with all their subdirectories
+// (other than any excluded directories).
+func updateWatches(watcher *fsnotify.Watcher, patterns, excludes []string) {
+	dirs := make(map[string]bool)
+	for _, pattern := range patterns {
+		root, ok := recursiveRoot(pattern)
+		if !ok {
+			dirs[existingDir(glob.Base(pattern))] = true
+
+			// Wildcards in the directory part of the pattern (eg. dist/*/*.deb)
+			// are expanded, so that every matching directory is watched. This
+			// is repeated after every run, so newly created directories are
+			// picked up too.
+			for _, dirPattern := range dirPatterns(pattern) {
+				matches, _ := filepath.Glob(dirPattern)
+				for _, match := range matches {
+					if fi, err := os.Stat(match); err == nil && fi.IsDir() {
+						dirs[match] = true
+					}
+				}
+			}
+
+			continue
+		}
+
+		dirs[existingDir(root)] = true
+
+		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+
+			if glob.Within(path, excludes...) {
+				return filepath.SkipDir
+			}
+
+			dirs[path] = true
+
+			return nil
+		})
+	}
+
+	for dir := range dirs {
+		if glob.Within(dir, excludes...) {
+			delete(dirs, dir)
+		}
+	}
+
+	for _, dir := range watcher.WatchList() {
+		if !dirs[dir] {
+			if err := watcher.Remove(dir); err != nil {
+				slog.Debug("Failed to stop watching directory", slog.String("dir", dir), slog.Any("error", err))
+			}
+		}
+	}
+
+	watched := make(map[string]bool)
+	for _, dir := range watcher.WatchList() {
+		watched[dir] = true
+	}
+
+	for dir := range dirs {
+		if watched[dir] {
+			continue
+		}
+
+		slog.Debug("Watching directory", slog.String("dir", dir))
+
+		if err := watcher.Add(dir); err != nil {
+			slog.Warn("Failed to watch directory", slog.String("dir", dir), slog.Any("error", err))
+		}
+	}
+}
+
+// recursiveRoot returns the directory tree that needs to be watched for a
+// recursive pattern, or a pattern that refers to a directory.
+func recursiveRoot(pattern string) (string, bool) {
+	if glob.IsRecursive(pattern) {
+		return glob.Base(pattern), true
+	}
+
+	if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+		return filepath.Clean(pattern), true
+	}
+
+	return "", false
+}
+
+// dirPatterns returns the directory part of a pattern, along with each of its
+// ancestors that contain glob meta characters, eg. "a/*/b/*.deb" returns
+// "a/*/b" and "a/*".
+func dirPatterns(pattern string) []string {
+	var patterns []string
+	for dir := filepath.Dir(filepath.Clean(pattern)); glob.HasMeta(dir); dir = filepath.Dir(dir) {
+		patterns = append(patterns, dir)
+	}
+
+	return patterns
+}
+
+// existingDir returns the closest existing ancestor of dir (so that the
+// creation of the directory itself can be observed).
+func existingDir(dir string) string {
+	for {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// matchesAny returns true if the path matches any of the patterns, is within
+// a watched directory tree, or is a directory that leads to a pattern.
+func matchesAny(patterns []string, path string) bool {
+	path = filepath.Clean(path)
+
+	for _, pattern := range patterns {
+		pattern = filepath.Clean(pattern)
+
+		if ok, _ := glob.Match(pattern, path); ok || path == pattern {
+			return true
+		}
+
+		if root, ok := recursiveRoot(pattern); ok && strings.HasPrefix(path, root+string(filepath.Separator)) {
+			// Anything beneath a directory source might be a deb file, whereas
+			// recursive patterns only need to know about new subdirectories.
+			if !glob.IsRecursive(pattern) {
+				return true
+			}
+
+			if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+				return true
+			}
+		}
+
+		// A directory on the way to a pattern was created or removed.
+		base := glob.Base(pattern)
+		if strings.HasPrefix(base, path+string(filepath.Separator)) || base == path {
+			return true
+		}
+
+		// A directory matching a wildcard in the directory part of a pattern
+		// was created.
+		if !glob.IsRecursive(pattern) {
+			for _, dirPattern := range dirPatterns(pattern) {
+				if ok, _ := glob.Match(dirPattern, path); ok {
+					if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
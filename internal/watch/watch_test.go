@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	repoDir := filepath.Join(dir, "repository")
+	require.NoError(t, os.MkdirAll(filepath.Join(repoDir, "pool"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "dist"), 0o755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	runs := make(chan []string, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, Options{
+			Debounce: 50 * time.Millisecond,
+			Patterns: func() []string {
+				return []string{filepath.Join(dir, "**", "*.deb")}
+			},
+			Exclude: []string{repoDir},
+		}, func(changed []string) error {
+			runs <- changed
+			return nil
+		})
+	}()
+
+	require.Empty(t, <-runs)
+
+	// Writes to the output repository are ignored.
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "pool", "hello_1.0_amd64.deb"), nil, 0o644))
+
+	// A burst of changes results in a single run.
+	for _, name := range []string{"hello_1.0_amd64.deb", "world_1.0_amd64.deb", "README"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "dist", name), nil, 0o644))
+	}
+
+	select {
+	case changed := <-runs:
+		require.Equal(t, []string{
+			filepath.Join(dir, "dist", "hello_1.0_amd64.deb"),
+			filepath.Join(dir, "dist", "world_1.0_amd64.deb"),
+		}, changed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a rebuild")
+	}
+
+	select {
+	case changed := <-runs:
+		t.Fatalf("unexpected rebuild: %v", changed)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestUpdateWatches(t *testing.T) {
+	dir := t.TempDir()
+	repoDir := filepath.Join(dir, "repository")
+	for _, subdir := range []string{"a/b", "c", "repository/pool/main"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, subdir), 0o755))
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = watcher.Close()
+	})
+
+	watchList := func() []string {
+		list := watcher.WatchList()
+		sort.Strings(list)
+		return list
+	}
+
+	t.Run("Recursive", func(t *testing.T) {
+		updateWatches(watcher, []string{filepath.Join(dir, "**", "*.deb")}, []string{repoDir})
+
+		require.Equal(t, []string{
+			dir,
+			filepath.Join(dir, "a"),
+			filepath.Join(dir, "a", "b"),
+			filepath.Join(dir, "c"),
+		}, watchList())
+	})
+
+	t.Run("Wildcard Directory", func(t *testing.T) {
+		updateWatches(watcher, []string{filepath.Join(dir, "*", "*.deb")}, []string{repoDir})
+
+		require.Equal(t, []string{
+			dir,
+			filepath.Join(dir, "a"),
+			filepath.Join(dir, "c"),
+		}, watchList())
+
+		// Newly created directories are watched once the patterns are expanded
+		// again.
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "d"), 0o755))
+
+		updateWatches(watcher, []string{filepath.Join(dir, "*", "*.deb")}, []string{repoDir})
+
+		require.Equal(t, []string{
+			dir,
+			filepath.Join(dir, "a"),
+			filepath.Join(dir, "c"),
+			filepath.Join(dir, "d"),
+		}, watchList())
+	})
+
+	t.Run("Missing Directory", func(t *testing.T) {
+		updateWatches(watcher, []string{filepath.Join(dir, "missing", "*.deb")}, []string{repoDir})
+
+		// The closest existing ancestor is watched instead.
+		require.Equal(t, []string{dir}, watchList())
+	})
+}
+
+func TestMatchesAny(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "src", "sub"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "dist", "amd64"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "dist", "README"), nil, 0o644))
+
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		expected bool
+	}{
+		{"Glob", []string{filepath.Join(dir, "*.deb")}, filepath.Join(dir, "hello.deb"), true},
+		{"Not Matching", []string{filepath.Join(dir, "*.deb")}, filepath.Join(dir, "README"), false},
+		{"Directory Source", []string{filepath.Join(dir, "src")}, filepath.Join(dir, "src", "sub", "hello.deb"), true},
+		{"Recursive Subdirectory", []string{filepath.Join(dir, "**", "*.deb")}, filepath.Join(dir, "src", "sub"), true},
+		{"Leading Directory", []string{filepath.Join(dir, "missing", "*.deb")}, filepath.Join(dir, "missing"), true},
+		{"Wildcard Directory", []string{filepath.Join(dir, "dist", "*", "*.deb")}, filepath.Join(dir, "dist", "amd64"), true},
+		{"Wildcard Directory File", []string{filepath.Join(dir, "dist", "*", "*.deb")}, filepath.Join(dir, "dist", "README"), false},
+		{"Wildcard Directory Match", []string{filepath.Join(dir, "dist", "*", "*.deb")}, filepath.Join(dir, "dist", "amd64", "hello.deb"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, matchesAny(tt.patterns, tt.path))
+		})
+	}
+}
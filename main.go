@@ -21,34 +21,39 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strings"
-	stdtime "time"
+	"syscall"
+	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/adrg/xdg"
 	"github.com/dpeckett/aptify/internal/config"
-	"github.com/dpeckett/aptify/internal/config/v1alpha1"
+	"github.com/dpeckett/aptify/internal/config/v1alpha2"
 	"github.com/dpeckett/aptify/internal/constants"
 	"github.com/dpeckett/aptify/internal/deb"
-	"github.com/dpeckett/aptify/internal/sha256sum"
+	"github.com/dpeckett/aptify/internal/fetch"
+	"github.com/dpeckett/aptify/internal/gc"
+	"github.com/dpeckett/aptify/internal/lint"
+	"github.com/dpeckett/aptify/internal/lockfile"
+	"github.com/dpeckett/aptify/internal/pool"
+	"github.com/dpeckett/aptify/internal/provenance"
+	"github.com/dpeckett/aptify/internal/publish"
+	"github.com/dpeckett/aptify/internal/repolock"
+	"github.com/dpeckett/aptify/internal/report"
+	"github.com/dpeckett/aptify/internal/repository"
 	"github.com/dpeckett/aptify/internal/util"
-	"github.com/dpeckett/deb822"
-	"github.com/dpeckett/deb822/types"
-	"github.com/dpeckett/deb822/types/arch"
-	"github.com/dpeckett/deb822/types/list"
-	"github.com/dpeckett/deb822/types/time"
+	"github.com/dpeckett/aptify/internal/watch"
 	"github.com/dpeckett/telemetry"
 	telemetryv1alpha1 "github.com/dpeckett/telemetry/v1alpha1"
-	"github.com/dpeckett/uncompr"
-	cp "github.com/otiai10/copy"
 	"github.com/urfave/cli/v2"
 )
 
@@ -91,6 +96,41 @@ func main() {
 		return nil
 	}
 
+	gcFlags := []cli.Flag{
+		&cli.IntFlag{
+			Name:  "keep-generations",
+			Usage: "Number of published generations to keep for rollback",
+			Value: publish.DefaultKeepGenerations,
+		},
+		&cli.DurationFlag{
+			Name:  "grace-period",
+			Usage: "How long to keep superseded generations (and the pool files they reference)",
+		},
+	}
+
+	lockTimeoutFlag := &cli.DurationFlag{
+		Name:  "lock-timeout",
+		Usage: "How long to wait for another process to release the repository lock",
+		Value: time.Minute,
+	}
+
+	cacheDirFlag := &cli.StringFlag{
+		Name:    "cache-dir",
+		EnvVars: []string{"CACHE_DIR"},
+		Usage:   "Directory to cache downloaded packages in",
+		Value:   filepath.Join(xdg.CacheHome, "aptify"),
+	}
+
+	lockfileFlag := &cli.StringFlag{
+		Name:  "lockfile",
+		Usage: "Path to the lockfile (defaults to " + lockfile.DefaultName + " alongside the configuration file)",
+	}
+
+	setFlag := &cli.StringSliceFlag{
+		Name:  "set",
+		Usage: "Set a configuration variable (NAME=value), overriding the environment",
+	}
+
 	// Collect anonymized usage statistics.
 	var telemetryReporter *telemetry.Reporter
 
@@ -128,7 +168,7 @@ func main() {
 		})
 
 		// Don't want to block the shutdown of the application for too long.
-		ctx, cancel := context.WithTimeout(context.Background(), 3*stdtime.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 		defer cancel()
 
 		if err := telemetryReporter.Shutdown(ctx); err != nil {
@@ -165,7 +205,7 @@ func main() {
 				Action: func(c *cli.Context) error {
 					entityConfig := &packet.Config{
 						RSABits: 4096,
-						Time:    stdtime.Now,
+						Time:    time.Now,
 					}
 
 					slog.Info("Generating RSA key")
@@ -208,344 +248,856 @@ func main() {
 					&cli.StringFlag{
 						Name:     "config",
 						Aliases:  []string{"c"},
-						Usage:    "Configuration file",
+						Usage:    "Configuration file (or directory of configuration files)",
 						Required: true,
 					},
+					setFlag,
 					&cli.StringFlag{
 						Name:    "repository-dir",
 						Aliases: []string{"d"},
 						Usage:   "Directory to store the repository",
 						Value:   "repository",
 					},
-				}, persistentFlags...),
+					&cli.BoolFlag{
+						Name:  "prune",
+						Usage: "Remove files that are no longer referenced after building",
+					},
+					&cli.StringFlag{
+						Name:  "date",
+						Usage: "Date to stamp releases with (RFC 3339), defaults to $SOURCE_DATE_EPOCH or the current time",
+					},
+					&cli.BoolFlag{
+						Name:  "plan",
+						Usage: "Report the changes a build would make, without modifying the repository",
+					},
+					&cli.BoolFlag{
+						Name:  "locked",
+						Usage: "Fail if the resolved packages differ from those recorded in the lockfile",
+					},
+					&cli.BoolFlag{
+						Name:  "lint",
+						Usage: "Check packages for common mistakes before building (always enabled if configured)",
+					},
+					lockfileFlag,
+					cacheDirFlag,
+					&cli.StringFlag{
+						Name:  "plan-format",
+						Usage: "Format of the plan output (text or json)",
+						Value: "text",
+					},
+					&cli.StringFlag{
+						Name:  "report",
+						Usage: "Write a JSON report describing the build to the given path",
+					},
+					&cli.BoolFlag{
+						Name:  "watch",
+						Usage: "Rebuild the repository whenever the configuration or packages change",
+					},
+					&cli.DurationFlag{
+						Name:  "watch-debounce",
+						Usage: "How long to wait for changes to settle before rebuilding",
+						Value: 500 * time.Millisecond,
+					},
+					lockTimeoutFlag,
+				}, append(gcFlags, persistentFlags...)...),
 				Before: util.BeforeAll(initLogger, initConfDir, initTelemetry),
 				After:  shutdownTelemetry,
 				Action: func(c *cli.Context) error {
-					repoDir := c.String("repository-dir")
+					cache := repository.NewCache()
+
+					if !c.Bool("watch") {
+						_, err := buildRepository(c, cache)
+						return err
+					}
 
-					slog.Info("Building repository", slog.String("dir", repoDir))
+					var previous *repository.Resolved
+					return watch.Run(c.Context, watch.Options{
+						Debounce: c.Duration("watch-debounce"),
+						// Don't rebuild in response to our own output.
+						Exclude: []string{c.String("repository-dir")},
+						Patterns: func() []string {
+							patterns := []string{c.String("config")}
+
+							conf, files, err := loadConfig(c)
+							if err != nil {
+								return patterns
+							}
+							patterns = append(patterns, files...)
+
+							for _, releaseConf := range conf.Releases {
+								for _, componentConf := range releaseConf.Components {
+									patterns = append(patterns, repository.SourcePatterns(componentConf)...)
+								}
+							}
+
+							return patterns
+						},
+					}, func(changed []string) error {
+						if len(changed) > 0 {
+							slog.Info("Rebuilding repository", slog.Any("changed", changed))
+						}
+
+						resolved, err := buildRepository(c, cache)
+						if err != nil {
+							return err
+						}
 
-					privateKeyPath := filepath.Join(c.String("config-dir"), "aptify_private.asc")
+						if previous != nil {
+							changes := repository.DiffPackages(previous, resolved)
+							for _, change := range changes {
+								slog.Info("Package changed",
+									slog.String("action", string(change.Action)),
+									slog.String("release", change.Release),
+									slog.String("component", change.Component),
+									slog.String("arch", change.Architecture),
+									slog.String("name", change.Name),
+									slog.String("version", change.Version),
+									slog.String("previousVersion", change.PreviousVersion))
+							}
+
+							slog.Info("Rebuild complete", slog.Int("packageChanges", len(changes)))
+						}
+						previous = resolved
 
-					return buildRepository(
-						repoDir,
-						c.String("config"),
-						privateKeyPath,
-					)
+						return nil
+					})
 				},
 			},
-		},
-	}
+			{
+				Name:  "lock",
+				Usage: "Record the exact package files resolved by a configuration file in a lockfile",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "config",
+						Aliases:  []string{"c"},
+						Usage:    "Configuration file (or directory of configuration files)",
+						Required: true,
+					},
+					setFlag,
+					&cli.StringFlag{
+						Name:    "repository-dir",
+						Aliases: []string{"d"},
+						Usage:   "Directory of the published repository, used to determine when packages were first added (for retention policies)",
+						Value:   "repository",
+					},
+					&cli.StringFlag{
+						Name:  "date",
+						Usage: "Date to measure package ages against (RFC 3339), defaults to $SOURCE_DATE_EPOCH or the current time",
+					},
+					lockfileFlag,
+					cacheDirFlag,
+				}, persistentFlags...),
+				Before: util.BeforeAll(initLogger, initTelemetry),
+				After:  shutdownTelemetry,
+				Action: func(c *cli.Context) error {
+					conf, _, err := loadConfig(c)
+					if err != nil {
+						return err
+					}
 
-	if err := app.Run(os.Args); err != nil {
-		slog.Error("Error", slog.Any("error", err))
-		os.Exit(1)
-	}
-}
+					date, err := util.BuildDate(c.String("date"))
+					if err != nil {
+						return err
+					}
 
-func buildRepository(repoDir, confPath, privateKeyPath string) error {
-	if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
-		return fmt.Errorf("private key not found; run 'aptify init-keys' to generate one")
-	}
+					previous, err := provenance.Read(filepath.Join(c.String("repository-dir"), "dists", provenance.ManifestName))
+					if err != nil {
+						return err
+					}
 
-	privateKey, err := loadPrivateKey(privateKeyPath)
-	if err != nil {
-		return fmt.Errorf("failed to read private key: %w", err)
-	}
+					resolved, err := repository.Resolve(c.Context, conf, repository.ResolveOptions{
+						Fetcher:       fetch.NewFetcher(c.String("cache-dir"), nil),
+						RepositoryDir: c.String("repository-dir"),
+						Date:          date,
+						Provenance:    previous,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to resolve packages: %w", err)
+					}
 
-	confFile, err := os.Open(confPath)
-	if err != nil {
-		return fmt.Errorf("failed to open config file: %w", err)
-	}
-	defer confFile.Close()
+					lf := lockfile.FromResolved(resolved)
 
-	conf, err := config.FromYAML(confFile)
-	if err != nil {
-		return fmt.Errorf("failed to read config: %w", err)
-	}
+					lockfilePath := lockfilePath(c)
+					if err := lf.WriteFile(lockfilePath); err != nil {
+						return err
+					}
 
-	packagesForReleaseComponent := make(map[string][]types.Package)
-	archsForReleaseComponent := make(map[string]map[string]bool)
-	pkgPoolPaths := make(map[string]string)
+					slog.Info("Wrote lockfile",
+						slog.String("path", lockfilePath), slog.Int("packages", len(lf.Packages)))
 
-	// Copy packages to the pool directory.
-	for _, releaseConf := range conf.Releases {
-		for _, componentConf := range releaseConf.Components {
-			releaseComponent := fmt.Sprintf("%s/%s", releaseConf.Name, componentConf.Name)
+					return nil
+				},
+			},
+			{
+				Name:      "lint",
+				Usage:     "Check packages for common mistakes",
+				ArgsUsage: "[deb files...]",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Usage:   "Configuration file (or directory of configuration files), every package it references is checked",
+					},
+					setFlag,
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "Format of the output (text or json)",
+						Value: "text",
+					},
+					cacheDirFlag,
+				}, persistentFlags...),
+				Before: util.BeforeAll(initLogger, initTelemetry),
+				After:  shutdownTelemetry,
+				Action: func(c *cli.Context) error {
+					if c.String("config") == "" && c.NArg() == 0 {
+						return fmt.Errorf("either a configuration file or deb files must be specified")
+					}
 
-			for _, pattern := range componentConf.Packages {
-				matches, err := filepath.Glob(pattern)
-				if err != nil {
-					return fmt.Errorf("failed to find deb files for %s: %w", pattern, err)
-				}
+					var lintConf *v1alpha2.LintConfig
+					var resolved *repository.Resolved
+					limits := deb.DefaultLimits
+					if c.String("config") != "" {
+						conf, _, err := loadConfig(c)
+						if err != nil {
+							return err
+						}
+						lintConf = conf.Settings.Lint
+
+						// Packages with invalid control fields are reported as
+						// findings, rather than failing the resolve.
+						resolved, err = repository.Resolve(c.Context, conf, repository.ResolveOptions{
+							Fetcher:     fetch.NewFetcher(c.String("cache-dir"), nil),
+							SkipInvalid: true,
+						})
+						if err != nil {
+							return fmt.Errorf("failed to resolve packages: %w", err)
+						}
 
-				for _, pkgPath := range matches {
-					pkg, err := deb.GetMetadata(pkgPath)
-					if err != nil {
-						return fmt.Errorf("failed to get package metadata: %w", err)
+						// Deb files given on the command line are read with the
+						// configured limits.
+						limits = resolved.Limits()
 					}
 
-					pkg.SHA256, err = sha256sum.File(pkgPath)
+					linter, err := lint.NewLinter(lintConf)
 					if err != nil {
-						return fmt.Errorf("failed to hash package: %w", err)
+						return fmt.Errorf("invalid lint configuration: %w", err)
 					}
 
-					if _, ok := archsForReleaseComponent[releaseComponent]; !ok {
-						archsForReleaseComponent[releaseComponent] = make(map[string]bool)
+					var findings []lint.Finding
+					if resolved != nil {
+						findings, err = linter.LintResolved(c.Context, resolved)
+						if err != nil {
+							return err
+						}
 					}
-					archsForReleaseComponent[releaseComponent][pkg.Architecture.String()] = true
 
-					// Only copy each deb file once.
-					// Use the component name from the first release that includes the package.
-					if existingPoolPath, ok := pkgPoolPaths[pkgPath]; !ok {
-						pkg.Filename = poolPathForPackage(componentConf.Name, pkg)
-
-						if err := os.MkdirAll(filepath.Dir(filepath.Join(repoDir, pkg.Filename)), 0o755); err != nil {
-							return fmt.Errorf("failed to create pool subdirectory: %w", err)
+					for _, path := range c.Args().Slice() {
+						fileFindings, err := linter.LintFile(c.Context, path, limits)
+						if err != nil {
+							return err
 						}
 
-						if err := cp.Copy(pkgPath, filepath.Join(repoDir, pkg.Filename)); err != nil {
-							return fmt.Errorf("failed to copy package: %w", err)
+						findings = append(findings, fileFindings...)
+					}
+
+					switch c.String("format") {
+					case "json":
+						enc := json.NewEncoder(os.Stdout)
+						enc.SetIndent("", "  ")
+						if err := enc.Encode(findings); err != nil {
+							return err
 						}
+					case "text":
+						for _, finding := range findings {
+							fmt.Println(finding)
+						}
+					default:
+						return fmt.Errorf("unsupported format: %s", c.String("format"))
+					}
 
-						pkgPoolPaths[pkgPath] = pkg.Filename
-					} else {
-						pkg.Filename = existingPoolPath
+					if lint.HasErrors(findings) {
+						return fmt.Errorf("lint failed")
 					}
 
-					// Get the size of the package file.
-					fi, err := os.Stat(filepath.Join(repoDir, pkg.Filename))
+					return nil
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Manage configuration files",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "validate",
+						Usage:     "Check configuration files for mistakes",
+						ArgsUsage: "<config files...>",
+						Flags:     append([]cli.Flag{setFlag}, persistentFlags...),
+						Before:    util.BeforeAll(initLogger, initTelemetry),
+						After:     shutdownTelemetry,
+						Action: func(c *cli.Context) error {
+							if c.NArg() == 0 {
+								return fmt.Errorf("no configuration files specified")
+							}
+
+							lookupVar, err := configLookup(c)
+							if err != nil {
+								return err
+							}
+
+							var errorCount int
+							for _, path := range c.Args().Slice() {
+								n, err := validateConfig(path, lookupVar)
+								if err != nil {
+									return err
+								}
+								errorCount += n
+							}
+
+							if errorCount > 0 {
+								return fmt.Errorf("configuration is invalid (%d error(s))", errorCount)
+							}
+
+							return nil
+						},
+					},
+					{
+						Name:  "schema",
+						Usage: "Print the JSON Schema of the configuration file (eg. for editor autocompletion)",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:  "api-version",
+								Usage: "API version of the schema",
+								Value: v1alpha2.APIVersion,
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initTelemetry),
+						After:  shutdownTelemetry,
+						Action: func(c *cli.Context) error {
+							versionedConf, err := config.GetConfigByAPIVersion(c.String("api-version"), "Repository")
+							if err != nil {
+								return err
+							}
+
+							schema, err := config.JSONSchema(versionedConf)
+							if err != nil {
+								return err
+							}
+
+							_, err = os.Stdout.Write(schema)
+							return err
+						},
+					},
+					{
+						Name:      "migrate",
+						Usage:     "Rewrite configuration files using the latest schema version",
+						ArgsUsage: "<config files...>",
+						Flags: append([]cli.Flag{
+							&cli.BoolFlag{
+								Name:  "stdout",
+								Usage: "Write the migrated configuration to stdout, instead of rewriting the files",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger, initTelemetry),
+						After:  shutdownTelemetry,
+						Action: func(c *cli.Context) error {
+							if c.NArg() == 0 {
+								return fmt.Errorf("no configuration files specified")
+							}
+
+							for _, path := range c.Args().Slice() {
+								if err := migrateConfig(path, c.Bool("stdout")); err != nil {
+									return err
+								}
+							}
+
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "gc",
+				Usage: "Remove files that are no longer referenced by the repository",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "repository-dir",
+						Aliases: []string{"d"},
+						Usage:   "Directory containing the repository",
+						Value:   "repository",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only report what would be removed",
+					},
+					lockTimeoutFlag,
+				}, append(gcFlags, persistentFlags...)...),
+				Before: util.BeforeAll(initLogger, initTelemetry),
+				After:  shutdownTelemetry,
+				Action: func(c *cli.Context) error {
+					repoDir := c.String("repository-dir")
+
+					unlock, err := lockRepository(c, repoDir)
 					if err != nil {
-						return fmt.Errorf("failed to get package size: %w", err)
+						return err
 					}
-					pkg.Size = int(fi.Size())
+					defer unlock()
 
-					packagesForReleaseComponent[releaseComponent] = append(packagesForReleaseComponent[releaseComponent], *pkg)
-				}
-			}
-		}
-	}
+					result, err := gc.Collect(repoDir, gc.Options{
+						KeepGenerations: c.Int("keep-generations"),
+						GracePeriod:     c.Duration("grace-period"),
+						DryRun:          c.Bool("dry-run"),
+					})
+					if err != nil {
+						return fmt.Errorf("failed to collect garbage: %w", err)
+					}
+
+					slog.Info("Garbage collection complete",
+						slog.Int("generations", len(result.Generations)),
+						slog.Int("files", len(result.Files)))
+
+					return nil
+				},
+			},
+			{
+				Name:  "rollback",
+				Usage: "Republish the previous generation of a repository",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "repository-dir",
+						Aliases: []string{"d"},
+						Usage:   "Directory containing the repository",
+						Value:   "repository",
+					},
+					lockTimeoutFlag,
+				}, persistentFlags...),
+				Before: util.BeforeAll(initLogger, initTelemetry),
+				After:  shutdownTelemetry,
+				Action: func(c *cli.Context) error {
+					repoDir := c.String("repository-dir")
 
-	// Create release files.
-	for _, releaseConf := range conf.Releases {
-		var architectures []arch.Arch
+					unlock, err := lockRepository(c, repoDir)
+					if err != nil {
+						return err
+					}
+					defer unlock()
 
-		for _, componentConf := range releaseConf.Components {
-			releaseComponent := fmt.Sprintf("%s/%s", releaseConf.Name, componentConf.Name)
+					id, err := publish.Rollback(repoDir)
+					if err != nil {
+						return fmt.Errorf("failed to roll back repository: %w", err)
+					}
 
-			for architecture := range archsForReleaseComponent[releaseComponent] {
-				componentDir := filepath.Join(repoDir, "dists", releaseConf.Name, componentConf.Name)
-				archDir := filepath.Join(componentDir, "binary-"+architecture)
+					slog.Info("Rolled back repository", slog.String("generation", id))
 
-				if err := os.MkdirAll(archDir, 0o755); err != nil {
-					return fmt.Errorf("failed to create dists subdirectory: %w", err)
-				}
+					return nil
+				},
+			},
+		},
+	}
 
-				packages := packagesForReleaseComponent[releaseComponent]
+	// Cancel any in-progress work on SIGINT/SIGTERM, so that partially written
+	// output is cleaned up and the published repository is left untouched.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-				// Filter out packages that don't match the architecture.
-				filteredPackages := make([]types.Package, 0, len(packages))
-				for _, pkg := range packages {
-					if pkg.Architecture.String() == architecture {
-						filteredPackages = append(filteredPackages, pkg)
-					}
-				}
-				packages = filteredPackages
+	go func() {
+		<-ctx.Done()
+		// Restore the default behavior, so that a second signal terminates the
+		// process immediately.
+		stop()
+	}()
 
-				sort.Slice(packages, func(i, j int) bool {
-					return packages[i].Compare(packages[j]) < 0
-				})
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		slog.Error("Error", slog.Any("error", err))
+		os.Exit(1)
+	}
+}
+
+// buildRepository builds (or plans) the repository described by the command
+// line flags, returning the resolved packages.
+func buildRepository(c *cli.Context, cache *repository.Cache) (resolved *repository.Resolved, err error) {
+	repoDir := c.String("repository-dir")
 
-				if err := writePackagesIndice(archDir, packages); err != nil {
-					return fmt.Errorf("failed to write package lists: %w", err)
-				}
+	var rep *report.Report
+	if reportPath := c.String("report"); reportPath != "" {
+		rep = report.New(constants.Version)
 
-				if err := writeContentsIndice(repoDir, componentDir, packages, architecture); err != nil {
-					return fmt.Errorf("failed to write contents file: %w", err)
-				}
+		// Record any warnings logged during the build.
+		logger := slog.Default()
+		slog.SetDefault(slog.New(rep.WarningRecorder(logger.Handler())))
 
-				architectures = append(architectures, arch.MustParse(architecture))
+		defer func() {
+			slog.SetDefault(logger)
+
+			if reportErr := rep.WriteFile(reportPath, err); reportErr != nil && err == nil {
+				err = reportErr
 			}
-		}
+		}()
+	}
 
-		releaseDir := filepath.Join(repoDir, "dists", releaseConf.Name)
-		if err := os.MkdirAll(releaseDir, 0o755); err != nil {
-			return fmt.Errorf("failed to create release directory: %w", err)
-		}
+	date, err := util.BuildDate(c.String("date"))
+	if err != nil {
+		return nil, err
+	}
 
-		if err := writeReleaseFile(releaseDir, releaseConf, architectures, privateKey); err != nil {
-			return fmt.Errorf("failed to write release: %w", err)
-		}
+	conf, _, err := loadConfig(c)
+	if err != nil {
+		return nil, err
 	}
 
-	// Save a copy of the signing key.
-	signingKeyFile, err := os.Create(filepath.Join(repoDir, "signing_key.asc"))
+	poolMode, err := pool.ParseMode(conf.Settings.PoolMode)
 	if err != nil {
-		return fmt.Errorf("failed to create signing key file: %w", err)
+		return nil, fmt.Errorf("invalid pool mode: %w", err)
 	}
-	defer signingKeyFile.Close()
 
-	publicKeyWriter, err := armor.Encode(signingKeyFile, openpgp.PublicKeyType, nil)
+	// Hold the lock for the whole build, so that the repository state it is
+	// based on (eg. the previous provenance manifest, the existing indices
+	// used by plan) can't change underneath it.
+	unlock, err := lockRepository(c, repoDir)
 	if err != nil {
-		return fmt.Errorf("failed to encode public key: %w", err)
+		return nil, err
 	}
+	defer unlock()
 
-	if err := privateKey.Serialize(publicKeyWriter); err != nil {
-		return fmt.Errorf("failed to serialize public key: %w", err)
+	previous, err := provenance.Read(filepath.Join(repoDir, "dists", provenance.ManifestName))
+	if err != nil {
+		return nil, err
 	}
 
-	if err := publicKeyWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close public key writer: %w", err)
+	endStage := rep.Stage("resolve")
+	resolved, err = repository.Resolve(c.Context, conf, repository.ResolveOptions{
+		Cache:         cache,
+		Fetcher:       fetch.NewFetcher(c.String("cache-dir"), nil),
+		RepositoryDir: repoDir,
+		Date:          date,
+		Provenance:    previous,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve packages: %w", err)
 	}
+	endStage()
 
-	return nil
-}
+	if c.Bool("locked") {
+		lf, err := lockfile.Read(lockfilePath(c))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := lf.Verify(resolved); err != nil {
+			return nil, err
+		}
+	}
 
-func writePackagesIndice(archDir string, packages []types.Package) error {
-	slog.Info("Writing Packages indice",
-		slog.String("dir", archDir), slog.Int("count", len(packages)))
+	if c.Bool("lint") || (conf.Settings.Lint != nil && conf.Settings.Lint.Enabled) {
+		endStage := rep.Stage("lint")
+		if err := lintPackages(c.Context, conf.Settings.Lint, resolved); err != nil {
+			return nil, err
+		}
+		endStage()
+	}
 
-	var packageList bytes.Buffer
-	if err := deb822.Marshal(&packageList, packages); err != nil {
-		return fmt.Errorf("failed to marshal packages: %w", err)
+	gcOpts := gc.Options{
+		KeepGenerations: c.Int("keep-generations"),
+		GracePeriod:     c.Duration("grace-period"),
 	}
 
-	for _, name := range []string{"Packages", "Packages.xz"} {
-		f, err := os.Create(filepath.Join(archDir, name))
+	buildOpts := repository.BuildOptions{
+		Date:            date,
+		PoolMode:        poolMode,
+		KeepGenerations: gcOpts.KeepGenerations,
+		GracePeriod:     gcOpts.GracePeriod,
+		Report:          rep,
+		Provenance:      provenanceOptions(conf.Settings.Provenance),
+	}
+
+	if c.Bool("plan") {
+		plan, err := repository.PlanBuild(c.Context, repoDir, resolved, buildOpts)
 		if err != nil {
-			return fmt.Errorf("failed to create Packages file: %w", err)
+			return nil, fmt.Errorf("failed to plan build: %w", err)
 		}
-		defer f.Close()
 
-		w, err := uncompr.NewWriter(f, f.Name())
-		if err != nil {
-			return fmt.Errorf("failed to create compression writer: %w", err)
+		switch c.String("plan-format") {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return resolved, enc.Encode(plan)
+		case "text":
+			return resolved, plan.WriteText(os.Stdout)
+		default:
+			return nil, fmt.Errorf("unsupported plan format: %s", c.String("plan-format"))
 		}
-		defer w.Close()
+	}
 
-		if _, err := w.Write(packageList.Bytes()); err != nil {
-			return fmt.Errorf("failed to write Packages file: %w", err)
+	privateKeyPath := filepath.Join(c.String("config-dir"), "aptify_private.asc")
+	if signingConf := conf.Settings.Signing; signingConf != nil && signingConf.PrivateKeyFile != "" {
+		privateKeyPath = signingConf.PrivateKeyFile
+	} else if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("private key not found; run 'aptify init-keys' to generate one")
+	}
+
+	buildOpts.PrivateKey, err = loadPrivateKey(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	slog.Info("Building repository", slog.String("dir", repoDir))
+
+	if err := repository.Build(c.Context, repoDir, resolved, buildOpts); err != nil {
+		return nil, err
+	}
+
+	if c.Bool("prune") {
+		endStage := rep.Stage("prune")
+		if _, err := gc.Collect(repoDir, gcOpts); err != nil {
+			return nil, fmt.Errorf("failed to prune repository: %w", err)
 		}
+		endStage()
 	}
 
-	return nil
+	return resolved, nil
 }
 
-func writeContentsIndice(repoDir, componentDir string, packages []types.Package, arch string) error {
-	f, err := os.Create(filepath.Join(componentDir, fmt.Sprintf("Contents-%s.gz", arch)))
+// lintPackages checks the resolved packages for common mistakes, failing checks
+// are logged and the build fails if any of them have a severity of error.
+func lintPackages(ctx context.Context, conf *v1alpha2.LintConfig, resolved *repository.Resolved) error {
+	linter, err := lint.NewLinter(conf)
 	if err != nil {
-		return fmt.Errorf("failed to create Contents file: %w", err)
+		return fmt.Errorf("invalid lint configuration: %w", err)
 	}
-	defer f.Close()
 
-	w, err := uncompr.NewWriter(f, f.Name())
+	findings, err := linter.LintResolved(ctx, resolved)
 	if err != nil {
-		return fmt.Errorf("failed to create compression writer: %w", err)
+		return err
 	}
-	defer w.Close()
 
-	slog.Info("Collecting package contents", slog.String("dir", componentDir))
+	var errorCount int
+	for _, finding := range findings {
+		attrs := []any{
+			slog.String("check", finding.Check),
+			slog.String("path", finding.Location),
+			slog.String("message", finding.Message),
+		}
 
-	contents := make(map[string][]string)
-	for _, pkg := range packages {
-		pkgContents, err := deb.GetPackageContents(filepath.Join(repoDir, pkg.Filename))
-		if err != nil {
-			return fmt.Errorf("failed to get package contents: %w", err)
+		if finding.Severity == lint.SeverityError {
+			errorCount++
+			slog.Error("Lint check failed", attrs...)
+		} else {
+			slog.Warn("Lint check failed", attrs...)
 		}
+	}
+
+	if errorCount > 0 {
+		return fmt.Errorf("lint failed with %d error(s)", errorCount)
+	}
+
+	return nil
+}
+
+// provenanceOptions returns the provenance to record for newly ingested
+// packages.
+func provenanceOptions(conf *v1alpha2.ProvenanceConfig) provenance.Options {
+	opts := provenance.Options{AptifyVersion: constants.Version}
+	if conf == nil {
+		return opts
+	}
 
-		qualifiedPackageName := pkg.Name
-		if pkg.Section != "" {
-			qualifiedPackageName = fmt.Sprintf("%s/%s", pkg.Section, pkg.Name)
+	opts.Attestations = conf.Attestations
+
+	for _, envVar := range conf.MetadataFromEnv {
+		if value, ok := os.LookupEnv(envVar); ok {
+			if opts.Metadata == nil {
+				opts.Metadata = make(map[string]string)
+			}
+			opts.Metadata[envVar] = value
 		}
+	}
+
+	return opts
+}
+
+// lockfilePath returns the path of the lockfile, by default it is stored
+// alongside the configuration file (or within the configuration directory).
+func lockfilePath(c *cli.Context) string {
+	if path := c.String("lockfile"); path != "" {
+		return path
+	}
 
-		for _, path := range pkgContents {
-			contents[path] = append(contents[path], qualifiedPackageName)
+	if fi, err := os.Stat(c.String("config")); err == nil && fi.IsDir() {
+		return filepath.Join(c.String("config"), lockfile.DefaultName)
+	}
+
+	return filepath.Join(filepath.Dir(c.String("config")), lockfile.DefaultName)
+}
+
+// lockRepository takes an exclusive lock on the repository, so that concurrent
+// builds can't interfere with one another.
+func lockRepository(c *cli.Context, repoDir string) (func(), error) {
+	lock, err := repolock.Acquire(c.Context, repoDir, c.Duration("lock-timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+
+	return func() {
+		if err := lock.Release(); err != nil {
+			slog.Warn("Failed to release repository lock", slog.Any("error", err))
 		}
+	}, nil
+}
+
+// loadConfig reads the configuration file (or directory of configuration
+// files), expanding any variables using the --set flags and the environment.
+// Returns the merged configuration and the paths of every file it was read
+// from.
+func loadConfig(c *cli.Context) (*v1alpha2.Repository, []string, error) {
+	lookupVar, err := configLookup(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conf, files, err := config.Load(c.String("config"), lookupVar)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config: %w", err)
 	}
 
-	paths := make([]string, 0, len(contents))
-	for k := range contents {
-		paths = append(paths, k)
+	return conf, files, nil
+}
+
+// configLookup returns a function that looks up configuration variables in the
+// --set flags, falling back to the environment.
+func configLookup(c *cli.Context) (config.LookupFunc, error) {
+	vars := make(map[string]string)
+	for _, kv := range c.StringSlice("set") {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid variable %q: expected NAME=value", kv)
+		}
+
+		vars[name] = value
 	}
 
-	sort.Strings(paths)
+	return func(name string) (string, bool) {
+		if value, ok := vars[name]; ok {
+			return value, true
+		}
+
+		return os.LookupEnv(name)
+	}, nil
+}
 
-	slog.Info("Writing Contents indice",
-		slog.String("dir", componentDir), slog.Int("count", len(paths)))
+// validateConfig prints any problems with the configuration file (or directory
+// of configuration files) at path, and every file it includes, including
+// conflicts between them, and returns the number of errors found.
+func validateConfig(path string, lookupVar config.LookupFunc) (int, error) {
+	_, paths, loadErr := config.Load(path, lookupVar)
+	if loadErr != nil {
+		// The included files aren't known, so validate what we can to report
+		// problems with their positions.
+		paths = []string{path}
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			paths, err = config.Fragments(path)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
 
+	var errorCount int
 	for _, path := range paths {
-		if _, err := fmt.Fprintf(w, "%s %s\n", path, strings.Join(contents[path], ",")); err != nil {
-			return fmt.Errorf("failed to write contents: %w", err)
+		n, err := validateConfigFile(path, lookupVar)
+		if err != nil {
+			return 0, err
 		}
+		errorCount += n
 	}
 
-	return nil
+	if errorCount > 0 {
+		return errorCount, nil
+	}
+
+	if loadErr != nil {
+		fmt.Printf("%s: error: %s\n", path, loadErr)
+		return 1, nil
+	}
+
+	return 0, nil
 }
 
-func writeReleaseFile(releaseDir string, releaseConf v1alpha1.ReleaseConfig, architectures []arch.Arch, privateKey *openpgp.Entity) error {
-	slog.Info("Writing Release file", slog.String("dir", releaseDir))
+// validateConfigFile prints any problems with a single configuration file, and
+// returns the number of errors found.
+func validateConfigFile(path string, lookupVar config.LookupFunc) (int, error) {
+	confFile, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer confFile.Close()
 
-	var components []string
-	for _, component := range releaseConf.Components {
-		components = append(components, component.Name)
+	problems, err := config.Validate(confFile, lookupVar)
+	if err != nil {
+		return 0, fmt.Errorf("failed to validate %s: %w", path, err)
 	}
 
-	r := types.Release{
-		Origin:        releaseConf.Origin,
-		Label:         releaseConf.Label,
-		Suite:         releaseConf.Suite,
-		Version:       releaseConf.Version,
-		Codename:      releaseConf.Name,
-		Changelogs:    "no",
-		Date:          time.Time(stdtime.Now().UTC()),
-		Architectures: list.SpaceDelimited[arch.Arch](architectures),
-		Components:    list.SpaceDelimited[string](components),
-		Description:   releaseConf.Description,
+	var errorCount int
+	for _, problem := range problems {
+		severity := "error"
+		if problem.Warning {
+			severity = "warning"
+		} else {
+			errorCount++
+		}
+
+		fmt.Printf("%s:%d:%d: %s: %s\n", path, problem.Line, problem.Column, severity, problem.Message)
 	}
 
-	var err error
-	r.SHA256, err = sha256sum.Directory(releaseDir)
-	if err != nil {
-		return fmt.Errorf("failed to hash release: %w", err)
+	if len(problems) == 0 {
+		slog.Info("Configuration is valid", slog.String("path", path))
 	}
 
-	releaseFile, err := os.Create(filepath.Join(releaseDir, "InRelease"))
+	return errorCount, nil
+}
+
+// migrateConfig rewrites the configuration file at path using the latest
+// schema version (or writes it to stdout).
+func migrateConfig(path string, stdout bool) error {
+	confFile, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to create Release file: %w", err)
+		return fmt.Errorf("failed to open config file: %w", err)
 	}
-	defer releaseFile.Close()
+	defer confFile.Close()
 
-	encoder, err := deb822.NewEncoder(releaseFile, privateKey)
+	var migrated bytes.Buffer
+	ok, err := config.Migrate(confFile, &migrated)
 	if err != nil {
-		return fmt.Errorf("failed to create encoder: %w", err)
+		return fmt.Errorf("failed to migrate %s: %w", path, err)
 	}
-	defer encoder.Close()
 
-	if err := encoder.Encode(r); err != nil {
-		return fmt.Errorf("failed to encode release: %w", err)
+	if !ok {
+		slog.Info("Configuration is already up to date", slog.String("path", path))
+		return nil
 	}
 
-	return nil
-}
+	if stdout {
+		_, err := os.Stdout.Write(migrated.Bytes())
+		return err
+	}
 
-func poolPathForPackage(componentName string, pkg *types.Package) string {
-	source := strings.TrimSpace(pkg.Source)
-	if pkg.Source == "" {
-		source = strings.TrimSpace(pkg.Name)
+	fi, err := confFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat config file: %w", err)
 	}
 
-	// If the source has a version, lop it off.
-	if strings.Contains(source, "(") {
-		source = source[:strings.Index(source, "(")]
+	// Write to a temporary file first, so that the original isn't lost if
+	// writing fails.
+	tempPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tempPath, migrated.Bytes(), fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write migrated config: %w", err)
 	}
 
-	prefix := source[:1]
-	if strings.HasPrefix(source, "lib") {
-		prefix = source[:4]
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("failed to replace config file: %w", err)
 	}
 
-	return filepath.Join("pool", componentName, prefix, source,
-		fmt.Sprintf("%s_%s_%s.deb", pkg.Name, pkg.Version, pkg.Architecture))
+	slog.Info("Migrated configuration", slog.String("path", path))
+
+	return nil
 }
 
 func loadPrivateKey(path string) (*openpgp.Entity, error) {